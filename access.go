@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/loginoff/nutanix-backup/nutanixapi"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Transports for reading vdisks from the containers
+const (
+	//Kernel NFS mounts, needs root
+	transportNFS = "nfs"
+	//Directories under nutanix_mount_root where the containers are already mounted
+	transportLocal = "local"
+	//NFS client built in, needs no root
+	transportUserNFS = "userspace-nfs"
+	transportSFTP    = "sftp"
+)
+
+// ContainerAccess makes the files on the containers available. Root mounts
+// or connects to a container on first use, Release undoes what was done.
+// Implementations are safe for concurrent use.
+type ContainerAccess interface {
+	// Root returns the path the files of the container are under
+	Root(UUID string) (string, error)
+	Release() error
+}
+
+// SourceOpener is a ContainerAccess whose paths are not in the local
+// filesystem. Its paths start with Prefix and are opened with Open.
+type SourceOpener interface {
+	ContainerAccess
+	Prefix() string
+	Open(path string) (SourceFile, error)
+	Stat(path string) (os.FileInfo, error)
+}
+
+// newContainerAccess returns access to the containers with the configured
+// transport. Writing, for restores, needs NFS mounts or local directories.
+func newContainerAccess(ntnx *nutanixapi.Client, readwrite bool) (ContainerAccess, error) {
+	switch {
+	case BackupConfig.Transport == transportLocal:
+		return NewLocalAccess(ntnx, BackupConfig.Nutanix_mount_root)
+	case BackupConfig.Transport == transportUserNFS && !readwrite:
+		return NewUserNFSAccess(ntnx, BackupConfig.Nutanix_cvm_addr), nil
+	case BackupConfig.Transport == transportSFTP && !readwrite:
+		return NewSFTPAccess(ntnx, BackupConfig.Nutanix_cvm_addr, BackupConfig.Sftp_port, *username, *password, BackupConfig.Sftp_known_hosts)
+	}
+	return NewNFSAccess(ntnx, BackupConfig.Nutanix_cvm_addr, BackupConfig.Nutanix_mount_root, readwrite)
+}
+
+// containerNames looks up and caches the names of containers, which their
+// exports and directories are named after
+type containerNames struct {
+	mu    sync.Mutex
+	ntnx  *nutanixapi.Client
+	names map[string]string
+}
+
+func newContainerNames(ntnx *nutanixapi.Client) *containerNames {
+	return &containerNames{ntnx: ntnx, names: make(map[string]string)}
+}
+
+func (c *containerNames) name(UUID string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cname, ok := c.names[UUID]; ok {
+		return cname, nil
+	}
+	cname, err := c.ntnx.GetContainerNameByUUID(UUID)
+	if err != nil {
+		log.Warningf("Unable to retreive name for container %s", UUID)
+		return "", err
+	}
+	c.names[UUID] = cname
+	return cname, nil
+}
+
+// LocalAccess reads the containers from directories named after them, for
+// containers mounted outside of the backup, eg. in /etc/fstab, and for tests
+type LocalAccess struct {
+	names *containerNames
+	root  string
+}
+
+func NewLocalAccess(ntnx *nutanixapi.Client, root string) (*LocalAccess, error) {
+	if !IsDir(root) {
+		return nil, fmt.Errorf("%s must be a directory", root)
+	}
+	return &LocalAccess{names: newContainerNames(ntnx), root: root}, nil
+}
+
+func (a *LocalAccess) Root(UUID string) (string, error) {
+	cname, err := a.names.name(UUID)
+	if err != nil {
+		return "", err
+	}
+	root := filepath.Join(a.root, cname)
+	if !IsDir(root) {
+		return "", fmt.Errorf("Container %s is not available in %s", cname, root)
+	}
+	return root, nil
+}
+
+func (a *LocalAccess) Release() error {
+	return nil
+}
+
+// openSource opens a vdisk, through the container access when the path is
+// one of its own
+func openSource(path string) (SourceFile, error) {
+	if opener, ok := containers.(SourceOpener); ok && strings.HasPrefix(path, opener.Prefix()) {
+		return opener.Open(strings.TrimPrefix(path, opener.Prefix()))
+	}
+	return os.Open(path)
+}
+
+func statSource(path string) (os.FileInfo, error) {
+	if opener, ok := containers.(SourceOpener); ok && strings.HasPrefix(path, opener.Prefix()) {
+		return opener.Stat(strings.TrimPrefix(path, opener.Prefix()))
+	}
+	return os.Stat(path)
+}
+
+// dataRegion is nextDataRegion for any source. Holes can only be found in
+// local files, in others they are read as zeroes.
+func dataRegion(f SourceFile, offset, size int64) (start, end int64, err error) {
+	if local, ok := f.(*os.File); ok {
+		return nextDataRegion(local, offset, size)
+	}
+	return offset, size, nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const catalogFile = "catalog.json"
+
+// Catalog is an index of the backups stored in backup_root
+type Catalog struct {
+	mu      sync.Mutex
+	path    string
+	Backups []CatalogEntry `json:"backups"`
+}
+
+type CatalogEntry struct {
+	//Name of the backup directory, which is also the name of the snapshot
+	Name         string        `json:"name"`
+	VM           string        `json:"vm"`
+	VMUUID       string        `json:"vmUuid"`
+	SnapshotUUID string        `json:"snapshotUuid"`
+	Time         time.Time     `json:"time"`
+	Status       string        `json:"status"`
+	Verified     time.Time     `json:"verified,omitempty"`
+	Size         int64         `json:"size"`
+	Disks        []CatalogDisk `json:"disks"`
+	//Backup an incremental backup is based on
+	Base string `json:"base,omitempty"`
+	//The snapshot was kept on the cluster for the next incremental backup
+	SnapshotRetained bool   `json:"snapshotRetained,omitempty"`
+	Compression      string `json:"compression,omitempty"`
+	KeyID            string `json:"keyId,omitempty"`
+	Consistency      string `json:"consistency,omitempty"`
+}
+
+type CatalogDisk struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"sha256"`
+}
+
+func OpenCatalog(path string) (*Catalog, error) {
+	c := &Catalog{path: path}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(c); err != nil {
+		return nil, fmt.Errorf("Corrupt catalog %s: %s", path, err)
+	}
+	return c, nil
+}
+
+// Add records a backup, replacing an earlier entry with the same name
+func (c *Catalog) Add(entry CatalogEntry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.remove(entry.Name)
+	c.Backups = append(c.Backups, entry)
+	sort.Slice(c.Backups, func(i, j int) bool {
+		return c.Backups[i].Time.Before(c.Backups[j].Time)
+	})
+	return c.save()
+}
+
+func (c *Catalog) Remove(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.remove(name)
+	return c.save()
+}
+
+func (c *Catalog) remove(name string) {
+	var remaining []CatalogEntry
+	for _, entry := range c.Backups {
+		if entry.Name != name {
+			remaining = append(remaining, entry)
+		}
+	}
+	c.Backups = remaining
+}
+
+// SetVerified records the outcome of verifying a backup
+func (c *Catalog) SetVerified(name, status string, t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := range c.Backups {
+		if c.Backups[i].Name == name {
+			c.Backups[i].Status = status
+			c.Backups[i].Verified = t
+			return c.save()
+		}
+	}
+	return nil
+}
+
+// SetSnapshotRetained records whether the snapshot of a backup still exists on the cluster
+func (c *Catalog) SetSnapshotRetained(name string, retained bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := range c.Backups {
+		if c.Backups[i].Name == name {
+			c.Backups[i].SnapshotRetained = retained
+			return c.save()
+		}
+	}
+	return nil
+}
+
+func (c *Catalog) Get(name string) (CatalogEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, entry := range c.Backups {
+		if entry.Name == name {
+			return entry, true
+		}
+	}
+	return CatalogEntry{}, false
+}
+
+// Find returns the backups of VMs matching the vm glob pattern, taken between since and until.
+// Empty arguments match everything.
+func (c *Catalog) Find(vm string, since, until time.Time) []CatalogEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var found []CatalogEntry
+	for _, entry := range c.Backups {
+		if vm != "" {
+			if ok, _ := filepath.Match(vm, entry.VM); !ok {
+				continue
+			}
+		}
+		if !since.IsZero() && entry.Time.Before(since) {
+			continue
+		}
+		if !until.IsZero() && !entry.Time.Before(until) {
+			continue
+		}
+		found = append(found, entry)
+	}
+	return found
+}
+
+// save writes the catalog to a temporary file and renames it over the old one.
+// Must be called with c.mu held
+func (c *Catalog) save() error {
+	tmp := c.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+
+	e := json.NewEncoder(f)
+	e.SetIndent("", "\t")
+	if err := e.Encode(c); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// parseDate parses dates given on the command line, either 2006-01-02 or 2006-01-02T15:04
+func parseDate(date string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02", "2006-01-02T15:04"} {
+		if t, err := time.ParseInLocation(layout, date, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Invalid date %q, use 2006-01-02 or 2006-01-02T15:04", date)
+}
+
+func runList(args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	vm := fs.String("vm", "", "Only list backups of VMs matching this name or glob pattern")
+	since := fs.String("since", "", "Only list backups taken on or after this date")
+	until := fs.String("until", "", "Only list backups taken before the end of this date")
+	fs.Parse(args)
+
+	var from, to time.Time
+	var err error
+	if *since != "" {
+		if from, err = parseDate(*since); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *until != "" {
+		if to, err = parseDate(*until); err != nil {
+			log.Fatal(err)
+		}
+		//A plain date includes the whole day
+		if len(*until) == len("2006-01-02") {
+			to = to.AddDate(0, 0, 1)
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "BACKUP\tVM\tTIME\tDISKS\tSIZE\tSTATUS")
+	for _, entry := range catalog.Find(*vm, from, to) {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", entry.Name, entry.VM, entry.Time.Format("2006-01-02 15:04"),
+			len(entry.Disks), formatBytes(entry.Size), entry.Status)
+	}
+	w.Flush()
+}
+
+func runShow(args []string) {
+	if len(args) != 1 {
+		log.Fatal("Specify the name of the backup to show")
+	}
+
+	entry, ok := catalog.Get(args[0])
+	if !ok {
+		log.Fatalf("No backup named %s in the catalog", args[0])
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Backup:\t%s\n", entry.Name)
+	fmt.Fprintf(w, "Path:\t%s\n", filepath.Join(BackupConfig.Backup_root, entry.Name))
+	fmt.Fprintf(w, "VM:\t%s (%s)\n", entry.VM, entry.VMUUID)
+	if entry.SnapshotRetained {
+		fmt.Fprintf(w, "Snapshot:\t%s (kept on the cluster)\n", entry.SnapshotUUID)
+	} else {
+		fmt.Fprintf(w, "Snapshot:\t%s\n", entry.SnapshotUUID)
+	}
+	if entry.Base != "" {
+		fmt.Fprintf(w, "Incremental on:\t%s\n", entry.Base)
+	}
+	fmt.Fprintf(w, "Time:\t%s\n", entry.Time.Format(time.RFC3339))
+	fmt.Fprintf(w, "Status:\t%s\n", entry.Status)
+	fmt.Fprintf(w, "Size:\t%s\n", formatBytes(entry.Size))
+	if entry.Compression != "" {
+		fmt.Fprintf(w, "Compression:\t%s\n", entry.Compression)
+	}
+	if entry.KeyID != "" {
+		fmt.Fprintf(w, "Encrypted with key:\t%s\n", entry.KeyID)
+	}
+	if entry.Consistency != "" {
+		fmt.Fprintf(w, "Consistency:\t%s\n", entry.Consistency)
+	}
+	w.Flush()
+
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DISK\tSIZE\tSHA256")
+	for _, disk := range entry.Disks {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", disk.Name, formatBytes(disk.Size), disk.Checksum)
+	}
+	w.Flush()
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func catalogEntry(vm, when string) CatalogEntry {
+	t, err := time.ParseInLocation(snapshotTimeFormat, when, time.Local)
+	if err != nil {
+		panic(err)
+	}
+	return CatalogEntry{Name: vm + "_backup_" + when, VM: vm, Time: t, Status: statusOK}
+}
+
+func TestCatalog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), catalogFile)
+	c, err := OpenCatalog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []CatalogEntry{
+		catalogEntry("web1", "20240115_1000"),
+		catalogEntry("db1", "20240114_2300"),
+		catalogEntry("web2", "20240116_0100"),
+		catalogEntry("web1", "20240113_1000"),
+	} {
+		if err := c.Add(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//Added again after a failed backup was retried
+	retried := catalogEntry("web1", "20240115_1000")
+	retried.Size = 100
+	if err := c.Add(retried); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+
+	//Kept across runs
+	c, err = OpenCatalog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Backups) != 4 {
+		t.Fatalf("%d entries, want 4", len(c.Backups))
+	}
+	for i := 1; i < len(c.Backups); i++ {
+		if c.Backups[i].Time.Before(c.Backups[i-1].Time) {
+			t.Fatalf("entries not in order of time: %v", c.Backups)
+		}
+	}
+	if entry, ok := c.Get("web1_backup_20240115_1000"); !ok || entry.Size != 100 {
+		t.Fatalf("got %v, %v, want the retried entry", entry, ok)
+	}
+
+	day := func(date string) time.Time {
+		t, _ := parseDate(date)
+		return t
+	}
+	tests := []struct {
+		name         string
+		vm           string
+		since, until time.Time
+		want         []string
+	}{
+		{name: "all", want: []string{"web1_backup_20240113_1000", "db1_backup_20240114_2300", "web1_backup_20240115_1000", "web2_backup_20240116_0100"}},
+		{name: "vm", vm: "web1", want: []string{"web1_backup_20240113_1000", "web1_backup_20240115_1000"}},
+		{name: "pattern", vm: "web*", since: day("2024-01-14"), want: []string{"web1_backup_20240115_1000", "web2_backup_20240116_0100"}},
+		{name: "until is exclusive", until: day("2024-01-15T10:00"), want: []string{"web1_backup_20240113_1000", "db1_backup_20240114_2300"}},
+		{name: "range", since: day("2024-01-14"), until: day("2024-01-16"), want: []string{"db1_backup_20240114_2300", "web1_backup_20240115_1000"}},
+		{name: "no match", vm: "mail*"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []string
+			for _, entry := range c.Find(test.vm, test.since, test.until) {
+				got = append(got, entry.Name)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("found %q, want %q", got, test.want)
+			}
+		})
+	}
+
+	if err := c.Remove("db1_backup_20240114_2300"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Get("db1_backup_20240114_2300"); ok {
+		t.Fatal("removed entry still in the catalog")
+	}
+}
+
+func TestCatalogSaveFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), catalogFile)
+	c, err := OpenCatalog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Add(catalogEntry("web1", "20240115_1000")); err != nil {
+		t.Fatal(err)
+	}
+
+	//The temporary file can't be written, the saved catalog stays as it was
+	if err := os.Mkdir(path+".tmp", 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Add(catalogEntry("web1", "20240116_1000")); err == nil {
+		t.Fatal("saved the catalog without writing it")
+	}
+	saved, err := OpenCatalog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Backups) != 1 {
+		t.Fatalf("saved catalog has %d entries, want 1", len(saved.Backups))
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"backups": [`), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenCatalog(path); err == nil {
+		t.Fatal("opened a corrupt catalog")
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	tests := []struct {
+		date string
+		want time.Time
+		ok   bool
+	}{
+		{date: "2024-01-15", want: time.Date(2024, 1, 15, 0, 0, 0, 0, time.Local), ok: true},
+		{date: "2024-01-15T10:30", want: time.Date(2024, 1, 15, 10, 30, 0, 0, time.Local), ok: true},
+		{date: "15.01.2024"},
+		{date: "2024-01-15 10:30"},
+		{date: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.date, func(t *testing.T) {
+			got, err := parseDate(test.date)
+			if (err == nil) != test.ok {
+				t.Fatalf("parseDate returned %v", err)
+			}
+			if !got.Equal(test.want) {
+				t.Fatalf("parsed %s, want %s", got, test.want)
+			}
+		})
+	}
+}
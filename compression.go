@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codecs disk images can be compressed with, by the extension of the compressed files
+const (
+	compressionNone = "none"
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+)
+
+var compressionExtensions = map[string]string{
+	compressionNone: "",
+	compressionGzip: ".gz",
+	compressionZstd: ".zst",
+}
+
+// Describes how the files of a backup are stored, written next to ahv_vm
+const backupMetaFile = "backup.json"
+
+type BackupMeta struct {
+	Compression string `json:"compression"`
+	//ID of the key the files are encrypted with
+	KeyID string `json:"keyId,omitempty"`
+	//crash or application, empty in backups from before it was recorded
+	Consistency string `json:"consistency,omitempty"`
+	//Checksums of the uncompressed contents of the compressed files
+	Checksums map[string]string `json:"checksums,omitempty"`
+}
+
+func readBackupMeta(backup_path string) (*BackupMeta, error) {
+	f, err := os.Open(filepath.Join(backup_path, backupMetaFile))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var meta BackupMeta
+	err = json.NewDecoder(f).Decode(&meta)
+	return &meta, err
+}
+
+func writeBackupMeta(backup_path string, meta *BackupMeta) error {
+	f, err := os.OpenFile(filepath.Join(backup_path, backupMetaFile), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	e := json.NewEncoder(f)
+	e.SetIndent("", "\t")
+	return e.Encode(meta)
+}
+
+func validCompression(codec string) error {
+	if _, ok := compressionExtensions[codec]; !ok {
+		return fmt.Errorf("Unknown compression %q, use zstd, gzip or none", codec)
+	}
+	return nil
+}
+
+// compressionFor returns the codec configured for the VM, or the global one
+func compressionFor(vm *VMBackup) string {
+	if vm.Compression != "" {
+		return vm.Compression
+	}
+	if BackupConfig.Compression != "" {
+		return BackupConfig.Compression
+	}
+	return compressionNone
+}
+
+// StorageFormat is how files are written into backups
+type StorageFormat struct {
+	Codec string
+	//Not encrypted when nil
+	Key *EncryptionKey
+}
+
+// Ext returns the extension of files stored in the format
+func (f StorageFormat) Ext() string {
+	ext := compressionExtensions[f.Codec]
+	if f.Key != nil {
+		ext += encryptedSuffix
+	}
+	return ext
+}
+
+// Raw reports whether files are stored as they are
+func (f StorageFormat) Raw() bool {
+	return f.Codec == compressionNone && f.Key == nil
+}
+
+// Writer returns a writer that compresses and encrypts into w. Closing it
+// flushes everything into w, but doesn't close w.
+func (f StorageFormat) Writer(w io.Writer) (io.WriteCloser, error) {
+	encrypted, err := encrypt(f.Key, w)
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := compressWriter(f.Codec, encrypted)
+	if err != nil {
+		return nil, err
+	}
+	return &storedWriter{WriteCloser: compressed, encrypted: encrypted}, nil
+}
+
+type storedWriter struct {
+	io.WriteCloser
+	encrypted io.WriteCloser
+}
+
+func (w *storedWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	return w.encrypted.Close()
+}
+
+// codecOf returns the codec a stored file is compressed with, by its extension
+func codecOf(name string) string {
+	name = strings.TrimSuffix(name, encryptedSuffix)
+	for codec, ext := range compressionExtensions {
+		if ext != "" && strings.HasSuffix(name, ext) {
+			return codec
+		}
+	}
+	return compressionNone
+}
+
+// plainName strips the extensions of the codec and encryption from a stored file name
+func plainName(name string) string {
+	name = strings.TrimSuffix(name, encryptedSuffix)
+	return strings.TrimSuffix(name, compressionExtensions[codecOf(name)])
+}
+
+// storedImage returns the path of the image of a disk in a backup directory,
+// whichever format it was stored in
+func storedImage(backup_path, disk string) (string, bool) {
+	for _, ext := range compressionExtensions {
+		for _, suffix := range []string{"", encryptedSuffix} {
+			path := filepath.Join(backup_path, disk+ext+suffix)
+			if exists(path) {
+				return path, true
+			}
+		}
+	}
+	return "", false
+}
+
+func compressWriter(codec string, w io.Writer) (io.WriteCloser, error) {
+	switch codec {
+	case compressionGzip:
+		return gzip.NewWriter(w), nil
+	case compressionZstd:
+		return zstd.NewWriter(w)
+	}
+	return nopWriteCloser{w}, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// storedReader closes the decompressor along with the file
+type storedReader struct {
+	io.Reader
+	closers []func() error
+}
+
+func (r *storedReader) Close() error {
+	var err error
+	for _, c := range r.closers {
+		if cerr := c(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// decompressReader wraps r in a decompressor for codec
+func decompressReader(codec string, r io.Reader) (io.ReadCloser, error) {
+	switch codec {
+	case compressionGzip:
+		return gzip.NewReader(r)
+	case compressionZstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return ioutil.NopCloser(r), nil
+}
+
+// openStored opens a file in a backup, decrypts it if it is encrypted and
+// decompresses it according to its extension
+func openStored(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return wrapStored(path, f, encryptionRequired(path, filepath.Dir(path)))
+}
+
+// openStoredObject opens an object in the storage like openStored
+func openStoredObject(ctx context.Context, name string) (io.ReadCloser, error) {
+	r, err := storage.Open(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	//The metadata of backups is kept in backup_root
+	backup_path := filepath.Join(BackupConfig.Backup_root, path.Dir(name))
+	return wrapStored(name, r, encryptionRequired(name, backup_path))
+}
+
+// encryptionRequired reports whether the stored file name, in the backup at
+// backup_path, must be encrypted: its name says so or the backup was
+// encrypted. Whether a file is decrypted is not left to its header alone, or
+// a file replaced by a plain one would be read as it is. Backups from before
+// a key was configured stay readable.
+func encryptionRequired(name, backup_path string) bool {
+	if strings.HasSuffix(name, encryptedSuffix) {
+		return true
+	}
+	meta, err := readBackupMeta(backup_path)
+	return err == nil && meta.KeyID != ""
+}
+
+// wrapStored decrypts and decompresses the stored file name read from f, and
+// closes f when the returned reader is closed. Fails when the file is not
+// encrypted but encrypted is set.
+func wrapStored(name string, f io.ReadCloser, encrypted bool) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(f)
+	var r io.Reader = buffered
+	if isEncrypted(buffered) {
+		var err error
+		if r, err = newDecryptReader(name, buffered); err != nil {
+			f.Close()
+			return nil, err
+		}
+	} else if encrypted {
+		f.Close()
+		return nil, fmt.Errorf("%s is not encrypted but should be, it was replaced or is from before encryption was configured", name)
+	}
+	d, err := decompressReader(codecOf(name), r)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &storedReader{Reader: d, closers: []func() error{d.Close, f.Close}}, nil
+}
+
+// hashStored returns the checksum of the uncompressed contents of a stored file
+func hashStored(ctx context.Context, path string) (string, error) {
+	r, err := openStored(path)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	return hashReader(ctx, r)
+}
+
+// hashReader returns the checksum of everything read from r
+func hashReader(ctx context.Context, r io.Reader) (string, error) {
+	sum := sha256.New()
+	buf := make([]byte, copyChunkSize)
+	for {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		n, err := r.Read(buf)
+		sum.Write(buf[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// storeImage copies src to dst, compressed and encrypted according to format.
+// Holes in src are read as zeroes, which take next to no space once compressed.
+// Returns the checksum of the image and of the stored file.
+func storeImage(ctx context.Context, src, dst string, format StorageFormat, limiter *RateLimiter, blocks *blockHasher) (checksum, file_checksum string, err error) {
+	//Written under a temporary name, so backups with a stored image
+	//that is not finished are incomplete
+	tmp := dst + partialSuffix
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return "", "", err
+	}
+	defer out.Close()
+
+	if checksum, file_checksum, err = streamImage(ctx, src, dst, out, format, limiter, blocks); err != nil {
+		return "", "", err
+	}
+	if err := out.Sync(); err != nil {
+		return "", "", err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return "", "", err
+	}
+	return checksum, file_checksum, nil
+}
+
+// streamImage writes src into out, compressed and encrypted according to
+// format, and the block map of src into blocks. dst names out in the
+// progress messages.
+func streamImage(ctx context.Context, src, dst string, out io.Writer, format StorageFormat, limiter *RateLimiter, blocks *blockHasher) (checksum, file_checksum string, err error) {
+	in, err := openSource(src)
+	if err != nil {
+		return "", "", err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return "", "", err
+	}
+
+	file_sum := sha256.New()
+	counter := &countingWriter{}
+	buffered := bufio.NewWriter(io.MultiWriter(out, file_sum, counter))
+	w, err := format.Writer(buffered)
+	if err != nil {
+		return "", "", err
+	}
+
+	image_sum := sha256.New()
+	progress := CopyProgress{Src: src, Dst: dst, Size: info.Size()}
+	start := time.Now()
+	last_progress := start
+	blocks.reset()
+
+	err = forEachBlock(ctx, in, info.Size(), limiter, func(offset int64, block []byte, hole bool) error {
+		image_sum.Write(block)
+		if hole {
+			blocks.zeroes(int64(len(block)))
+		} else {
+			blocks.Write(block)
+		}
+		if !hole {
+			progress.BytesRead += int64(len(block))
+		}
+		progress.Offset = offset + int64(len(block))
+		if now := time.Now(); now.Sub(last_progress) >= progressInterval {
+			progress.Elapsed = now.Sub(start)
+			progress.BytesWritten = counter.n
+			logProgress(progress)
+			last_progress = now
+		}
+		_, err := w.Write(block)
+		return err
+	})
+	if err != nil {
+		return "", "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", "", err
+	}
+	if err := buffered.Flush(); err != nil {
+		return "", "", err
+	}
+
+	progress.BytesWritten = counter.n
+	progress.Elapsed = time.Since(start)
+	progress.Done = true
+	logProgress(progress)
+	return hex.EncodeToString(image_sum.Sum(nil)), hex.EncodeToString(file_sum.Sum(nil)), nil
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// extractImage copies an image stored in a backup to dst, decrypting and
+// decompressing it if needed. Blocks of zeroes are left as holes.
+func extractImage(ctx context.Context, src, dst string) error {
+	if codecOf(src) == compressionNone && !encryptionRequired(src, filepath.Dir(src)) {
+		_, err := copyImage(ctx, src, dst, nil)
+		return err
+	}
+
+	r, err := openStored(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	log.Infof("Extracting %s to %s", src, dst)
+	return extractTo(ctx, r, dst)
+}
+
+// extractObject copies an image stored as an object in the storage to dst
+func extractObject(ctx context.Context, name, dst string) error {
+	r, err := openStoredObject(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	log.Infof("Extracting %s/%s to %s", storage, name, dst)
+	return extractTo(ctx, r, dst)
+}
+
+// extractTo writes the image read from r to dst, leaving blocks of zeroes as holes
+func extractTo(ctx context.Context, r io.Reader, dst string) error {
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	buf := make([]byte, copyChunkSize)
+	var offset int64
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		n, err := io.ReadFull(r, buf)
+		if n > 0 && !isZero(buf[:n]) {
+			if _, err := out.WriteAt(buf[:n], offset); err != nil {
+				return err
+			}
+		}
+		offset += int64(n)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	//Trailing holes
+	if err := out.Truncate(offset); err != nil {
+		return err
+	}
+	return out.Sync()
+}
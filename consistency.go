@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/loginoff/nutanix-backup/nutanixapi"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Consistency of snapshots, recorded in the metadata of backups
+const (
+	consistencyCrash = "crash"
+	//The guest was quiesced through Nutanix Guest Tools, VSS on Windows
+	consistencyApplication = "application"
+)
+
+// What to do when an application consistent snapshot can't be taken
+const (
+	fallbackFail  = "fail"
+	fallbackCrash = "crash"
+)
+
+func validConsistency(consistency, fallback string) error {
+	switch consistency {
+	case "", consistencyCrash, consistencyApplication:
+	default:
+		return fmt.Errorf("Unknown consistency %q, use crash or application", consistency)
+	}
+	switch fallback {
+	case "", fallbackFail, fallbackCrash:
+	default:
+		return fmt.Errorf("Unknown consistency_fallback %q, use fail or crash", fallback)
+	}
+	return nil
+}
+
+// consistencyFor returns the consistency of the snapshots of the VM, or the
+// global one
+func consistencyFor(vm *VMBackup) string {
+	if vm.Consistency != "" {
+		return vm.Consistency
+	}
+	if BackupConfig.Consistency != "" {
+		return BackupConfig.Consistency
+	}
+	return consistencyCrash
+}
+
+// fallbackFor returns what to do when the VM can't be quiesced
+func fallbackFor(vm *VMBackup) string {
+	if vm.Consistency_fallback != "" {
+		return vm.Consistency_fallback
+	}
+	if BackupConfig.Consistency_fallback != "" {
+		return BackupConfig.Consistency_fallback
+	}
+	return fallbackFail
+}
+
+// checkConsistency catches snapshots that were taken crash consistent even
+// though an application consistent one was asked for. Returns the
+// consistency of the snapshot.
+func checkConsistency(vm *VMBackup, consistency string, snapshot_info *nutanixapi.AHVSnapshotInfo) (string, error) {
+	if consistency != consistencyApplication || snapshot_info.AppConsistent == nil || *snapshot_info.AppConsistent {
+		return consistency, nil
+	}
+	if fallbackFor(vm) == fallbackCrash {
+		log.Warnf("The snapshot of %s is only crash consistent, the guest was not quiesced", vm.Name)
+		return consistencyCrash, nil
+	}
+	return "", fmt.Errorf("The snapshot of %s is only crash consistent, the guest was not quiesced", vm.Name)
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	copyChunkSize = 1024 * 1024
+	//Suffix of the checkpoint file kept next to a partially copied image
+	partialSuffix      = ".partial"
+	checkpointInterval = 30 * time.Second
+	progressInterval   = 10 * time.Second
+)
+
+var zeroChunk = make([]byte, copyChunkSize)
+
+// CopyProgress is reported periodically while an image is being copied
+type CopyProgress struct {
+	Src  string
+	Dst  string
+	Size int64
+	//Position in the source up to which everything has been copied
+	Offset int64
+	//Data read from the source and written to the destination in this copy,
+	//holes in the source and blocks of zeroes are not written
+	BytesRead    int64
+	BytesWritten int64
+	Elapsed      time.Duration
+	Resumed      bool
+	Done         bool
+}
+
+// Copier copies disk images, preserving holes in sparse files, and computes
+// their SHA-256 checksum on the way. A copy that failed can be resumed from
+// the last checkpoint by copying again.
+type Copier struct {
+	Limiter  *RateLimiter
+	Progress func(CopyProgress)
+	//Gets the block map of the image, when set
+	Blocks *blockHasher
+}
+
+type copyCheckpoint struct {
+	Source  string    `json:"source"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Offset  int64     `json:"offset"`
+	//State of the checksum of everything before Offset
+	HashState []byte `json:"hashState"`
+}
+
+// Copy copies src to dst and returns the hex encoded SHA-256 checksum of the image
+func (c *Copier) Copy(ctx context.Context, src, dst string) (checksum string, err error) {
+	in, err := openSource(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return "", err
+	}
+	size := info.Size()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE, 0640)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	checkpoint_path := dst + partialSuffix
+	progress := CopyProgress{Src: src, Dst: dst, Size: size}
+	sum := sha256.New()
+	if cp, err := readCheckpoint(checkpoint_path); err == nil &&
+		cp.Source == src && cp.Size == size && cp.ModTime.Equal(info.ModTime()) &&
+		sum.(encoding.BinaryUnmarshaler).UnmarshalBinary(cp.HashState) == nil {
+		log.Infof("Resuming copy of %s at %s", src, formatBytes(cp.Offset))
+		progress.Offset = cp.Offset
+		progress.Resumed = true
+		c.Blocks.restore(cp.Offset)
+	} else {
+		sum.Reset()
+		c.Blocks.reset()
+	}
+
+	//Anything past the checkpoint may have been partially written. Drop it,
+	//so the blocks of zeroes skipped below read back as zeroes.
+	if err := out.Truncate(progress.Offset); err != nil {
+		return "", err
+	}
+
+	//Whatever happens, leave a checkpoint to resume from
+	defer func() {
+		if err != nil && progress.Offset > 0 {
+			if cperr := c.checkpoint(out, checkpoint_path, src, info, progress.Offset, sum); cperr != nil {
+				log.Warnf("Unable to save checkpoint for %s: %s", dst, cperr)
+			}
+		}
+	}()
+
+	start := time.Now()
+	last_progress, last_checkpoint := start, start
+	buf := make([]byte, copyChunkSize)
+
+	for progress.Offset < size {
+		data, end, err := dataRegion(in, progress.Offset, size)
+		if err != nil {
+			return "", err
+		}
+		//Skip the hole, it reads as zeroes
+		hashZeroes(sum, data-progress.Offset)
+		c.Blocks.zeroes(data - progress.Offset)
+		progress.Offset = data
+
+		for progress.Offset < end {
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+
+			n := end - progress.Offset
+			if n > copyChunkSize {
+				n = copyChunkSize
+			}
+			if err := c.Limiter.Wait(ctx, int(n)); err != nil {
+				return "", err
+			}
+
+			read, err := in.ReadAt(buf[:n], progress.Offset)
+			if int64(read) < n {
+				if err == nil || err == io.EOF {
+					err = fmt.Errorf("%s shrank while copying", src)
+				}
+				return "", err
+			}
+
+			if !bytes.Equal(buf[:n], zeroChunk[:n]) {
+				if _, err := out.WriteAt(buf[:n], progress.Offset); err != nil {
+					return "", err
+				}
+				progress.BytesWritten += n
+			}
+			sum.Write(buf[:n])
+			c.Blocks.Write(buf[:n])
+			progress.BytesRead += n
+			progress.Offset += n
+
+			now := time.Now()
+			if now.Sub(last_checkpoint) >= checkpointInterval {
+				if err := c.checkpoint(out, checkpoint_path, src, info, progress.Offset, sum); err != nil {
+					return "", err
+				}
+				last_checkpoint = now
+			}
+			if c.Progress != nil && now.Sub(last_progress) >= progressInterval {
+				progress.Elapsed = now.Sub(start)
+				c.Progress(progress)
+				last_progress = now
+			}
+		}
+	}
+
+	//Trailing holes
+	if err := out.Truncate(size); err != nil {
+		return "", err
+	}
+	if err := out.Sync(); err != nil {
+		return "", err
+	}
+	if err := os.Remove(checkpoint_path); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	if c.Progress != nil {
+		progress.Elapsed = time.Since(start)
+		progress.Done = true
+		c.Progress(progress)
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// removePartial deletes what failed copies to dst left behind. The copies of
+// interrupted backups are kept instead, the next run resumes them from the
+// same snapshot into the same directory.
+func removePartial(dst string) {
+	for _, path := range []string{dst, dst + partialSuffix, dst + partialSuffix + ".tmp"} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Warnf("Unable to remove %s: %s", path, err)
+		}
+	}
+}
+
+// hashZeroes adds n zero bytes to the checksum
+func hashZeroes(sum hash.Hash, n int64) {
+	for n > 0 {
+		chunk := n
+		if chunk > copyChunkSize {
+			chunk = copyChunkSize
+		}
+		sum.Write(zeroChunk[:chunk])
+		n -= chunk
+	}
+}
+
+// checkpoint flushes the copied data to disk and records how far the copy got
+func (c *Copier) checkpoint(out *os.File, path, src string, info os.FileInfo, offset int64, sum hash.Hash) error {
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	hash_state, err := sum.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(f).Encode(copyCheckpoint{
+		Source:    src,
+		Size:      info.Size(),
+		ModTime:   info.ModTime(),
+		Offset:    offset,
+		HashState: hash_state,
+	})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	c.Blocks.checkpoint(offset)
+	return nil
+}
+
+func readCheckpoint(path string) (*copyCheckpoint, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cp copyCheckpoint
+	err = json.NewDecoder(f).Decode(&cp)
+	return &cp, err
+}
+
+func logProgress(p CopyProgress) {
+	percent := int64(100)
+	if p.Size > 0 {
+		percent = p.Offset * 100 / p.Size
+	}
+	entry := log.WithFields(log.Fields{
+		"src":     p.Src,
+		"dst":     p.Dst,
+		"read":    formatBytes(p.BytesRead),
+		"written": formatBytes(p.BytesWritten),
+		"percent": percent,
+	})
+
+	if p.Done {
+		entry.Infof("Finished copying %s in %s", p.Dst, p.Elapsed.Round(time.Second))
+	} else {
+		entry.Infof("Copying %s, %d%% done", p.Dst, percent)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// copyImageFile copies src with c into a new file, and returns the file and
+// the progress reported at the end
+func copyImageFile(t *testing.T, c *Copier, src string) (string, CopyProgress) {
+	dst := filepath.Join(t.TempDir(), "copy")
+	var done CopyProgress
+	c.Progress = func(p CopyProgress) {
+		if p.Done {
+			done = p
+		}
+	}
+	checksum, err := c.Copy(context.Background(), src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checksum != sha256Hex(data) {
+		t.Fatal("checksum differs from the image")
+	}
+	if got, err := ioutil.ReadFile(dst); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("copy differs from the image (%v)", err)
+	}
+	return dst, done
+}
+
+func TestCopySparse(t *testing.T) {
+	const mb = 1024 * 1024
+	block := randomData(10, 64*1024)
+	tests := []struct {
+		name string
+		size int64
+		data map[int64][]byte
+		//Bytes read from the image and written to the copy
+		read, written int64
+	}{
+		{name: "empty", size: 0},
+		{name: "only a hole", size: 8 * mb},
+		{name: "hole in the middle", size: 4 * mb, data: map[int64][]byte{0: block, 3 * mb: block}, read: 2 * 64 * 1024, written: 2 * 64 * 1024},
+		{name: "trailing hole", size: 4 * mb, data: map[int64][]byte{mb: block}, read: 64 * 1024, written: 64 * 1024},
+		//Written zeroes are read, but not written to the copy
+		{name: "zeroes", size: 2 * mb, data: map[int64][]byte{0: make([]byte, mb), mb: block}, read: mb + 64*1024, written: 64 * 1024},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			src := sparseImage(t, test.size, test.data)
+			dst, done := copyImageFile(t, &Copier{}, src)
+			if !done.Done || done.Offset != test.size {
+				t.Fatalf("copy done at %d of %d bytes", done.Offset, test.size)
+			}
+			if done.BytesRead != test.read || done.BytesWritten != test.written {
+				t.Errorf("read %d and wrote %d bytes, want %d and %d", done.BytesRead, done.BytesWritten, test.read, test.written)
+			}
+			info, err := os.Stat(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if allocated := allocatedSize(info); allocated > test.written+64*1024 {
+				t.Errorf("copy takes up %d bytes, %d written", allocated, test.written)
+			}
+		})
+	}
+}
+
+func TestCopyResume(t *testing.T) {
+	const mb = 1024 * 1024
+	tests := []struct {
+		name string
+		//Changes the image or the checkpoint after the interrupted copy
+		modify  func(t *testing.T, src, checkpoint string)
+		resumed bool
+	}{
+		{name: "resumed", resumed: true},
+		{name: "image changed", modify: func(t *testing.T, src, checkpoint string) {
+			if err := os.Chtimes(src, time.Now(), time.Now().Add(time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{name: "image grew", modify: func(t *testing.T, src, checkpoint string) {
+			if err := os.Truncate(src, 4*mb); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{name: "corrupt checkpoint", modify: func(t *testing.T, src, checkpoint string) {
+			if err := ioutil.WriteFile(checkpoint, []byte("{"), 0640); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			src := sparseImage(t, 3*mb, map[int64][]byte{0: randomData(11, 3*mb)})
+			dst := filepath.Join(t.TempDir(), "copy")
+
+			//The first MB goes through right away, the copy is interrupted
+			//while waiting for the second
+			ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+			defer cancel()
+			c := &Copier{Limiter: NewRateLimiter(mb)}
+			if _, err := c.Copy(ctx, src, dst); err == nil {
+				t.Fatal("interrupted copy succeeded")
+			}
+			checkpoint := dst + partialSuffix
+			cp, err := readCheckpoint(checkpoint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cp.Offset != mb {
+				t.Fatalf("checkpoint at %d, want %d", cp.Offset, mb)
+			}
+			if test.modify != nil {
+				test.modify(t, src, checkpoint)
+			}
+
+			var done CopyProgress
+			c = &Copier{Progress: func(p CopyProgress) { done = p }}
+			checksum, err := c.Copy(context.Background(), src, dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := ioutil.ReadFile(src)
+			if got, _ := ioutil.ReadFile(dst); checksum != sha256Hex(data) || !bytes.Equal(got, data) {
+				t.Fatal("resumed copy differs from the image")
+			}
+			if done.Resumed != test.resumed {
+				t.Errorf("resumed %v, want %v", done.Resumed, test.resumed)
+			}
+			if test.resumed && done.BytesRead != 2*mb {
+				t.Errorf("read %d bytes after resuming, want %d", done.BytesRead, 2*mb)
+			}
+			if _, err := os.Stat(checkpoint); !os.IsNotExist(err) {
+				t.Error("checkpoint left behind")
+			}
+		})
+	}
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// In the deduplicating repository format disk images are split into chunks
+// at content-defined boundaries. Every chunk is stored once in backup_root/.chunks,
+// named by its SHA-256 checksum, and a backup only contains an index per disk
+// listing the chunks its image is made of.
+const (
+	chunkDir    = ".chunks"
+	indexSuffix = ".index"
+	indexMagic  = "NTXINDEX1"
+
+	chunkMinSize = 512 * 1024
+	chunkMaxSize = 4 * 1024 * 1024
+	//Cut points are where the low 20 bits of the rolling hash are zero, 1MB chunks on average
+	chunkMask = 1<<20 - 1
+)
+
+// Random values for the gear rolling hash, fixed so chunk boundaries never change
+var gearTable [256]uint64
+
+func init() {
+	//splitmix64
+	seed := uint64(0x6e7574616e6978)
+	for i := range gearTable {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gearTable[i] = z ^ (z >> 31)
+	}
+}
+
+type IndexChunk struct {
+	Hash   string
+	Length int64
+}
+
+// DedupIndex lists the chunks a disk image is made of
+type DedupIndex struct {
+	Size     int64
+	Checksum string
+	Chunks   []IndexChunk
+}
+
+// chunker splits the data written to it into content-defined chunks
+type chunker struct {
+	buf  []byte
+	hash uint64
+	emit func(chunk []byte) error
+}
+
+func (c *chunker) Write(p []byte) error {
+	for len(p) > 0 {
+		//No cut point can be closer to the start of the chunk than chunkMinSize
+		if skip := chunkMinSize - 64 - len(c.buf); skip > 0 {
+			if skip > len(p) {
+				skip = len(p)
+			}
+			c.buf = append(c.buf, p[:skip]...)
+			p = p[skip:]
+			continue
+		}
+
+		cut := -1
+		for i, b := range p {
+			c.hash = c.hash<<1 + gearTable[b]
+			if n := len(c.buf) + i + 1; (n >= chunkMinSize && c.hash&chunkMask == 0) || n >= chunkMaxSize {
+				cut = i + 1
+				break
+			}
+		}
+		if cut < 0 {
+			c.buf = append(c.buf, p...)
+			return nil
+		}
+
+		c.buf = append(c.buf, p[:cut]...)
+		p = p[cut:]
+		if err := c.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush emits the data buffered since the last cut point as a chunk
+func (c *chunker) Flush() error {
+	if len(c.buf) == 0 {
+		return nil
+	}
+	err := c.emit(c.buf)
+	c.buf = c.buf[:0]
+	c.hash = 0
+	return err
+}
+
+func isZero(b []byte) bool {
+	for len(b) > 0 {
+		n := len(b)
+		if n > len(zeroChunk) {
+			n = len(zeroChunk)
+		}
+		if !bytes.Equal(b[:n], zeroChunk[:n]) {
+			return false
+		}
+		b = b[n:]
+	}
+	return true
+}
+
+func chunkPath(root, hash string) string {
+	return filepath.Join(root, chunkDir, hash[:2], hash)
+}
+
+// findChunk returns the path of a chunk in the repository, whichever format it
+// was stored in. Chunks stored before a key was configured have a plain copy
+// as well as an encrypted one, the copy that can be read with the configured
+// key is preferred.
+func findChunk(root, hash string) (string, bool) {
+	if path, ok := findChunkCopy(root, hash, encryptionKey != nil); ok {
+		return path, true
+	}
+	return storedImage(filepath.Dir(chunkPath(root, hash)), hash)
+}
+
+// findChunkCopy returns the path of the encrypted or the plain copy of a chunk
+func findChunkCopy(root, hash string, encrypted bool) (string, bool) {
+	for _, ext := range compressionExtensions {
+		path := chunkPath(root, hash) + ext
+		if encrypted {
+			path += encryptedSuffix
+		}
+		if exists(path) {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// storeChunk writes a chunk in format into the repository unless it is
+// already there, encrypted if format is. Returns the number of bytes written.
+func storeChunk(root, hash string, format StorageFormat, data []byte) (int64, error) {
+	//A plain copy would leave the data of encrypted backups unencrypted
+	if _, ok := findChunkCopy(root, hash, format.Key != nil); ok {
+		return 0, nil
+	}
+	path := chunkPath(root, hash) + format.Ext()
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return 0, err
+	}
+
+	//Written under a temporary name, so a chunk that exists is always complete
+	f, err := ioutil.TempFile(filepath.Dir(path), hash+".*"+partialSuffix)
+	if err != nil {
+		return 0, err
+	}
+	w, err := format.Writer(f)
+	if err == nil {
+		_, err = w.Write(data)
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return 0, err
+	}
+	return info.Size(), os.Rename(f.Name(), path)
+}
+
+// ChunkCorruptError is returned for chunks whose contents don't match their name
+type ChunkCorruptError struct {
+	Hash string
+}
+
+func (e *ChunkCorruptError) Error() string {
+	return fmt.Sprintf("Chunk %s is corrupt", e.Hash)
+}
+
+// readChunk reads a chunk from the repository and checks it against its name
+func readChunk(root, hash string, buf []byte) ([]byte, error) {
+	path, ok := findChunk(root, hash)
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: chunkPath(root, hash), Err: os.ErrNotExist}
+	}
+	f, err := openStored(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data := bytes.NewBuffer(buf[:0])
+	if _, err := io.Copy(data, f); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data.Bytes())
+	if hex.EncodeToString(sum[:]) != hash {
+		return nil, &ChunkCorruptError{Hash: hash}
+	}
+	return data.Bytes(), nil
+}
+
+func writeIndex(path string, index *DedupIndex) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "%s %d %s\n", indexMagic, index.Size, index.Checksum)
+	for _, chunk := range index.Chunks {
+		fmt.Fprintf(w, "%s %d\n", chunk.Hash, chunk.Length)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func readIndex(path string) (*DedupIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseIndex(path, f)
+}
+
+// parseIndex reads the index file path from r
+func parseIndex(path string, r io.Reader) (*DedupIndex, error) {
+	var err error
+	index := &DedupIndex{}
+	scanner := bufio.NewScanner(r)
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("%s is not an index file", path)
+	}
+	header := strings.Fields(scanner.Text())
+	if len(header) != 3 || header[0] != indexMagic {
+		return nil, fmt.Errorf("%s is not an index file", path)
+	}
+	if index.Size, err = strconv.ParseInt(header[1], 10, 64); err != nil {
+		return nil, fmt.Errorf("Malformed header in %s", path)
+	}
+	index.Checksum = header[2]
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Malformed line in %s: %q", path, scanner.Text())
+		}
+		length, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || len(fields[0]) != sha256.Size*2 {
+			return nil, fmt.Errorf("Malformed line in %s: %q", path, scanner.Text())
+		}
+		index.Chunks = append(index.Chunks, IndexChunk{Hash: fields[0], Length: length})
+	}
+	return index, scanner.Err()
+}
+
+func dedupFor(vm *VMBackup) bool {
+	if vm.Dedup != nil {
+		return *vm.Dedup
+	}
+	return BackupConfig.Dedup
+}
+
+// BackupVDiskDedup chunks a vdisk into the repository and writes the index of
+// the disk into the backup. Returns the index and the number of bytes of new chunks.
+func BackupVDiskDedup(ctx context.Context, container_UUID, disk_container_path, vm_root, disk_name string, format StorageFormat) (*DedupIndex, int64, error) {
+	container_root, err := containers.Root(container_UUID)
+	if err != nil {
+		return nil, 0, err
+	}
+	vdisk_path := filepath.Join(container_root, disk_container_path)
+	index_path := filepath.Join(vm_root, disk_name+indexSuffix)
+
+	select {
+	case copySlots <- struct{}{}:
+		defer func() { <-copySlots }()
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	}
+
+	log.Infof("Backing up %s to the repository", vdisk_path)
+	var index *DedupIndex
+	var stored int64
+	for attempt := 1; ; attempt++ {
+		//Chunks stored by a failed attempt are found again by the next one
+		index, stored, err = chunkImage(ctx, vdisk_path, BackupConfig.Backup_root, format)
+		if err == nil || ctx.Err() != nil || attempt == copyAttempts {
+			break
+		}
+		log.Warnf("Reading %s failed (attempt %d of %d), retrying: %s", vdisk_path, attempt, copyAttempts, err)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if BackupConfig.Verify_source {
+		log.Infof("Verifying %s against %s", index_path, vdisk_path)
+		source_checksum, err := hashFile(ctx, vdisk_path, bandwidth)
+		if err != nil {
+			return nil, 0, err
+		}
+		if source_checksum != index.Checksum {
+			return nil, 0, fmt.Errorf("%s changed while reading it", vdisk_path)
+		}
+	}
+
+	if err := writeIndex(index_path, index); err != nil {
+		return nil, 0, err
+	}
+	return index, stored, nil
+}
+
+// chunkImage splits an image into chunks and stores the new ones, in format,
+// in the repository at root
+func chunkImage(ctx context.Context, src, root string, format StorageFormat) (*DedupIndex, int64, error) {
+	f, err := openSource(src)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	index := &DedupIndex{Size: info.Size()}
+	image_sum := sha256.New()
+	progress := CopyProgress{Src: src, Dst: filepath.Join(root, chunkDir), Size: info.Size()}
+	start := time.Now()
+	last_progress := start
+
+	c := &chunker{emit: func(chunk []byte) error {
+		sum := sha256.Sum256(chunk)
+		hash := hex.EncodeToString(sum[:])
+		written, err := storeChunk(root, hash, format, chunk)
+		if err != nil {
+			return err
+		}
+		progress.BytesWritten += written
+		index.Chunks = append(index.Chunks, IndexChunk{Hash: hash, Length: int64(len(chunk))})
+		return nil
+	}}
+
+	err = forEachBlock(ctx, f, info.Size(), bandwidth, func(offset int64, block []byte, hole bool) error {
+		image_sum.Write(block)
+		if !hole {
+			progress.BytesRead += int64(len(block))
+		}
+		progress.Offset = offset + int64(len(block))
+		if now := time.Now(); now.Sub(last_progress) >= progressInterval {
+			progress.Elapsed = now.Sub(start)
+			logProgress(progress)
+			last_progress = now
+		}
+		return c.Write(block)
+	})
+	if err == nil {
+		err = c.Flush()
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	progress.Elapsed = time.Since(start)
+	progress.Done = true
+	logProgress(progress)
+
+	index.Checksum = hex.EncodeToString(image_sum.Sum(nil))
+	return index, progress.BytesWritten, nil
+}
+
+// assembleImage writes the image described by an index to dst, leaving holes
+// for chunks of zeroes, and checks it against the checksum in the index
+func assembleImage(ctx context.Context, index_path, dst string) error {
+	index, err := readIndex(index_path)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	sum, err := readIndexedImage(ctx, index, func(offset int64, chunk []byte) error {
+		if isZero(chunk) {
+			return nil
+		}
+		_, err := out.WriteAt(chunk, offset)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if sum != index.Checksum {
+		return fmt.Errorf("Image assembled from %s does not match its checksum", index_path)
+	}
+	if err := out.Truncate(index.Size); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+// hashIndexedImage reads all chunks of an index and returns the checksum of the
+// image they make up, along with the checksum recorded in the index
+func hashIndexedImage(ctx context.Context, index_path string) (sum, recorded string, err error) {
+	index, err := readIndex(index_path)
+	if err != nil {
+		return "", "", err
+	}
+	sum, err = readIndexedImage(ctx, index, func(offset int64, chunk []byte) error {
+		return nil
+	})
+	return sum, index.Checksum, err
+}
+
+// readIndexedImage calls fn with every chunk of the image in order and returns its checksum
+func readIndexedImage(ctx context.Context, index *DedupIndex, fn func(offset int64, chunk []byte) error) (string, error) {
+	image_sum := sha256.New()
+	buf := make([]byte, 0, chunkMaxSize)
+	var offset int64
+	for _, chunk := range index.Chunks {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		data, err := readChunk(BackupConfig.Backup_root, chunk.Hash, buf)
+		if err != nil {
+			return "", err
+		}
+		if int64(len(data)) != chunk.Length {
+			return "", &ChunkCorruptError{Hash: chunk.Hash}
+		}
+		image_sum.Write(data)
+		if err := fn(offset, data); err != nil {
+			return "", err
+		}
+		offset += chunk.Length
+	}
+	if offset != index.Size {
+		return "", fmt.Errorf("Chunks add up to %d bytes instead of %d", offset, index.Size)
+	}
+	return hex.EncodeToString(image_sum.Sum(nil)), nil
+}
+
+// gc deletes the chunks in the repository that no index in backup_root refers
+// to. The caller must hold the lock, a running backup stores and reuses chunks
+// before its index is written.
+func gc(dryrun bool) error {
+	root := BackupConfig.Backup_root
+	referenced := make(map[string]bool)
+	backups, err := listBackups(root)
+	if err != nil {
+		return err
+	}
+	for _, b := range backups {
+		indexes, err := filepath.Glob(filepath.Join(b.Path, "*"+indexSuffix))
+		if err != nil {
+			return err
+		}
+		for _, index_path := range indexes {
+			index, err := readIndex(index_path)
+			if err != nil {
+				//Deleting chunks it may refer to could make the backup unrestorable
+				return err
+			}
+			for _, chunk := range index.Chunks {
+				referenced[chunk.Hash] = true
+			}
+		}
+	}
+
+	var count, freed int64
+	err = filepath.Walk(filepath.Join(root, chunkDir), func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		//Chunks being written are not in any index yet
+		if info.IsDir() || strings.HasSuffix(info.Name(), partialSuffix) || referenced[plainName(info.Name())] {
+			return nil
+		}
+		count++
+		freed += allocatedSize(info)
+		if dryrun {
+			log.Debugf("Would delete %s", path)
+			return nil
+		}
+		return os.Remove(path)
+	})
+	if err != nil {
+		return err
+	}
+
+	if dryrun {
+		fmt.Printf("Would delete %d unreferenced chunks, freeing %s\n", count, formatBytes(freed))
+	} else {
+		fmt.Printf("Deleted %d unreferenced chunks, freed %s\n", count, formatBytes(freed))
+	}
+	return nil
+}
+
+func runGC(args []string) {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryrun := fs.Bool("dry-run", *planonly, "Only show how many chunks would be deleted")
+	fs.Parse(args)
+
+	lock := lockBackupRoot()
+	defer lock.Release()
+
+	if err := gc(*dryrun); err != nil {
+		log.Fatalf("Garbage collection failed: %s", err)
+	}
+}
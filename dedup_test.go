@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func randomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// chunks splits data written in pieces of at most write bytes
+func chunks(t *testing.T, data []byte, write int) [][]byte {
+	var out [][]byte
+	c := &chunker{emit: func(chunk []byte) error {
+		out = append(out, append([]byte(nil), chunk...))
+		return nil
+	}}
+	for p := data; len(p) > 0; {
+		n := write
+		if n > len(p) {
+			n = len(p)
+		}
+		if err := c.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestChunker(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		//Number of chunks, or -1 if it depends on the contents
+		count int
+	}{
+		{name: "empty", count: 0},
+		{name: "shorter than a chunk", data: randomData(1, chunkMinSize-1), count: 1},
+		{name: "zeroes", data: make([]byte, 3*chunkMaxSize+5), count: 4},
+		{name: "random", data: randomData(2, 20*1024*1024), count: -1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			want := chunks(t, test.data, len(test.data)+1)
+			if test.count >= 0 && len(want) != test.count {
+				t.Fatalf("%d chunks, want %d", len(want), test.count)
+			}
+			for i, chunk := range want {
+				if len(chunk) > chunkMaxSize || (len(chunk) < chunkMinSize && i != len(want)-1) {
+					t.Errorf("chunk %d of %d bytes", i, len(chunk))
+				}
+			}
+			if got := bytes.Join(want, nil); !bytes.Equal(got, test.data) {
+				t.Fatal("chunks don't add up to the data")
+			}
+
+			//Boundaries only depend on the contents, not on how they were written
+			for _, write := range []int{1 << 20, 65536, 4093} {
+				got := chunks(t, test.data, write)
+				if len(got) != len(want) {
+					t.Fatalf("written in pieces of %d: %d chunks, want %d", write, len(got), len(want))
+				}
+				for i := range got {
+					if !bytes.Equal(got[i], want[i]) {
+						t.Fatalf("written in pieces of %d: chunk %d differs", write, i)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestChunkerInsert(t *testing.T) {
+	data := randomData(3, 20*1024*1024)
+	before := make(map[[sha256.Size]byte]bool)
+	for _, chunk := range chunks(t, data, len(data)) {
+		before[sha256.Sum256(chunk)] = true
+	}
+
+	//Data inserted at the start only changes the chunks around it
+	after := chunks(t, append(randomData(4, 1000), data...), len(data))
+	changed := 0
+	for _, chunk := range after {
+		if !before[sha256.Sum256(chunk)] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Fatalf("%d of %d chunks changed", changed, len(after))
+	}
+}
+
+func TestReadIndex(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+	tests := []struct {
+		name  string
+		index string
+		ok    bool
+	}{
+		{name: "valid", index: indexMagic + " 10 sum\n" + hash + " 4\n" + hash + " 6\n", ok: true},
+		{name: "no chunks", index: indexMagic + " 0 sum\n", ok: true},
+		{name: "empty"},
+		{name: "other magic", index: "NTXINDEX2 10 sum\n"},
+		{name: "malformed size", index: indexMagic + " ten sum\n"},
+		{name: "malformed length", index: indexMagic + " 10 sum\n" + hash + " 4k\n"},
+		{name: "short hash", index: indexMagic + " 10 sum\n" + hash[:60] + " 10\n"},
+		{name: "truncated line", index: indexMagic + " 10 sum\n" + hash + " 4\n" + hash[:20]},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "scsi.0"+indexSuffix)
+			if err := ioutil.WriteFile(path, []byte(test.index), 0640); err != nil {
+				t.Fatal(err)
+			}
+			index, err := readIndex(path)
+			if !test.ok {
+				if err == nil {
+					t.Fatal("read a malformed index")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			//Written back the same
+			if err := writeIndex(path, index); err != nil {
+				t.Fatal(err)
+			}
+			written, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(written) != test.index {
+				t.Fatalf("wrote %q, want %q", written, test.index)
+			}
+		})
+	}
+}
+
+func TestGC(t *testing.T) {
+	saved_config := BackupConfig
+	t.Cleanup(func() {
+		BackupConfig = saved_config
+		catalog = nil
+	})
+
+	kept := randomData(5, 1000)
+	unreferenced := randomData(6, 1000)
+	compressed := randomData(7, 1000)
+	partial := randomData(8, 1000)
+
+	tests := []struct {
+		name   string
+		dryrun bool
+		//Index of a backup that is still being written
+		truncated bool
+		ok        bool
+		deleted   bool
+	}{
+		{name: "unreferenced chunks deleted", ok: true, deleted: true},
+		{name: "dry run", dryrun: true, ok: true},
+		{name: "malformed index", truncated: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			BackupConfig.Backup_root = root
+			var err error
+			if catalog, err = OpenCatalog(filepath.Join(root, catalogFile)); err != nil {
+				t.Fatal(err)
+			}
+			for _, data := range [][]byte{kept, unreferenced} {
+				if _, err := storeChunk(root, sha256Hex(data), StorageFormat{Codec: compressionNone}, data); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := storeChunk(root, sha256Hex(compressed), StorageFormat{Codec: compressionZstd}, compressed); err != nil {
+				t.Fatal(err)
+			}
+			//A chunk being stored by a running backup
+			partial_path := chunkPath(root, sha256Hex(partial)) + ".1234" + partialSuffix
+			os.MkdirAll(filepath.Dir(partial_path), 0750)
+			if err := ioutil.WriteFile(partial_path, partial, 0640); err != nil {
+				t.Fatal(err)
+			}
+
+			backup := filepath.Join(root, "vm1_backup_20240115_1000")
+			os.Mkdir(backup, 0750)
+			err = writeIndex(filepath.Join(backup, "scsi.0"+indexSuffix), &DedupIndex{
+				Size:     2000,
+				Checksum: "sum",
+				Chunks:   []IndexChunk{{Hash: sha256Hex(kept), Length: 1000}, {Hash: sha256Hex(compressed), Length: 1000}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.truncated {
+				index := filepath.Join(root, "vm1_backup_20240116_1000", "scsi.0"+indexSuffix)
+				os.Mkdir(filepath.Dir(index), 0750)
+				ioutil.WriteFile(index, []byte(indexMagic+" 1000 sum\n"+sha256Hex(unreferenced)[:10]), 0640)
+			}
+
+			err = gc(test.dryrun)
+			if (err == nil) != test.ok {
+				t.Fatalf("gc returned %v", err)
+			}
+			for _, data := range [][]byte{kept, compressed} {
+				if _, ok := findChunk(root, sha256Hex(data)); !ok {
+					t.Error("referenced chunk deleted")
+				}
+			}
+			if _, err := os.Stat(partial_path); err != nil {
+				t.Error("chunk being written deleted")
+			}
+			if _, ok := findChunk(root, sha256Hex(unreferenced)); ok == test.deleted {
+				t.Errorf("unreferenced chunk kept %v, want %v", ok, !test.deleted)
+			}
+		})
+	}
+}
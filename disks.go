@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// diskAddress returns the name of a disk in the configuration, eg. scsi.0
+func diskAddress(bus string, index int) string {
+	return fmt.Sprintf("%s.%d", bus, index)
+}
+
+// diskRuleMatches reports whether an include_disks or exclude_disks rule
+// matches a disk. Rules are a bus (scsi), an index (0), or a glob pattern
+// of addresses (scsi.*, ide.1).
+func diskRuleMatches(rule, bus string, index int) bool {
+	if rule == bus || rule == strconv.Itoa(index) {
+		return true
+	}
+	ok, _ := filepath.Match(rule, diskAddress(bus, index))
+	return ok
+}
+
+// validateDisks checks the disk rules of a VM entry
+func (vm *VMBackup) validateDisks() error {
+	if len(vm.Disks) > 0 && (len(vm.Include_disks) > 0 || len(vm.Exclude_disks) > 0 || vm.Min_disk_size != "" || vm.Max_disk_size != "") {
+		return fmt.Errorf("%s lists disks and has disk rules, use one or the other", vm.describe())
+	}
+	for _, rule := range append(append([]string{}, vm.Include_disks...), vm.Exclude_disks...) {
+		if _, err := filepath.Match(rule, ""); err != nil {
+			return fmt.Errorf("Invalid disk rule %q: %s", rule, err)
+		}
+	}
+	for _, size := range []string{vm.Min_disk_size, vm.Max_disk_size} {
+		if size != "" {
+			if _, err := parseSize(size, 1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// selectDisks returns the disks of the VM to back up. Disks listed in the
+// entry are backed up as they are, otherwise all disks that aren't CD-ROMs
+// or empty are, less the ones the disk rules leave out. Disks with data that
+// aren't backed up are logged.
+func (vm *VMBackup) selectDisks() []string {
+	listed := make(map[string]bool)
+	for _, disk := range vm.Disks {
+		listed[disk] = true
+	}
+	var min_size, max_size int64
+	if vm.Min_disk_size != "" {
+		min_size, _ = parseSize(vm.Min_disk_size, 1)
+	}
+	if vm.Max_disk_size != "" {
+		max_size, _ = parseSize(vm.Max_disk_size, 1)
+	}
+
+	var selected []string
+	for _, vdisk := range vm.VMInfo.Config.VMDisks {
+		bus, index := vdisk.Addr.DeviceBus, vdisk.Addr.DeviceIndex
+		disk := diskAddress(bus, index)
+		if len(vm.Disks) > 0 {
+			if !listed[disk] && !vdisk.IsCdrom && !vdisk.IsEmpty {
+				log.Warnf("Disk %s of %s is not listed in its disks, it is not backed up", disk, vm.Name)
+			}
+			continue
+		}
+		if vdisk.IsCdrom || vdisk.IsEmpty {
+			continue
+		}
+
+		reason := ""
+		switch {
+		case len(vm.Include_disks) > 0 && !matchesAnyDisk(vm.Include_disks, bus, index):
+			reason = "not in include_disks"
+		case matchesAnyDisk(vm.Exclude_disks, bus, index):
+			reason = "in exclude_disks"
+		case min_size > 0 && vdisk.VMDiskSize < min_size:
+			reason = "smaller than min_disk_size"
+		case max_size > 0 && vdisk.VMDiskSize > max_size:
+			reason = "larger than max_disk_size"
+		}
+		if reason != "" {
+			log.Warnf("Disk %s of %s (%s) is %s, it is not backed up", disk, vm.Name, formatBytes(vdisk.VMDiskSize), reason)
+			continue
+		}
+		selected = append(selected, disk)
+	}
+
+	if len(vm.Disks) > 0 {
+		return vm.Disks
+	}
+	return selected
+}
+
+func matchesAnyDisk(rules []string, bus string, index int) bool {
+	for _, rule := range rules {
+		if diskRuleMatches(rule, bus, index) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+type testVDisk struct {
+	bus   string
+	index int
+	size  int64
+	cdrom bool
+	empty bool
+}
+
+// withDisks returns entry with the VM on the cluster having the disks
+func withDisks(t *testing.T, entry VMBackup, disks ...testVDisk) VMBackup {
+	var vdisks []map[string]interface{}
+	for _, disk := range disks {
+		vdisks = append(vdisks, map[string]interface{}{
+			"addr":       map[string]interface{}{"deviceBus": disk.bus, "deviceIndex": disk.index},
+			"vmDiskSize": disk.size,
+			"isCdrom":    disk.cdrom,
+			"isEmpty":    disk.empty,
+		})
+	}
+	data, err := json.Marshal(vdisks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry.VMInfo = clusterVM("vm1", "")
+	if err := json.Unmarshal(data, &entry.VMInfo.Config.VMDisks); err != nil {
+		t.Fatal(err)
+	}
+	return entry
+}
+
+func TestSelectDisks(t *testing.T) {
+	const gb = 1024 * 1024 * 1024
+	disks := []testVDisk{
+		{bus: "scsi", index: 0, size: 20 * gb},
+		{bus: "scsi", index: 1, size: 500 * gb},
+		{bus: "scsi", index: 2, size: gb / 2},
+		{bus: "ide", index: 0, cdrom: true},
+		{bus: "ide", index: 1, size: 10 * gb},
+		{bus: "sata", index: 0, empty: true},
+	}
+	tests := []struct {
+		name  string
+		entry VMBackup
+		want  []string
+	}{
+		{name: "all disks", want: []string{"scsi.0", "scsi.1", "scsi.2", "ide.1"}},
+		{name: "listed", entry: VMBackup{Disks: []string{"scsi.1", "ide.0"}}, want: []string{"scsi.1", "ide.0"}},
+		{name: "include bus", entry: VMBackup{Include_disks: []string{"scsi"}}, want: []string{"scsi.0", "scsi.1", "scsi.2"}},
+		{name: "include index", entry: VMBackup{Include_disks: []string{"0"}}, want: []string{"scsi.0"}},
+		{name: "include pattern", entry: VMBackup{Include_disks: []string{"scsi.[01]", "ide.*"}}, want: []string{"scsi.0", "scsi.1", "ide.1"}},
+		{name: "exclude", entry: VMBackup{Exclude_disks: []string{"scsi.1", "ide"}}, want: []string{"scsi.0", "scsi.2"}},
+		{name: "exclude wins over include", entry: VMBackup{Include_disks: []string{"scsi"}, Exclude_disks: []string{"2"}}, want: []string{"scsi.0", "scsi.1"}},
+		{name: "min size", entry: VMBackup{Min_disk_size: "1G"}, want: []string{"scsi.0", "scsi.1", "ide.1"}},
+		{name: "max size", entry: VMBackup{Max_disk_size: "100G"}, want: []string{"scsi.0", "scsi.2", "ide.1"}},
+		{name: "size range", entry: VMBackup{Min_disk_size: "1G", Max_disk_size: "20G"}, want: []string{"scsi.0", "ide.1"}},
+		{name: "nothing left", entry: VMBackup{Include_disks: []string{"nvme"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vm := withDisks(t, test.entry, disks...)
+			if got := vm.selectDisks(); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("selected %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestValidateDisks(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry VMBackup
+		ok    bool
+	}{
+		{name: "no rules", entry: VMBackup{Name: "vm1"}, ok: true},
+		{name: "rules", entry: VMBackup{Name: "vm1", Include_disks: []string{"scsi.*"}, Min_disk_size: "1G"}, ok: true},
+		{name: "listed and rules", entry: VMBackup{Name: "vm1", Disks: []string{"scsi.0"}, Exclude_disks: []string{"ide"}}},
+		{name: "invalid pattern", entry: VMBackup{Name: "vm1", Exclude_disks: []string{"scsi.["}}},
+		{name: "invalid size", entry: VMBackup{Name: "vm1", Max_disk_size: "big"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.entry.validateDisks(); (err == nil) != test.ok {
+				t.Fatalf("validateDisks returned %v", err)
+			}
+		})
+	}
+}
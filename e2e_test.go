@@ -0,0 +1,757 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/loginoff/nutanix-backup/nutanixapi"
+	"github.com/loginoff/nutanix-backup/nutanixapi/prismtest"
+)
+
+const (
+	testCVM       = "cvm"
+	testContainer = "0005a1b2-0000-4000-8000-00000000c0de"
+)
+
+// fakeMounts stands in for NFS: mounting a container replaces the empty
+// mount point with a symlink to the directory standing in for the container
+type fakeMounts struct {
+	exports map[string]string
+	mounted map[string]bool
+}
+
+func (f *fakeMounts) Mount(source, target, mode string) error {
+	dir, ok := f.exports[source]
+	if !ok {
+		return os.ErrNotExist
+	}
+	if err := os.Remove(target); err != nil {
+		return err
+	}
+	if err := os.Symlink(dir, target); err != nil {
+		return err
+	}
+	f.mounted[target] = true
+	return nil
+}
+
+func (f *fakeMounts) Umount(target string) error {
+	if !f.mounted[target] {
+		return os.ErrNotExist
+	}
+	delete(f.mounted, target)
+	if err := os.Remove(target); err != nil {
+		return err
+	}
+	return os.Mkdir(target, 0750)
+}
+
+func (f *fakeMounts) IsMounted(target string) bool {
+	return f.mounted[target]
+}
+
+type e2e struct {
+	prism  *prismtest.Server
+	ntnx   *nutanixapi.Client
+	mounts *fakeMounts
+	//Directory standing in for the container
+	container string
+}
+
+// setupE2E points the global state of a backup run at a fake PRISM server,
+// a fake mount layer and temporary directories
+func setupE2E(t *testing.T) *e2e {
+	saved_config, saved_mounts, saved_now := BackupConfig, mounts, now
+	t.Cleanup(func() {
+		BackupConfig, mounts, now = saved_config, saved_mounts, saved_now
+		containers, storage, catalog, journal, encryptionKey = nil, nil, nil, nil, nil
+		bandwidth = nil
+	})
+
+	dir := t.TempDir()
+	backup_root := filepath.Join(dir, "backup")
+	mount_root := filepath.Join(dir, "mnt")
+	container_dir := filepath.Join(dir, "container")
+	for _, d := range []string{backup_root, mount_root, container_dir} {
+		if err := os.Mkdir(d, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prism := prismtest.NewServer()
+	t.Cleanup(prism.Close)
+	prism.AddContainer(testContainer, "ctr1", container_dir)
+	ntnx, err := prism.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	BackupConfig.Backup_root = backup_root
+	BackupConfig.Nutanix_mount_root = mount_root
+	BackupConfig.Nutanix_cvm_addr = testCVM
+	BackupConfig.Transport = transportNFS
+	BackupConfig.Concurrency = 1
+	BackupConfig.Max_copies = 1
+
+	fake := &fakeMounts{
+		exports: map[string]string{testCVM + ":/ctr1": container_dir},
+		mounted: make(map[string]bool),
+	}
+	mounts = fake
+	storage = &LocalStorage{root: backup_root}
+	copySlots = make(chan struct{}, 1)
+	if catalog, err = OpenCatalog(filepath.Join(backup_root, catalogFile)); err != nil {
+		t.Fatal(err)
+	}
+	if journal, err = OpenJournal(filepath.Join(backup_root, journalFile)); err != nil {
+		t.Fatal(err)
+	}
+	if containers, err = NewNFSAccess(ntnx, testCVM, mount_root, false); err != nil {
+		t.Fatal(err)
+	}
+
+	return &e2e{prism: prism, ntnx: ntnx, mounts: fake, container: container_dir}
+}
+
+// resolve selects the VMs of the entries on the fake cluster
+func (e *e2e) resolve(t *testing.T, entries ...VMBackup) []VMBackup {
+	BackupConfig.VMs = entries
+	allvms, err := e.ntnx.GetVMs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vms, err := resolveVMs(allvms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vms
+}
+
+// backupAt backs up the VM of the entry as if it were at, and returns the
+// backup directory
+func (e *e2e) backupAt(t *testing.T, entry VMBackup, at time.Time) string {
+	now = func() time.Time { return at }
+	vms := e.resolve(t, entry)
+	var result BackupResult
+	if err := BackupVM(context.Background(), e.ntnx, &vms[0], &result); err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(BackupConfig.Backup_root, result.Snapshot)
+}
+
+// testDisk returns disk data with a hole of zeroes in the middle
+func testDisk(seed byte, size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		if i < size/4 || i > size/2 {
+			data[i] = seed + byte(i%251)
+		}
+	}
+	return data
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestBackupVM(t *testing.T) {
+	e := setupE2E(t)
+	root := testDisk(1, 3*1024*1024)
+	data := testDisk(7, 1024*1024+123)
+	e.prism.AddVM("web1", "frontend #backup",
+		prismtest.Disk{Bus: "scsi", Index: 0, ContainerUUID: testContainer, Data: root},
+		prismtest.Disk{Bus: "scsi", Index: 1, ContainerUUID: testContainer, Data: data},
+		prismtest.Disk{Bus: "ide", Index: 0, Cdrom: true},
+	)
+	e.prism.AddVM("db1", "", prismtest.Disk{Bus: "scsi", Index: 0, ContainerUUID: testContainer, Data: data})
+
+	vms := e.resolve(t, VMBackup{Tags: []string{"backup"}})
+	if len(vms) != 1 || vms[0].Name != "web1" {
+		t.Fatalf("selected %v, want web1", vms)
+	}
+	if strings.Join(vms[0].Disks, ",") != "scsi.0,scsi.1" {
+		t.Fatalf("selected disks %v, want scsi.0 and scsi.1", vms[0].Disks)
+	}
+
+	var result BackupResult
+	if err := BackupVM(context.Background(), e.ntnx, &vms[0], &result); err != nil {
+		t.Fatal(err)
+	}
+	if err := containers.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	backups := catalog.Find("web1", time.Time{}, time.Time{})
+	if len(backups) != 1 || backups[0].Status != statusOK {
+		t.Fatalf("catalog has %v, want one good backup of web1", backups)
+	}
+	backup_path := filepath.Join(BackupConfig.Backup_root, backups[0].Name)
+	sums, err := readManifest(backup_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for disk, want := range map[string][]byte{"scsi.0": root, "scsi.1": data} {
+		got, err := ioutil.ReadFile(filepath.Join(backup_path, disk))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("image of %s differs from the vdisk", disk)
+		}
+		if sums[disk] != sha256Hex(want) {
+			t.Errorf("manifest has %s for %s, want %s", sums[disk], disk, sha256Hex(want))
+		}
+	}
+	if _, err := ReadSnapshotInfo(filepath.Join(backup_path, "ahv_vm")); err != nil {
+		t.Errorf("reading the VM info: %s", err)
+	}
+
+	if snapshots := e.prism.Snapshots(); len(snapshots) != 0 {
+		t.Errorf("%d snapshots left behind", len(snapshots))
+	}
+	if !journal.Empty() {
+		t.Errorf("journal not empty: %v %v", journal.Snapshots, journal.Mounts)
+	}
+	if len(e.mounts.mounted) != 0 {
+		t.Errorf("containers still mounted: %v", e.mounts.mounted)
+	}
+}
+
+func TestBackupVMCompressed(t *testing.T) {
+	e := setupE2E(t)
+	data := testDisk(3, 2*1024*1024)
+	e.prism.AddVM("app1", "", prismtest.Disk{Bus: "scsi", Index: 0, ContainerUUID: testContainer, Data: data})
+	//Tasks report progress a few times before they complete
+	e.prism.TaskPolls = 3
+
+	vms := e.resolve(t, VMBackup{Name_pattern: "app*", Compression: compressionZstd})
+	var result BackupResult
+	if err := BackupVM(context.Background(), e.ntnx, &vms[0], &result); err != nil {
+		t.Fatal(err)
+	}
+	containers.Release()
+
+	backups := catalog.Find("app1", time.Time{}, time.Time{})
+	if len(backups) != 1 {
+		t.Fatalf("catalog has %d backups of app1, want 1", len(backups))
+	}
+	restored := filepath.Join(t.TempDir(), "scsi.0")
+	image := filepath.Join(BackupConfig.Backup_root, backups[0].Name, "scsi.0"+compressionExtensions[compressionZstd])
+	if err := extractImage(context.Background(), image, restored); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("extracted image differs from the vdisk")
+	}
+}
+
+func TestBackupVMSnapshotFails(t *testing.T) {
+	e := setupE2E(t)
+	e.prism.AddVM("web1", "", prismtest.Disk{Bus: "scsi", Index: 0, ContainerUUID: testContainer, Data: testDisk(1, 4096)})
+	e.prism.FailTask(prismtest.OpSnapshotCreate, "out of space")
+
+	vms := e.resolve(t, VMBackup{Name: "web1"})
+	var result BackupResult
+	err := BackupVM(context.Background(), e.ntnx, &vms[0], &result)
+	if err == nil || !strings.Contains(err.Error(), "out of space") {
+		t.Fatalf("got error %v, want the failure of the snapshot task", err)
+	}
+	if backups := catalog.Find("", time.Time{}, time.Time{}); len(backups) != 0 {
+		t.Errorf("catalog has %d backups, want none", len(backups))
+	}
+	//The snapshot may still show up, the next run cleans it up
+	if len(journal.Snapshots) != 1 {
+		t.Errorf("journal has %d snapshots, want 1", len(journal.Snapshots))
+	}
+	if err := journal.Cleanup(e.ntnx, false); err != nil {
+		t.Fatal(err)
+	}
+	if !journal.Empty() {
+		t.Error("journal not empty after cleanup")
+	}
+}
+
+func TestBackupVMFailureDeletesSnapshot(t *testing.T) {
+	tests := []struct {
+		name string
+		//Run after the snapshot, {container} is replaced by the directory of the container
+		post_snapshot string
+		want          string
+	}{
+		//The vdisks of the snapshot are gone before they are copied
+		{name: "copy fails", post_snapshot: "rm -r {container}/.acropolis/snapshot", want: "no such file"},
+		{name: "post-snapshot hook fails", post_snapshot: "exit 3", want: "post-snapshot hook failed"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := setupE2E(t)
+			e.prism.AddVM("web1", "", prismtest.Disk{Bus: "scsi", Index: 0, ContainerUUID: testContainer, Data: testDisk(1, 4096)})
+
+			vms := e.resolve(t, VMBackup{
+				Name:          "web1",
+				Post_snapshot: &Hook{Type: hookCommand, Command: strings.Replace(test.post_snapshot, "{container}", e.container, 1)},
+			})
+			var result BackupResult
+			err := BackupVM(context.Background(), e.ntnx, &vms[0], &result)
+			containers.Release()
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("got error %v, want %q", err, test.want)
+			}
+			if snapshots := e.prism.Snapshots(); len(snapshots) != 0 {
+				t.Errorf("%d snapshots left behind", len(snapshots))
+			}
+			if !journal.Empty() {
+				t.Errorf("journal not empty: %v", journal.Snapshots)
+			}
+		})
+	}
+}
+
+func TestBackupVMFailedCopyRemoved(t *testing.T) {
+	e := setupE2E(t)
+	e.prism.AddVM("web1", "", prismtest.Disk{Bus: "scsi", Index: 0, ContainerUUID: testContainer, Data: testDisk(1, 4096)})
+
+	//The vdisks of the snapshot can be opened, but not read
+	vms := e.resolve(t, VMBackup{
+		Name:          "web1",
+		Post_snapshot: &Hook{Type: hookCommand, Command: "for f in " + e.container + "/.acropolis/snapshot/*/vmdisk/*; do rm $f && mkdir $f; done"},
+	})
+	var result BackupResult
+	if err := BackupVM(context.Background(), e.ntnx, &vms[0], &result); err == nil {
+		t.Fatal("backup of unreadable vdisks succeeded")
+	}
+	containers.Release()
+
+	left, err := filepath.Glob(filepath.Join(BackupConfig.Backup_root, result.Snapshot, "scsi.0*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 0 {
+		t.Errorf("failed copy left %v behind", left)
+	}
+}
+
+func TestBackupVMInterruptedResumed(t *testing.T) {
+	e := setupE2E(t)
+	data := randomData(12, 4*1024*1024)
+	e.prism.AddVM("web1", "", prismtest.Disk{Bus: "scsi", Index: 0, ContainerUUID: testContainer, Data: data})
+	vms := e.resolve(t, VMBackup{Name: "web1"})
+
+	//Interrupted once half of the disk is copied
+	bandwidth = NewRateLimiter(1024 * 1024)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for ctx.Err() == nil {
+			matches, _ := filepath.Glob(filepath.Join(BackupConfig.Backup_root, "*", "scsi.0"))
+			for _, image := range matches {
+				if info, err := os.Stat(image); err == nil && info.Size() >= int64(len(data)/2) {
+					cancel()
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	var result BackupResult
+	if err := BackupVM(ctx, e.ntnx, &vms[0], &result); err != context.Canceled {
+		t.Fatalf("interrupted backup returned %v", err)
+	}
+	containers.Release()
+	backup_path := filepath.Join(BackupConfig.Backup_root, result.Snapshot)
+	cp, err := readCheckpoint(filepath.Join(backup_path, "scsi.0"+partialSuffix))
+	if err != nil {
+		t.Fatalf("no checkpoint kept: %s", err)
+	}
+	if cp.Offset == 0 || cp.Offset >= int64(len(data)) {
+		t.Fatalf("checkpoint at %d of %d bytes", cp.Offset, len(data))
+	}
+	if len(e.prism.Snapshots()) != 1 || len(journal.Snapshots) != 1 || !journal.Snapshots[0].Resume {
+		t.Fatalf("want the snapshot kept to resume from, journal has %v", journal.Snapshots)
+	}
+	//Left alone by the cleanup before a backup
+	if err := journal.Cleanup(e.ntnx, true); err != nil {
+		t.Fatal(err)
+	}
+
+	bandwidth = nil
+	var resumed BackupResult
+	if err := BackupVM(context.Background(), e.ntnx, &vms[0], &resumed); err != nil {
+		t.Fatal(err)
+	}
+	containers.Release()
+	if resumed.Snapshot != result.Snapshot {
+		t.Fatalf("backed up to %s, want %s", resumed.Snapshot, result.Snapshot)
+	}
+	snapshots := 0
+	for _, request := range e.prism.Requests() {
+		if request == "POST /api/nutanix/v0.8/snapshots" {
+			snapshots++
+		}
+	}
+	if snapshots != 1 {
+		t.Errorf("%d snapshots taken, want 1", snapshots)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(backup_path, "scsi.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("resumed image differs from the vdisk")
+	}
+	if len(e.prism.Snapshots()) != 0 || !journal.Empty() {
+		t.Errorf("snapshot left behind, journal has %v", journal.Snapshots)
+	}
+	if _, err := os.Stat(filepath.Join(backup_path, "scsi.0"+partialSuffix)); !os.IsNotExist(err) {
+		t.Error("checkpoint left behind")
+	}
+}
+
+func TestBackupVMInterruptedWhileSnapshotting(t *testing.T) {
+	e := setupE2E(t)
+	e.prism.AddVM("web1", "", prismtest.Disk{Bus: "scsi", Index: 0, ContainerUUID: testContainer, Data: testDisk(1, 4096)})
+	vms := e.resolve(t, VMBackup{Name: "web1"})
+	e.prism.TaskPolls = 5
+	e.ntnx.PollPeriod = 50 * time.Millisecond
+
+	//Interrupted like a run, once the snapshot task is being polled
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	go func() {
+		for ctx.Err() == nil {
+			for _, request := range e.prism.Requests() {
+				if strings.HasPrefix(request, "GET /api/nutanix/v0.8/tasks/") {
+					syscall.Kill(os.Getpid(), syscall.SIGINT)
+					return
+				}
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	var result BackupResult
+	err := BackupVM(ctx, e.ntnx, &vms[0], &result)
+	if ctx.Err() == nil {
+		t.Fatalf("backup returned %v before it was interrupted", err)
+	}
+	if err == nil {
+		t.Fatal("interrupted backup succeeded")
+	}
+	if len(e.prism.Snapshots()) != 0 {
+		t.Fatal("kept polling the snapshot task after the interrupt")
+	}
+	if len(journal.Snapshots) != 1 || journal.Snapshots[0].Task == "" {
+		t.Fatalf("want the snapshot and its task in the journal, journal has %v", journal.Snapshots)
+	}
+
+	//The snapshot is deleted by a cleanup once its task completes
+	for i := 0; i < 10 && !journal.Empty(); i++ {
+		if err := journal.Cleanup(e.ntnx, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !journal.Empty() || len(e.prism.Snapshots()) != 0 {
+		t.Fatalf("snapshot not cleaned up, journal has %v", journal.Snapshots)
+	}
+}
+
+func TestBackupVMDeleteRetried(t *testing.T) {
+	e := setupE2E(t)
+	e.prism.AddVM("web1", "", prismtest.Disk{Bus: "scsi", Index: 0, ContainerUUID: testContainer, Data: testDisk(1, 4096)})
+	e.prism.FailTask(prismtest.OpSnapshotDelete, "busy")
+
+	vms := e.resolve(t, VMBackup{Name: "web1"})
+	var result BackupResult
+	if err := BackupVM(context.Background(), e.ntnx, &vms[0], &result); err == nil {
+		t.Fatal("backup succeeded, want the failure of deleting the snapshot")
+	}
+	containers.Release()
+	if len(e.prism.Snapshots()) != 1 || len(journal.Snapshots) != 1 {
+		t.Fatalf("want the snapshot left behind and in the journal")
+	}
+
+	//PRISM is unavailable for a moment
+	e.prism.FailRequests(http.MethodGet, "/api/nutanix/v0.8/snapshots", http.StatusServiceUnavailable, 1)
+	if err := journal.Cleanup(e.ntnx, false); err == nil {
+		t.Fatal("cleanup succeeded without listing the snapshots")
+	}
+	if err := journal.Cleanup(e.ntnx, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(e.prism.Snapshots()) != 0 || !journal.Empty() {
+		t.Error("snapshot not cleaned up")
+	}
+}
+
+func TestBackupVMLocalTransport(t *testing.T) {
+	e := setupE2E(t)
+	data := testDisk(5, 64*1024)
+	e.prism.AddVM("web1", "", prismtest.Disk{Bus: "scsi", Index: 0, ContainerUUID: testContainer, Data: data})
+
+	//The container is mounted outside of the backup
+	BackupConfig.Transport = transportLocal
+	if err := os.Symlink(e.container, filepath.Join(BackupConfig.Nutanix_mount_root, "ctr1")); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if containers, err = newContainerAccess(e.ntnx, false); err != nil {
+		t.Fatal(err)
+	}
+
+	vms := e.resolve(t, VMBackup{Name: "web1"})
+	var result BackupResult
+	if err := BackupVM(context.Background(), e.ntnx, &vms[0], &result); err != nil {
+		t.Fatal(err)
+	}
+	if err := containers.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if len(e.mounts.mounted) != 0 {
+		t.Errorf("containers mounted with the local transport: %v", e.mounts.mounted)
+	}
+
+	backups := catalog.Find("web1", time.Time{}, time.Time{})
+	if len(backups) != 1 {
+		t.Fatalf("catalog has %d backups of web1, want 1", len(backups))
+	}
+	got, err := ioutil.ReadFile(filepath.Join(BackupConfig.Backup_root, backups[0].Name, "scsi.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("image differs from the vdisk")
+	}
+}
+
+func TestBackupVMHooks(t *testing.T) {
+	e := setupE2E(t)
+	e.prism.AddVM("db1", "", prismtest.Disk{Bus: "scsi", Index: 0, ContainerUUID: testContainer, Data: testDisk(1, 4096)})
+	hook_log := filepath.Join(t.TempDir(), "hooks")
+
+	vms := e.resolve(t, VMBackup{
+		Name:          "db1",
+		Pre_snapshot:  &Hook{Type: hookCommand, Command: "echo $NUTANIX_BACKUP_HOOK $NUTANIX_BACKUP_VM >> " + hook_log},
+		Post_snapshot: &Hook{Type: hookCommand, Command: "echo $NUTANIX_BACKUP_HOOK $NUTANIX_BACKUP_VM >> " + hook_log},
+	})
+	var result BackupResult
+	if err := BackupVM(context.Background(), e.ntnx, &vms[0], &result); err != nil {
+		t.Fatal(err)
+	}
+	containers.Release()
+
+	got, err := ioutil.ReadFile(hook_log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "pre-snapshot db1\npost-snapshot db1\n" {
+		t.Errorf("hooks ran as %q", got)
+	}
+	if backups := catalog.Find("db1", time.Time{}, time.Time{}); len(backups) != 1 {
+		t.Errorf("catalog has %d backups of db1, want 1", len(backups))
+	}
+}
+
+func TestBackupVMPreHookFails(t *testing.T) {
+	e := setupE2E(t)
+	e.prism.AddVM("db1", "", prismtest.Disk{Bus: "scsi", Index: 0, ContainerUUID: testContainer, Data: testDisk(1, 4096)})
+	thawed := filepath.Join(t.TempDir(), "thawed")
+
+	vms := e.resolve(t, VMBackup{
+		Name:          "db1",
+		Pre_snapshot:  &Hook{Type: hookCommand, Command: "sleep 10", Timeout: "100ms"},
+		Post_snapshot: &Hook{Type: hookCommand, Command: "touch " + thawed},
+	})
+	var result BackupResult
+	err := BackupVM(context.Background(), e.ntnx, &vms[0], &result)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("got error %v, want the pre-snapshot hook timing out", err)
+	}
+	for _, req := range e.prism.Requests() {
+		if req == "POST /api/nutanix/v0.8/snapshots" {
+			t.Error("snapshot taken after the pre-snapshot hook failed")
+		}
+	}
+	if !journal.Empty() {
+		t.Error("journal not empty")
+	}
+	if !exists(thawed) {
+		t.Error("post-snapshot hook not run after the pre-snapshot hook failed")
+	}
+}
+
+func TestBackupVMAppConsistent(t *testing.T) {
+	e := setupE2E(t)
+	e.prism.AddVM("db1", "", prismtest.Disk{Bus: "scsi", Index: 0, ContainerUUID: testContainer, Data: testDisk(1, 4096)})
+	uuid := e.prism.AddVM("db2", "", prismtest.Disk{Bus: "scsi", Index: 0, ContainerUUID: testContainer, Data: testDisk(2, 4096)})
+	e.prism.NoGuestTools(uuid)
+
+	vms := e.resolve(t,
+		VMBackup{Name: "db1", Consistency: consistencyApplication},
+		VMBackup{Name: "db2", Consistency: consistencyApplication},
+	)
+	for i := range vms {
+		var result BackupResult
+		err := BackupVM(context.Background(), e.ntnx, &vms[i], &result)
+		switch vms[i].Name {
+		case "db1":
+			if err != nil {
+				t.Fatal(err)
+			}
+		case "db2":
+			if err == nil || !strings.Contains(err.Error(), "application consistent") {
+				t.Fatalf("got error %v, want the application consistent snapshot failing", err)
+			}
+		}
+	}
+
+	//Crash consistent snapshots will do for db2
+	BackupConfig.Consistency_fallback = fallbackCrash
+	var result BackupResult
+	if err := BackupVM(context.Background(), e.ntnx, &vms[1], &result); err != nil {
+		t.Fatal(err)
+	}
+	containers.Release()
+
+	for vm, want := range map[string]string{"db1": consistencyApplication, "db2": consistencyCrash} {
+		backups := catalog.Find(vm, time.Time{}, time.Time{})
+		if len(backups) != 1 {
+			t.Fatalf("catalog has %d backups of %s, want 1", len(backups), vm)
+		}
+		meta, err := readBackupMeta(filepath.Join(BackupConfig.Backup_root, backups[0].Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.Consistency != want || backups[0].Consistency != want {
+			t.Errorf("backup of %s is %s consistent, want %s", vm, meta.Consistency, want)
+		}
+	}
+}
+
+func TestBackupMetrics(t *testing.T) {
+	e := setupE2E(t)
+	e.prism.AddVM("metrics1", "", prismtest.Disk{Bus: "scsi", Index: 0, ContainerUUID: testContainer, Data: testDisk(1, 8192)})
+	e.prism.AddVM("metrics2", "", prismtest.Disk{Bus: "scsi", Index: 0, ContainerUUID: testContainer, Data: testDisk(2, 4096)})
+	BackupConfig.Continue_on_error = true
+	BackupConfig.Metrics_textfile = filepath.Join(t.TempDir(), "nutanix_backup.prom")
+
+	vms := e.resolve(t, VMBackup{Name: "metrics1"}, VMBackup{Name: "metrics2", Pre_snapshot: &Hook{Type: hookCommand, Command: "false"}})
+	if succeeded, failed := backupVMs(context.Background(), e.ntnx, vms); succeeded != 1 || failed != 1 {
+		t.Fatalf("%d backups succeeded and %d failed, want 1 and 1", succeeded, failed)
+	}
+	writeMetrics()
+
+	got, err := ioutil.ReadFile(BackupConfig.Metrics_textfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backups := catalog.Find("metrics1", time.Time{}, time.Time{})
+	if len(backups) != 1 {
+		t.Fatalf("catalog has %d backups of metrics1, want 1", len(backups))
+	}
+	for _, want := range []string{
+		`nutanix_backup_bytes_copied_total{vm="metrics1"} 8192`,
+		`nutanix_backup_failures_total{vm="metrics1"} 0`,
+		`nutanix_backup_failures_total{vm="metrics2"} 1`,
+		`nutanix_backup_phase_duration_seconds{phase="copy",vm="metrics1"}`,
+		`nutanix_backup_snapshot_wait_seconds{vm="metrics1"}`,
+	} {
+		if !strings.Contains(string(got), want) {
+			t.Errorf("metrics lack %s", want)
+		}
+	}
+	last_success := metricValue(string(got), `nutanix_backup_last_success_timestamp_seconds{vm="metrics1"}`)
+	if last_success != float64(backups[0].Time.Unix()) {
+		t.Errorf("last success of metrics1 at %f, want the time of its snapshot %d", last_success, backups[0].Time.Unix())
+	}
+	if strings.Contains(string(got), `last_success_timestamp_seconds{vm="metrics2"}`) {
+		t.Error("metrics have a good backup of metrics2")
+	}
+}
+
+func TestBackupVMsMaxCopies(t *testing.T) {
+	tests := []struct {
+		name        string
+		concurrency int
+		max_copies  int
+	}{
+		{name: "one copy at a time", concurrency: 4, max_copies: 1},
+		{name: "two copies at a time", concurrency: 4, max_copies: 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := setupE2E(t)
+			const size = 2 * 1024 * 1024
+			var entries []VMBackup
+			for i := 0; i < 4; i++ {
+				name := fmt.Sprintf("vm%d", i)
+				e.prism.AddVM(name, "", prismtest.Disk{Bus: "scsi", Index: 0, ContainerUUID: testContainer, Data: randomData(int64(20+i), size)})
+				entries = append(entries, VMBackup{Name: name})
+			}
+			vms := e.resolve(t, entries...)
+			BackupConfig.Concurrency = test.concurrency
+			BackupConfig.Max_copies = test.max_copies
+			//Slow enough for the copies to overlap if they may
+			BackupConfig.BWLimit = "4M"
+
+			//An image is being copied from its creation until it has all its data
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			most := make(chan int)
+			go func() {
+				max := 0
+				for ctx.Err() == nil {
+					copying := 0
+					images, _ := filepath.Glob(filepath.Join(BackupConfig.Backup_root, "*", "scsi.0"))
+					for _, image := range images {
+						if info, err := os.Stat(image); err == nil && info.Size() < size {
+							copying++
+						}
+					}
+					if copying > max {
+						max = copying
+					}
+					time.Sleep(5 * time.Millisecond)
+				}
+				most <- max
+			}()
+
+			succeeded, failed := backupVMs(context.Background(), e.ntnx, vms)
+			cancel()
+			if succeeded != len(vms) || failed != 0 {
+				t.Fatalf("%d backups succeeded and %d failed, want %d and 0", succeeded, failed, len(vms))
+			}
+			if got := <-most; got != test.max_copies {
+				t.Errorf("at most %d disks copied at a time, want %d", got, test.max_copies)
+			}
+		})
+	}
+}
+
+// metricValue returns the value of a series in the text format, or -1
+func metricValue(metrics, series string) float64 {
+	for _, line := range strings.Split(metrics, "\n") {
+		if strings.HasPrefix(line, series+" ") {
+			value, err := strconv.ParseFloat(strings.TrimPrefix(line, series+" "), 64)
+			if err == nil {
+				return value
+			}
+		}
+	}
+	return -1
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encrypted files start with a header of the magic, the ID of the key and a
+// random salt. The key of the file is derived from the configured key and the
+// salt. The contents are split into segments sealed with AES-256-GCM, with
+// the number of the segment and whether it is the last one in the nonce, so
+// segments can't be reordered, dropped or cut off without failing authentication.
+const (
+	encryptedSuffix   = ".enc"
+	encryptionMagic   = "NTXENC01"
+	encryptionSegment = 1024 * 1024
+	keyIDSize         = 8
+	saltSize          = 16
+	headerSize        = len(encryptionMagic) + keyIDSize + saltSize
+	keySize           = 32
+)
+
+// Salt for deriving keys from passphrases, the same passphrase always gives the same key
+const passphraseSalt = "nutanix-backup passphrase"
+
+type EncryptionKey struct {
+	key []byte
+	//Hex encoded, recorded in the backups encrypted with the key
+	ID string
+}
+
+func newEncryptionKey(key []byte) *EncryptionKey {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("key id"))
+	return &EncryptionKey{key: key, ID: hex.EncodeToString(mac.Sum(nil)[:keyIDSize])}
+}
+
+// loadEncryptionKey reads the key from a key file, which contains 32 random bytes
+// or 64 hex digits, or derives it from a passphrase
+func loadEncryptionKey(key_file, passphrase string) (*EncryptionKey, error) {
+	if key_file != "" && passphrase != "" {
+		return nil, fmt.Errorf("Specify either encryption_key_file or encryption_passphrase, not both")
+	}
+
+	if passphrase != "" {
+		key, err := scrypt.Key([]byte(passphrase), []byte(passphraseSalt), 1<<15, 8, 1, keySize)
+		if err != nil {
+			return nil, err
+		}
+		return newEncryptionKey(key), nil
+	}
+
+	data, err := ioutil.ReadFile(key_file)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == keySize {
+		return newEncryptionKey(data), nil
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != keySize {
+		return nil, fmt.Errorf("%s must contain %d random bytes or %d hex digits", key_file, keySize, keySize*2)
+	}
+	return newEncryptionKey(key), nil
+}
+
+// fileCipher derives the cipher of a file from the key and the salt in its header
+func (k *EncryptionKey) fileCipher(salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, k.key)
+	mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func segmentNonce(aead cipher.AEAD, segment uint64, last bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-9:], segment)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	buf     []byte
+	segment uint64
+}
+
+func newEncryptWriter(key *EncryptionKey, w io.Writer) (io.WriteCloser, error) {
+	header := make([]byte, 0, headerSize)
+	header = append(header, encryptionMagic...)
+	id, _ := hex.DecodeString(key.ID)
+	header = append(header, id...)
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	header = append(header, salt...)
+
+	aead, err := key.fileCipher(salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, header: header}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	e.buf = append(e.buf, p...)
+	//The last segment is only sealed on Close, so keep at least one segment back
+	for len(e.buf) > encryptionSegment {
+		if err := e.seal(e.buf[:encryptionSegment], false); err != nil {
+			return 0, err
+		}
+		e.buf = e.buf[:copy(e.buf, e.buf[encryptionSegment:])]
+	}
+	return len(p), nil
+}
+
+func (e *encryptWriter) Close() error {
+	return e.seal(e.buf, true)
+}
+
+func (e *encryptWriter) seal(plaintext []byte, last bool) error {
+	sealed := e.aead.Seal(nil, segmentNonce(e.aead, e.segment, last), plaintext, e.header)
+	e.segment++
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+type decryptReader struct {
+	r       *bufio.Reader
+	name    string
+	aead    cipher.AEAD
+	header  []byte
+	buf     []byte
+	plain   []byte
+	segment uint64
+	done    bool
+}
+
+// isEncrypted reports whether the data in r starts with the header of an encrypted file
+func isEncrypted(r *bufio.Reader) bool {
+	magic, _ := r.Peek(len(encryptionMagic))
+	return string(magic) == encryptionMagic
+}
+
+// newDecryptReader reads the encrypted file name from r with the configured key
+func newDecryptReader(name string, r *bufio.Reader) (io.Reader, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("%s is not an encrypted file", name)
+	}
+	id := hex.EncodeToString(header[len(encryptionMagic) : len(encryptionMagic)+keyIDSize])
+	if encryptionKey == nil {
+		return nil, fmt.Errorf("%s is encrypted with key %s, configure encryption_key_file or encryption_passphrase", name, id)
+	}
+	if id != encryptionKey.ID {
+		return nil, fmt.Errorf("%s is encrypted with key %s, the configured key is %s", name, id, encryptionKey.ID)
+	}
+
+	aead, err := encryptionKey.fileCipher(header[len(encryptionMagic)+keyIDSize:])
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{
+		r:      r,
+		name:   name,
+		aead:   aead,
+		header: header,
+		buf:    make([]byte, encryptionSegment+aead.Overhead()),
+	}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptReader) open() error {
+	n, err := io.ReadFull(d.r, d.buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	//A short segment, or a full one at the end of the file, is the last one
+	last := n < len(d.buf)
+	if !last {
+		if _, err := d.r.Peek(1); err == io.EOF {
+			last = true
+		}
+	}
+
+	plain, err := d.aead.Open(d.buf[:0], segmentNonce(d.aead, d.segment, last), d.buf[:n], d.header)
+	if err != nil {
+		return fmt.Errorf("%s failed authentication, it was tampered with or is corrupt", d.name)
+	}
+	d.segment++
+	d.plain = plain
+	d.done = last
+	return nil
+}
+
+// encrypt wraps w in an encryptWriter when key is set
+func encrypt(key *EncryptionKey, w io.Writer) (io.WriteCloser, error) {
+	if key == nil {
+		return nopWriteCloser{w}, nil
+	}
+	return newEncryptWriter(key, w)
+}
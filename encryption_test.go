@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/loginoff/nutanix-backup/nutanixapi/prismtest"
+)
+
+// testKey returns a fixed key, and restores the configured one after the test
+func testKey(t *testing.T) *EncryptionKey {
+	saved := encryptionKey
+	t.Cleanup(func() { encryptionKey = saved })
+	return newEncryptionKey(bytes.Repeat([]byte{0x42}, 32))
+}
+
+func sealed(t *testing.T, key *EncryptionKey, plain []byte) []byte {
+	var buf bytes.Buffer
+	w, err := newEncryptWriter(key, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestOpenStoredRequiresEncryption(t *testing.T) {
+	key := testKey(t)
+	plain := []byte(`{"name":"vm1"}`)
+
+	tests := []struct {
+		name string
+		file string
+		//Encrypt the file
+		encrypted bool
+		//Configure the key
+		configured bool
+		//KeyID in backup.json
+		key_id string
+		ok     bool
+	}{
+		{name: "plain", file: "ahv_vm", ok: true},
+		{name: "encrypted", file: "ahv_vm", encrypted: true, configured: true, ok: true},
+		{name: "encrypted without a key", file: "ahv_vm", encrypted: true},
+		{name: "plain with a key", file: "ahv_vm", configured: true, ok: true},
+		{name: "plain in an encrypted backup", file: "ahv_vm", key_id: key.ID},
+		{name: "plain with the encrypted suffix", file: "scsi.0" + encryptedSuffix},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			data := plain
+			if test.encrypted {
+				data = sealed(t, key, plain)
+			}
+			path := filepath.Join(dir, test.file)
+			if err := ioutil.WriteFile(path, data, 0640); err != nil {
+				t.Fatal(err)
+			}
+			if test.key_id != "" {
+				if err := writeBackupMeta(dir, &BackupMeta{Compression: compressionNone, KeyID: test.key_id}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			encryptionKey = nil
+			if test.configured {
+				encryptionKey = key
+			}
+
+			r, err := openStored(path)
+			if err == nil {
+				var got []byte
+				got, err = ioutil.ReadAll(r)
+				r.Close()
+				if err == nil && !bytes.Equal(got, plain) {
+					t.Fatalf("read %q, want %q", got, plain)
+				}
+			}
+			if test.ok && err != nil {
+				t.Fatalf("openStored: %s", err)
+			}
+			if !test.ok && err == nil {
+				t.Fatal("openStored read the file")
+			}
+		})
+	}
+}
+
+func TestDecryptSegments(t *testing.T) {
+	key := testKey(t)
+	other := newEncryptionKey(bytes.Repeat([]byte{0x17}, 32))
+	segment := encryptionSegment + 16
+	//Two full segments and a short last one
+	plain := randomData(9, 2*encryptionSegment+1000)
+
+	tests := []struct {
+		name   string
+		plain  []byte
+		modify func(b []byte) []byte
+		ok     bool
+	}{
+		{name: "empty", plain: []byte{}, ok: true},
+		{name: "short", plain: []byte("hello"), ok: true},
+		{name: "one segment", plain: randomData(1, encryptionSegment), ok: true},
+		{name: "full last segment", plain: randomData(2, 2*encryptionSegment), ok: true},
+		{name: "segments", plain: plain, ok: true},
+		{name: "header tampered", plain: plain, modify: func(b []byte) []byte {
+			b[headerSize-1] ^= 1
+			return b
+		}},
+		{name: "segment tampered", plain: plain, modify: func(b []byte) []byte {
+			b[headerSize+segment+10] ^= 1
+			return b
+		}},
+		{name: "last segment cut off", plain: plain, modify: func(b []byte) []byte {
+			return b[:headerSize+2*segment]
+		}},
+		{name: "truncated within a segment", plain: plain, modify: func(b []byte) []byte {
+			return b[:len(b)-10]
+		}},
+		{name: "only the header", plain: []byte{}, modify: func(b []byte) []byte {
+			return b[:headerSize]
+		}},
+		{name: "segments reordered", plain: plain, modify: func(b []byte) []byte {
+			out := append([]byte(nil), b[:headerSize]...)
+			out = append(out, b[headerSize+segment:headerSize+2*segment]...)
+			out = append(out, b[headerSize:headerSize+segment]...)
+			return append(out, b[headerSize+2*segment:]...)
+		}},
+		{name: "segment dropped", plain: plain, modify: func(b []byte) []byte {
+			return append(b[:headerSize+segment], b[headerSize+2*segment:]...)
+		}},
+		{name: "data appended", plain: []byte("hello"), modify: func(b []byte) []byte {
+			return append(b, bytes.Repeat([]byte{1}, 100)...)
+		}},
+		{name: "other key", plain: []byte("hello"), modify: func(b []byte) []byte {
+			return sealed(t, other, []byte("hello"))
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := sealed(t, key, test.plain)
+			if test.modify != nil {
+				data = test.modify(data)
+			}
+			encryptionKey = key
+			r, err := newDecryptReader("scsi.0.enc", bufio.NewReader(bytes.NewReader(data)))
+			var got []byte
+			if err == nil {
+				got, err = ioutil.ReadAll(r)
+			}
+			if !test.ok {
+				if err == nil {
+					t.Fatalf("read %d bytes without an error", len(got))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, test.plain) {
+				t.Fatalf("read %d bytes, want %d", len(got), len(test.plain))
+			}
+		})
+	}
+}
+
+func TestBackupEncryptionEnabled(t *testing.T) {
+	e := setupE2E(t)
+	dedup := true
+	data := testDisk(5, 3*1024*1024)
+	compressed := testDisk(6, 1024*1024)
+	e.prism.AddVM("old1", "", prismtest.Disk{Bus: "scsi", Index: 0, ContainerUUID: testContainer, Data: data})
+	e.prism.AddVM("old2", "", prismtest.Disk{Bus: "scsi", Index: 0, ContainerUUID: testContainer, Data: compressed})
+	e.prism.AddVM("new1", "", prismtest.Disk{Bus: "scsi", Index: 0, ContainerUUID: testContainer, Data: data})
+
+	backup := func(entry VMBackup) string {
+		vms := e.resolve(t, entry)
+		var result BackupResult
+		if err := BackupVM(context.Background(), e.ntnx, &vms[0], &result); err != nil {
+			t.Fatal(err)
+		}
+		backups := catalog.Find(entry.Name, time.Time{}, time.Time{})
+		if len(backups) != 1 {
+			t.Fatalf("catalog has %d backups of %s, want 1", len(backups), entry.Name)
+		}
+		return filepath.Join(BackupConfig.Backup_root, backups[0].Name)
+	}
+
+	//The repository was filled before a key was configured
+	old1 := backup(VMBackup{Name: "old1", Dedup: &dedup})
+	old2 := backup(VMBackup{Name: "old2", Compression: compressionZstd})
+	encryptionKey = testKey(t)
+	new1 := backup(VMBackup{Name: "new1", Dedup: &dedup})
+	containers.Release()
+
+	index, err := readIndex(filepath.Join(new1, "scsi.0"+indexSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chunk := range index.Chunks {
+		if _, ok := findChunkCopy(BackupConfig.Backup_root, chunk.Hash, true); !ok {
+			t.Fatalf("chunk %s of the encrypted backup has no encrypted copy", chunk.Hash)
+		}
+	}
+
+	//Both the plain and the encrypted backups restore with the key configured
+	for _, backup_path := range []string{old1, new1} {
+		restored := filepath.Join(t.TempDir(), "scsi.0")
+		if err := assembleImage(context.Background(), filepath.Join(backup_path, "scsi.0"+indexSuffix), restored); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ioutil.ReadFile(restored); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("image assembled from %s differs from the vdisk (%v)", filepath.Base(backup_path), err)
+		}
+	}
+	restored := filepath.Join(t.TempDir(), "scsi.0")
+	if err := extractImage(context.Background(), filepath.Join(old2, "scsi.0"+compressionExtensions[compressionZstd]), restored); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(restored); err != nil || !bytes.Equal(got, compressed) {
+		t.Errorf("image extracted from %s differs from the vdisk (%v)", filepath.Base(old2), err)
+	}
+}
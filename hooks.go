@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Kinds of hooks
+const (
+	hookCommand = "command"
+	hookSSH     = "ssh"
+	hookHTTP    = "http"
+)
+
+const defaultHookTimeout = 5 * time.Minute
+
+// Hook is run before or after the snapshot of a VM, eg. to flush and freeze
+// a database and to thaw it again. Commands are run by the shell on the
+// backup machine, or in the guest over SSH; HTTP hooks send a request to URL.
+type Hook struct {
+	//command, ssh or http
+	Type    string
+	Command string
+	//SSH, as host or host:port, logged in to with a password or a private key
+	Host          string
+	User          string
+	Password      string
+	Identity_file string
+	Known_hosts   string
+	//HTTP, any status but 2xx fails the hook
+	URL    string
+	Method string
+	Body   string
+	//eg. 30s, defaults to 5m
+	Timeout string
+}
+
+func (h *Hook) validate() error {
+	switch h.Type {
+	case hookCommand:
+		if h.Command == "" {
+			return fmt.Errorf("Command hooks need a command")
+		}
+	case hookSSH:
+		if h.Command == "" || h.Host == "" || h.User == "" {
+			return fmt.Errorf("SSH hooks need a command, a host and a user")
+		}
+		if h.Password == "" && h.Identity_file == "" {
+			return fmt.Errorf("SSH hooks need a password or an identity_file")
+		}
+	case hookHTTP:
+		if h.URL == "" {
+			return fmt.Errorf("HTTP hooks need a url")
+		}
+	default:
+		return fmt.Errorf("Unknown hook type %q, use command, ssh or http", h.Type)
+	}
+	if h.Timeout != "" {
+		if _, err := time.ParseDuration(h.Timeout); err != nil {
+			return fmt.Errorf("Invalid hook timeout %q: %s", h.Timeout, err)
+		}
+	}
+	return nil
+}
+
+// describe returns what the hook does, for the plan of a dry run
+func (h *Hook) describe() string {
+	switch h.Type {
+	case hookSSH:
+		return fmt.Sprintf("ssh %s@%s %s", h.User, h.Host, h.Command)
+	case hookHTTP:
+		return h.method() + " " + h.URL
+	}
+	return h.Command
+}
+
+func (h *Hook) timeout() time.Duration {
+	if h.Timeout == "" {
+		return defaultHookTimeout
+	}
+	//Validated in evaluateConfig
+	timeout, _ := time.ParseDuration(h.Timeout)
+	return timeout
+}
+
+// run runs the hook, if there is one, and logs its output. name is the
+// hook, eg. pre-snapshot, and passed to commands in NUTANIX_BACKUP_HOOK with
+// the VM in NUTANIX_BACKUP_VM.
+func (h *Hook) run(ctx context.Context, name string, vm *VMBackup) error {
+	if h == nil {
+		return nil
+	}
+	log.Infof("Running the %s hook of %s", name, vm.Name)
+
+	timeout := h.timeout()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var output []byte
+	var err error
+	switch h.Type {
+	case hookCommand:
+		output, err = h.runCommand(ctx, name, vm)
+	case hookSSH:
+		output, err = h.runSSH(ctx)
+	case hookHTTP:
+		output, err = h.runHTTP(ctx)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		log.Infof("%s hook of %s: %s", name, vm.Name, scanner.Text())
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%s hook timed out after %s", name, timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%s hook failed: %s", name, err)
+	}
+	return nil
+}
+
+func (h *Hook) runCommand(ctx context.Context, name string, vm *VMBackup) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", h.Command)
+	cmd.Env = append(os.Environ(), "NUTANIX_BACKUP_HOOK="+name, "NUTANIX_BACKUP_VM="+vm.Name)
+	//Kill whatever the shell started too when the hook times out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = 5 * time.Second
+	return cmd.CombinedOutput()
+}
+
+func (h *Hook) runSSH(ctx context.Context) ([]byte, error) {
+	auth, err := sshAuth(h.Password, h.Identity_file)
+	if err != nil {
+		return nil, err
+	}
+	host_key, err := hostKeyCallback(h.Known_hosts)
+	if err != nil {
+		return nil, err
+	}
+	addr := h.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+
+	connection, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            h.User,
+		Auth:            auth,
+		HostKeyCallback: host_key,
+		Timeout:         30 * time.Second,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to %s: %s", addr, err)
+	}
+	defer connection.Close()
+	session, err := connection.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	//Closing the connection is the only way to stop the command
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			connection.Close()
+		case <-done:
+		}
+	}()
+	return session.CombinedOutput(h.Command)
+}
+
+func (h *Hook) method() string {
+	if h.Method == "" {
+		return http.MethodPost
+	}
+	return h.Method
+}
+
+func (h *Hook) runHTTP(ctx context.Context) ([]byte, error) {
+	method := h.method()
+	req, err := http.NewRequestWithContext(ctx, method, h.URL, strings.NewReader(h.Body))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return body, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return body, fmt.Errorf("%s %s returned %s", method, h.URL, resp.Status)
+	}
+	return body, nil
+}
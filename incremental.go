@@ -0,0 +1,799 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/loginoff/nutanix-backup/nutanixapi"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Incremental backups store only the blocks of a disk that changed since the
+// previous backup. Every backup keeps a block map with the checksum of each
+// block of its disk images, which the next backup compares against. The blocks
+// that differ are written into a delta file and chain.json records which
+// backup the deltas apply on top of.
+const (
+	chainFile      = "chain.json"
+	blockMapSuffix = ".blocks"
+	deltaSuffix    = ".delta"
+	deltaMagic     = "NTXDELT1"
+	blockSize      = copyChunkSize
+)
+
+// Kinds of records in a delta file
+const (
+	deltaData  = 0
+	deltaZeros = 1
+)
+
+type blockHash [sha256.Size]byte
+
+var zeroBlockHash = blockHash(sha256.Sum256(zeroChunk[:blockSize]))
+
+// ChainDescriptor describes how to rebuild the disk images of an incremental backup
+type ChainDescriptor struct {
+	//Backup the deltas apply on
+	Base  string               `json:"base"`
+	Disks map[string]ChainDisk `json:"disks"`
+}
+
+type ChainDisk struct {
+	Size int64 `json:"size"`
+	//Checksum of the rebuilt image
+	Checksum string `json:"sha256"`
+	//Delta file in the backup directory, empty when the full image was stored
+	Delta         string `json:"delta,omitempty"`
+	ChangedBlocks int64  `json:"changedBlocks"`
+}
+
+type deltaResult struct {
+	Blocks        []blockHash
+	ImageChecksum string
+	DeltaChecksum string
+	//Checksum of the delta before compression and encryption
+	ContentChecksum string
+	ChangedBlocks   int64
+}
+
+func readChain(backup_path string) (*ChainDescriptor, error) {
+	f, err := os.Open(filepath.Join(backup_path, chainFile))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var chain ChainDescriptor
+	err = json.NewDecoder(f).Decode(&chain)
+	return &chain, err
+}
+
+func writeChain(backup_path string, chain *ChainDescriptor) error {
+	f, err := os.OpenFile(filepath.Join(backup_path, chainFile), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	e := json.NewEncoder(f)
+	e.SetIndent("", "\t")
+	return e.Encode(chain)
+}
+
+// chainLength returns the number of incremental backups between the backup and its full backup
+func chainLength(backup_path string) int {
+	length := 0
+	for {
+		chain, err := readChain(backup_path)
+		if err != nil {
+			return length
+		}
+		length++
+		backup_path = filepath.Join(filepath.Dir(backup_path), chain.Base)
+	}
+}
+
+// readBlockMap reads the block map of a disk in a backup directory, which is
+// stored like the images
+func readBlockMap(backup_path, disk string) ([]blockHash, error) {
+	path, ok := storedImage(backup_path, disk+blockMapSuffix)
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: filepath.Join(backup_path, disk+blockMapSuffix), Err: os.ErrNotExist}
+	}
+	r, err := openStored(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data)%sha256.Size != 0 {
+		return nil, fmt.Errorf("Corrupt block map %s", path)
+	}
+
+	blocks := make([]blockHash, len(data)/sha256.Size)
+	for i := range blocks {
+		copy(blocks[i][:], data[i*sha256.Size:])
+	}
+	return blocks, nil
+}
+
+// writeBlockMap writes a block map to path, compressed and encrypted
+// according to format like the images, as it tells which blocks hold what
+func writeBlockMap(path string, blocks []blockHash, format StorageFormat) error {
+	f, err := os.OpenFile(path+format.Ext(), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buffered := bufio.NewWriter(f)
+	w, err := format.Writer(buffered)
+	if err != nil {
+		return err
+	}
+	for _, b := range blocks {
+		if _, err := w.Write(b[:]); err != nil {
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// blockHasher computes the block map of an image written to it from the
+// start, while the image is copied. It is nil when no block map is needed.
+type blockHasher struct {
+	sum hash.Hash
+	//Bytes of the current block in sum
+	n      int
+	blocks []blockHash
+	//The blocks are unknown after resuming a copy from a checkpoint the
+	//hasher has no mark for
+	valid bool
+	mark  *blockMark
+}
+
+// blockMark is the state of a blockHasher at a checkpoint of a copy
+type blockMark struct {
+	offset int64
+	blocks int
+	n      int
+	state  []byte
+}
+
+func newBlockHasher() *blockHasher {
+	return &blockHasher{sum: sha256.New(), valid: true}
+}
+
+func (b *blockHasher) Write(p []byte) (int, error) {
+	if b == nil {
+		return len(p), nil
+	}
+	written := len(p)
+	for len(p) > 0 {
+		n := blockSize - b.n
+		if n > len(p) {
+			n = len(p)
+		}
+		b.sum.Write(p[:n])
+		b.n += n
+		p = p[n:]
+		if b.n == blockSize {
+			var h blockHash
+			b.sum.Sum(h[:0])
+			b.blocks = append(b.blocks, h)
+			b.sum.Reset()
+			b.n = 0
+		}
+	}
+	return written, nil
+}
+
+// zeroes adds n zero bytes, eg. a hole
+func (b *blockHasher) zeroes(n int64) {
+	if b == nil {
+		return
+	}
+	for n > 0 {
+		if b.n == 0 && n >= blockSize {
+			b.blocks = append(b.blocks, zeroBlockHash)
+			n -= blockSize
+			continue
+		}
+		chunk := int64(blockSize - b.n)
+		if chunk > n {
+			chunk = n
+		}
+		b.Write(zeroChunk[:chunk])
+		n -= chunk
+	}
+}
+
+// reset starts over, for a copy that starts from the beginning again
+func (b *blockHasher) reset() {
+	if b == nil {
+		return
+	}
+	b.sum.Reset()
+	b.n = 0
+	b.blocks = nil
+	b.valid = true
+	b.mark = nil
+}
+
+// checkpoint marks the state at offset in the image, to restore it when the
+// copy is resumed from there
+func (b *blockHasher) checkpoint(offset int64) {
+	if b == nil {
+		return
+	}
+	state, err := b.sum.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		b.mark = nil
+		return
+	}
+	b.mark = &blockMark{offset: offset, blocks: len(b.blocks), n: b.n, state: state}
+}
+
+// restore goes back to the mark at offset, when a copy is resumed from there
+func (b *blockHasher) restore(offset int64) {
+	if b == nil {
+		return
+	}
+	mark := b.mark
+	if mark == nil || mark.offset != offset || b.sum.(encoding.BinaryUnmarshaler).UnmarshalBinary(mark.state) != nil {
+		b.reset()
+		b.valid = false
+		return
+	}
+	b.blocks = b.blocks[:mark.blocks]
+	b.n = mark.n
+}
+
+// Blocks returns the block map of everything written, or false when it is
+// not known
+func (b *blockHasher) Blocks() ([]blockHash, bool) {
+	if !b.valid {
+		return nil, false
+	}
+	blocks := b.blocks[:len(b.blocks):len(b.blocks)]
+	if b.n > 0 {
+		var h blockHash
+		b.sum.Sum(h[:0])
+		blocks = append(blocks, h)
+	}
+	return blocks, true
+}
+
+// forEachBlock calls fn with the contents of every block of the file. Blocks
+// in holes are not read, fn gets hole set and a block of zeroes for them.
+func forEachBlock(ctx context.Context, f SourceFile, size int64, limiter *RateLimiter, fn func(offset int64, block []byte, hole bool) error) error {
+	buf := make([]byte, blockSize)
+	for offset := int64(0); offset < size; offset += blockSize {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		n := size - offset
+		if n > blockSize {
+			n = blockSize
+		}
+
+		data, _, err := dataRegion(f, offset, size)
+		if err != nil {
+			return err
+		}
+		if data >= offset+n {
+			if err := fn(offset, zeroChunk[:n], true); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := limiter.Wait(ctx, int(n)); err != nil {
+			return err
+		}
+		read, err := f.ReadAt(buf[:n], offset)
+		if int64(read) < n {
+			if err == nil || err == io.EOF {
+				err = fmt.Errorf("%s shrank while reading", f.Name())
+			}
+			return err
+		}
+		if err := fn(offset, buf[:n], false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hashBlock(block []byte, hole bool) blockHash {
+	if hole && len(block) == blockSize {
+		return zeroBlockHash
+	}
+	return blockHash(sha256.Sum256(block))
+}
+
+// buildBlockMap computes the checksums of all blocks of an image
+func buildBlockMap(ctx context.Context, path string, limiter *RateLimiter) ([]blockHash, error) {
+	if plainName(path) != path {
+		return buildBlockMapStored(ctx, path)
+	}
+
+	f, err := openSource(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var blocks []blockHash
+	err = forEachBlock(ctx, f, info.Size(), limiter, func(offset int64, block []byte, hole bool) error {
+		blocks = append(blocks, hashBlock(block, hole))
+		return nil
+	})
+	return blocks, err
+}
+
+func buildBlockMapStored(ctx context.Context, path string) ([]blockHash, error) {
+	r, err := openStored(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var blocks []blockHash
+	buf := make([]byte, blockSize)
+	for {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			blocks = append(blocks, hashBlock(buf[:n], false))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return blocks, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// createDelta reads the image at src and writes the blocks that differ from
+// the previous block map into a delta file at dst
+func createDelta(ctx context.Context, src, dst string, format StorageFormat, previous []blockHash, limiter *RateLimiter) (*deltaResult, error) {
+	in, err := openSource(src)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+
+	delta_sum, content_sum := sha256.New(), sha256.New()
+	buffered := bufio.NewWriter(io.MultiWriter(out, delta_sum))
+	compressed, err := format.Writer(buffered)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(io.MultiWriter(compressed, content_sum))
+	w.WriteString(deltaMagic)
+	binary.Write(w, binary.BigEndian, size)
+	binary.Write(w, binary.BigEndian, int64(blockSize))
+
+	result := &deltaResult{}
+	image_sum := sha256.New()
+	progress := CopyProgress{Src: src, Dst: dst, Size: size}
+	start := time.Now()
+	last_progress := start
+
+	err = forEachBlock(ctx, in, size, limiter, func(offset int64, block []byte, hole bool) error {
+		image_sum.Write(block)
+		h := hashBlock(block, hole)
+		i := len(result.Blocks)
+		result.Blocks = append(result.Blocks, h)
+
+		if !hole {
+			progress.BytesRead += int64(len(block))
+		}
+		progress.Offset = offset + int64(len(block))
+		if now := time.Now(); now.Sub(last_progress) >= progressInterval {
+			progress.Elapsed = now.Sub(start)
+			logProgress(progress)
+			last_progress = now
+		}
+
+		if i < len(previous) && previous[i] == h {
+			return nil
+		}
+
+		result.ChangedBlocks++
+		kind := byte(deltaData)
+		if hole || bytes.Equal(block, zeroChunk[:len(block)]) {
+			kind = deltaZeros
+		}
+		binary.Write(w, binary.BigEndian, offset)
+		binary.Write(w, binary.BigEndian, int32(len(block)))
+		w.WriteByte(kind)
+		if kind == deltaData {
+			progress.BytesWritten += int64(len(block))
+			_, err := w.Write(block)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	if err := compressed.Close(); err != nil {
+		return nil, err
+	}
+	if err := buffered.Flush(); err != nil {
+		return nil, err
+	}
+	if err := out.Sync(); err != nil {
+		return nil, err
+	}
+
+	progress.Elapsed = time.Since(start)
+	progress.Done = true
+	logProgress(progress)
+
+	result.ImageChecksum = hex.EncodeToString(image_sum.Sum(nil))
+	result.DeltaChecksum = hex.EncodeToString(delta_sum.Sum(nil))
+	result.ContentChecksum = hex.EncodeToString(content_sum.Sum(nil))
+	return result, nil
+}
+
+// applyDelta writes the blocks in a delta file into the image
+func applyDelta(delta_path string, image *os.File) error {
+	f, err := openStored(delta_path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(deltaMagic))
+	var size, block_size int64
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != deltaMagic {
+		return fmt.Errorf("%s is not a delta file", delta_path)
+	}
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return err
+	}
+	if err := binary.Read(r, binary.BigEndian, &block_size); err != nil {
+		return err
+	}
+	if err := image.Truncate(size); err != nil {
+		return err
+	}
+
+	buf := make([]byte, block_size)
+	for {
+		var offset int64
+		var length int32
+		err := binary.Read(r, binary.BigEndian, &offset)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return err
+		}
+		if length < 0 || int64(length) > block_size {
+			return fmt.Errorf("Corrupt delta file %s", delta_path)
+		}
+		kind, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		block := zeroChunk[:length]
+		if kind == deltaData {
+			block = buf[:length]
+			if _, err := io.ReadFull(r, block); err != nil {
+				return err
+			}
+		}
+		if _, err := image.WriteAt(block, offset); err != nil {
+			return err
+		}
+	}
+}
+
+// materializeImage rebuilds the full image of a disk in a backup into dst,
+// applying the deltas of the chain on top of the full backup it starts from
+func materializeImage(ctx context.Context, backup_path, disk, dst string) error {
+	var deltas []string
+	var checksum string
+	current := backup_path
+	for {
+		chain, err := readChain(current)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		cd, ok := chain.Disks[disk]
+		if !ok {
+			return fmt.Errorf("Disk %s is not part of %s", disk, current)
+		}
+		if checksum == "" {
+			checksum = cd.Checksum
+		}
+		if cd.Delta == "" {
+			break
+		}
+		deltas = append([]string{filepath.Join(current, cd.Delta)}, deltas...)
+		current = filepath.Join(filepath.Dir(current), chain.Base)
+	}
+
+	log.Infof("Rebuilding %s from %s and %d deltas", disk, filepath.Base(current), len(deltas))
+	image_path, ok := storedImage(current, disk)
+	if !ok {
+		return fmt.Errorf("No image of %s in %s", disk, current)
+	}
+	if err := extractImage(ctx, image_path, dst); err != nil {
+		return err
+	}
+
+	image, err := os.OpenFile(dst, os.O_RDWR, 0640)
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+	for _, delta := range deltas {
+		log.Infof("Applying %s", delta)
+		if err := applyDelta(delta, image); err != nil {
+			return err
+		}
+	}
+	if err := image.Sync(); err != nil {
+		return err
+	}
+
+	if checksum == "" {
+		if sums, err := readManifest(backup_path); err == nil {
+			checksum = sums[disk]
+		}
+	}
+	if checksum != "" {
+		sum, err := hashFile(ctx, dst, nil)
+		if err != nil {
+			return err
+		}
+		if sum != checksum {
+			return fmt.Errorf("Rebuilt image %s does not match its checksum", dst)
+		}
+	}
+	return nil
+}
+
+func incrementalFor(vm *VMBackup) bool {
+	if vm.Incremental != nil {
+		return *vm.Incremental
+	}
+	return BackupConfig.Incremental
+}
+
+// incrementalBase returns the backup the next backup of a VM can store its
+// changes against, or an empty string when a full backup has to be taken
+func incrementalBase(vm string) string {
+	backups := catalog.Find("", time.Time{}, time.Time{})
+	for i := len(backups) - 1; i >= 0; i-- {
+		b := backups[i]
+		if b.VM != vm {
+			continue
+		}
+		backup_path := filepath.Join(BackupConfig.Backup_root, b.Name)
+		if b.Status != statusOK || !IsDir(backup_path) {
+			continue
+		}
+		if BackupConfig.Full_every > 0 && chainLength(backup_path)+1 >= BackupConfig.Full_every {
+			log.Infof("%s starts a new chain of incremental backups", vm)
+			return ""
+		}
+		return b.Name
+	}
+	return ""
+}
+
+// previousBlockMap returns the block map of a disk in the base backup. Backups
+// taken before incremental mode was enabled have none, it is then computed
+// from their snapshot if that is still on the cluster.
+func previousBlockMap(ctx context.Context, base, disk string) []blockHash {
+	base_path := filepath.Join(BackupConfig.Backup_root, base)
+	blocks, err := readBlockMap(base_path, disk)
+	if err == nil {
+		return blocks
+	}
+	if !os.IsNotExist(err) {
+		log.Warnf("Unable to read block map of %s in %s: %s", disk, base, err)
+		return nil
+	}
+
+	entry, ok := catalog.Get(base)
+	if !ok || !entry.SnapshotRetained {
+		return nil
+	}
+	snapshot_info, err := ReadSnapshotInfo(filepath.Join(base_path, "ahv_vm"))
+	if err != nil {
+		return nil
+	}
+	container_uuid, disk_container_path, ok := snapshotDiskPath(snapshot_info, disk)
+	if !ok {
+		return nil
+	}
+	container_root, err := containers.Root(container_uuid)
+	if err != nil {
+		return nil
+	}
+
+	log.Infof("Computing block map of %s from snapshot %s", disk, base)
+	blocks, err = buildBlockMap(ctx, filepath.Join(container_root, disk_container_path), bandwidth)
+	if err != nil {
+		log.Warnf("Unable to compute block map of %s from snapshot %s: %s", disk, base, err)
+		return nil
+	}
+	return blocks
+}
+
+// BackupVDiskIncremental stores the blocks of a vdisk that changed since the
+// base backup in a delta file, stored in format. Without a base, or when
+// the block map of the base is not available, the full image is copied.
+// Returns the chain entry of the disk and the checksums of the file stored in
+// the backup directory and of its uncompressed contents.
+func BackupVDiskIncremental(ctx context.Context, container_UUID, disk_container_path, vm_root, disk_name, base string, format StorageFormat) (chain_disk ChainDisk, file_checksum, content_checksum string, err error) {
+	var previous []blockHash
+	if base != "" {
+		previous = previousBlockMap(ctx, base, disk_name)
+	}
+	block_map := filepath.Join(vm_root, disk_name+blockMapSuffix)
+
+	container_root, err := containers.Root(container_UUID)
+	if err != nil {
+		return ChainDisk{}, "", "", err
+	}
+	vdisk_path := filepath.Join(container_root, disk_container_path)
+
+	if previous == nil {
+		hasher := newBlockHasher()
+		checksum, file_checksum, err := BackupVDisk(ctx, container_UUID, disk_container_path, vm_root, disk_name, format, hasher)
+		if err != nil {
+			return ChainDisk{}, "", "", err
+		}
+		blocks, ok := hasher.Blocks()
+		if !ok {
+			//The copy was resumed, the image has what was copied before
+			blocks, err = buildBlockMap(ctx, filepath.Join(vm_root, disk_name+format.Ext()), nil)
+			if err != nil {
+				return ChainDisk{}, "", "", err
+			}
+		}
+		if err := writeBlockMap(block_map, blocks, format); err != nil {
+			return ChainDisk{}, "", "", err
+		}
+		info, err := statSource(vdisk_path)
+		if err != nil {
+			return ChainDisk{}, "", "", err
+		}
+		return ChainDisk{Size: info.Size(), Checksum: checksum, ChangedBlocks: int64(len(blocks))}, file_checksum, checksum, nil
+	}
+
+	delta_name := disk_name + deltaSuffix + format.Ext()
+
+	select {
+	case copySlots <- struct{}{}:
+		defer func() { <-copySlots }()
+	case <-ctx.Done():
+		return ChainDisk{}, "", "", ctx.Err()
+	}
+
+	log.Infof("Backing up changed blocks of %s to %s", vdisk_path, filepath.Join(vm_root, delta_name))
+	result, err := createDelta(ctx, vdisk_path, filepath.Join(vm_root, delta_name), format, previous, bandwidth)
+	if err != nil {
+		return ChainDisk{}, "", "", err
+	}
+	log.Infof("%d of %d blocks of %s changed", result.ChangedBlocks, len(result.Blocks), disk_name)
+
+	if BackupConfig.Verify_source {
+		log.Infof("Verifying changed blocks of %s against %s", disk_name, vdisk_path)
+		source_checksum, err := hashFile(ctx, vdisk_path, bandwidth)
+		if err != nil {
+			return ChainDisk{}, "", "", err
+		}
+		if source_checksum != result.ImageChecksum {
+			return ChainDisk{}, "", "", fmt.Errorf("%s changed while reading it", vdisk_path)
+		}
+	}
+
+	if err := writeBlockMap(block_map, result.Blocks, format); err != nil {
+		return ChainDisk{}, "", "", err
+	}
+	info, err := statSource(vdisk_path)
+	if err != nil {
+		return ChainDisk{}, "", "", err
+	}
+	chain_disk = ChainDisk{
+		Size:          info.Size(),
+		Checksum:      result.ImageChecksum,
+		Delta:         delta_name,
+		ChangedBlocks: result.ChangedBlocks,
+	}
+	return chain_disk, result.DeltaChecksum, result.ContentChecksum, nil
+}
+
+// chainedDisk reports whether the image of a disk in a backup has to be
+// rebuilt from its chain instead of being copied as is
+func chainedDisk(backup_path, disk string) bool {
+	chain, err := readChain(backup_path)
+	if err != nil {
+		return false
+	}
+	return chain.Disks[disk].Delta != ""
+}
+
+// releaseSnapshots deletes the snapshots kept for earlier incremental backups
+// of a VM, now that the backup keep has taken over
+func releaseSnapshots(ntnx *nutanixapi.Client, vm, keep string) {
+	for _, b := range catalog.Find("", time.Time{}, time.Time{}) {
+		if b.VM != vm || b.Name == keep || !b.SnapshotRetained {
+			continue
+		}
+		log.Infof("Deleting snapshot %s kept for the previous incremental backup", b.Name)
+		if err := deleteSnapshot(ntnx, b.SnapshotUUID, b.Name); err != nil {
+			log.Warnf("Unable to delete snapshot %s: %s", b.Name, err)
+			continue
+		}
+		if err := catalog.SetSnapshotRetained(b.Name, false); err != nil {
+			log.Warnf("Unable to update catalog: %s", err)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/loginoff/nutanix-backup/nutanixapi/prismtest"
+)
+
+// sparseImage writes an image of size bytes with data at the given offsets
+// and holes everywhere else
+func sparseImage(t *testing.T, size int64, data map[int64][]byte) string {
+	path := filepath.Join(t.TempDir(), "image")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	for offset, b := range data {
+		if _, err := f.WriteAt(b, offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func equalBlocks(a, b []blockHash) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestBlockHasher(t *testing.T) {
+	tests := []struct {
+		name string
+		size int64
+		data map[int64][]byte
+	}{
+		{name: "empty"},
+		{name: "short", size: 1000, data: map[int64][]byte{0: testDisk(1, 1000)}},
+		{name: "two blocks", size: 2 * blockSize, data: map[int64][]byte{0: testDisk(2, 2*blockSize)}},
+		{name: "hole in the middle", size: 5*blockSize/2 + 17, data: map[int64][]byte{
+			100:             testDisk(3, 5000),
+			2*blockSize - 3: testDisk(4, blockSize/2),
+		}},
+		{name: "trailing hole", size: 3 * blockSize, data: map[int64][]byte{blockSize / 3: testDisk(5, blockSize)}},
+		{name: "only a hole", size: 2*blockSize + 5},
+	}
+	ctx := context.Background()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			src := sparseImage(t, test.size, test.data)
+			want, err := buildBlockMap(ctx, src, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			copied := newBlockHasher()
+			copier := &Copier{Blocks: copied}
+			if _, err := copier.Copy(ctx, src, filepath.Join(t.TempDir(), "copy")); err != nil {
+				t.Fatal(err)
+			}
+			if got, ok := copied.Blocks(); !ok || !equalBlocks(got, want) {
+				t.Errorf("copy hashed %d blocks, want %d", len(got), len(want))
+			}
+
+			streamed := newBlockHasher()
+			if _, _, err := streamImage(ctx, src, "stream", ioutil.Discard, StorageFormat{Codec: compressionZstd}, nil, streamed); err != nil {
+				t.Fatal(err)
+			}
+			if got, ok := streamed.Blocks(); !ok || !equalBlocks(got, want) {
+				t.Errorf("compressed copy hashed %d blocks, want %d", len(got), len(want))
+			}
+		})
+	}
+}
+
+func TestBlockHasherRestore(t *testing.T) {
+	data := testDisk(6, 3*blockSize+100)
+	want := newBlockHasher()
+	want.Write(data)
+	want_blocks, _ := want.Blocks()
+
+	tests := []struct {
+		name string
+		//Offset of the checkpoint, and where the copy resumes
+		mark, resume int64
+		ok           bool
+	}{
+		{name: "within a block", mark: blockSize + 10, resume: blockSize + 10, ok: true},
+		{name: "at a block boundary", mark: 2 * blockSize, resume: 2 * blockSize, ok: true},
+		{name: "from the start", mark: 0, resume: 0, ok: true},
+		{name: "without a mark", mark: blockSize, resume: 2 * blockSize},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newBlockHasher()
+			b.Write(data[:test.mark])
+			b.checkpoint(test.mark)
+			//Written before the copy failed, and copied again
+			b.Write(data[test.mark : test.mark+5000])
+			b.restore(test.resume)
+			b.Write(data[test.resume:])
+
+			got, ok := b.Blocks()
+			if ok != test.ok {
+				t.Fatalf("blocks known %v, want %v", ok, test.ok)
+			}
+			if ok && !equalBlocks(got, want_blocks) {
+				t.Fatal("restored hasher computed a different block map")
+			}
+		})
+	}
+}
+
+func TestBlockMapStored(t *testing.T) {
+	key := testKey(t)
+	blocks := []blockHash{zeroBlockHash, sha256.Sum256([]byte("a")), sha256.Sum256([]byte("b"))}
+
+	tests := []struct {
+		name   string
+		format StorageFormat
+	}{
+		{name: "plain", format: StorageFormat{Codec: compressionNone}},
+		{name: "compressed", format: StorageFormat{Codec: compressionZstd}},
+		{name: "encrypted", format: StorageFormat{Codec: compressionGzip, Key: key}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			encryptionKey = test.format.Key
+			if err := writeBlockMap(filepath.Join(dir, "scsi.0"+blockMapSuffix), blocks, test.format); err != nil {
+				t.Fatal(err)
+			}
+			stored, err := ioutil.ReadFile(filepath.Join(dir, "scsi.0"+blockMapSuffix+test.format.Ext()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.format.Key != nil && bytes.Contains(stored, blocks[1][:]) {
+				t.Error("encrypted block map holds the checksums in plain text")
+			}
+
+			got, err := readBlockMap(dir, "scsi.0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !equalBlocks(got, blocks) {
+				t.Fatalf("read %d blocks, want %d", len(got), len(blocks))
+			}
+		})
+	}
+
+	if _, err := readBlockMap(t.TempDir(), "scsi.0"); !os.IsNotExist(err) {
+		t.Fatalf("missing block map read with error %v", err)
+	}
+}
+
+func TestBackupVMIncrementalSFTP(t *testing.T) {
+	e := setupE2E(t)
+	server := newSFTPServer(t)
+
+	//The SFTP server serves the local filesystem, the container is named
+	//after its directory so its root is found there
+	const sftpContainer = "c2ba1f4e-sftp-container"
+	e.prism.AddContainer(sftpContainer, strings.TrimPrefix(e.container, "/"), e.container)
+	data := testDisk(8, 4*1024*1024)
+	e.prism.AddVM("db1", "", prismtest.Disk{Bus: "scsi", Index: 0, ContainerUUID: sftpContainer, Data: data})
+
+	BackupConfig.Transport = transportSFTP
+	BackupConfig.Incremental = true
+	BackupConfig.Verify_source = true
+	var err error
+	if containers, err = NewSFTPAccess(e.ntnx, server.host(), server.port(), testSSHUser, testSSHPassword, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	e.backupAt(t, VMBackup{Name: "db1"}, time.Date(2024, 1, 15, 10, 0, 0, 0, time.Local))
+	//The snapshot data is changed in place, in one block
+	copy(data[len(data)-1000:], bytes.Repeat([]byte{0xee}, 100))
+	incremental := e.backupAt(t, VMBackup{Name: "db1"}, time.Date(2024, 1, 16, 10, 0, 0, 0, time.Local))
+	containers.Release()
+
+	chain, err := readChain(incremental)
+	if err != nil {
+		t.Fatal(err)
+	}
+	disk := chain.Disks["scsi.0"]
+	if chain.Base == "" || disk.Delta == "" {
+		t.Fatalf("second backup is not incremental: %+v", chain)
+	}
+	if disk.Size != int64(len(data)) || disk.ChangedBlocks != 1 {
+		t.Fatalf("delta of %d bytes with %d changed blocks, want %d bytes with 1", disk.Size, disk.ChangedBlocks, len(data))
+	}
+	restored := filepath.Join(t.TempDir(), "scsi.0")
+	if err := materializeImage(context.Background(), incremental, "scsi.0", restored); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(restored); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("rebuilt image differs from the vdisk (%v)", err)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/loginoff/nutanix-backup/nutanixapi"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	journalFile = ".nutanix_backup_journal"
+	//How long a snapshot recorded without its creation task may take to show up
+	snapshotCreateGrace = time.Hour
+)
+
+// Journal keeps track of snapshots and mounts that have not been cleaned up yet.
+// Entries are added before the snapshot or mount is made and removed once it
+// has been deleted or unmounted, so whatever is left in the journal after an
+// interrupted run needs cleaning up. The snapshots of interrupted backups are
+// kept for the next backup of their VM to resume from.
+type Journal struct {
+	mu        sync.Mutex
+	path      string
+	Snapshots []JournalSnapshot `json:"snapshots"`
+	Mounts    []string          `json:"mounts"`
+}
+
+type JournalSnapshot struct {
+	Name   string `json:"name"`
+	VMUUID string `json:"vmUuid"`
+	UUID   string `json:"uuid,omitempty"`
+	//Task creating the snapshot, until the snapshot has a UUID
+	Task  string    `json:"task,omitempty"`
+	Added time.Time `json:"added"`
+	//The backup was interrupted, the next backup of the VM resumes from the snapshot
+	Resume      bool   `json:"resume,omitempty"`
+	Consistency string `json:"consistency,omitempty"`
+}
+
+func OpenJournal(path string) (*Journal, error) {
+	j := &Journal{path: path}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(j); err != nil {
+		return nil, fmt.Errorf("Corrupt journal %s: %s", path, err)
+	}
+	return j, nil
+}
+
+func (j *Journal) Empty() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return len(j.Snapshots) == 0 && len(j.Mounts) == 0
+}
+
+func (j *Journal) AddSnapshot(vmUUID, name string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.Snapshots = append(j.Snapshots, JournalSnapshot{Name: name, VMUUID: vmUUID, Added: time.Now()})
+	return j.save()
+}
+
+// SetSnapshotTask records the task creating the snapshot, so a cleanup can
+// tell whether it is still running
+func (j *Journal) SetSnapshotTask(name, task string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for i := range j.Snapshots {
+		if j.Snapshots[i].Name == name {
+			j.Snapshots[i].Task = task
+		}
+	}
+	return j.save()
+}
+
+func (j *Journal) SetSnapshotUUID(name, UUID string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for i := range j.Snapshots {
+		if j.Snapshots[i].Name == name {
+			j.Snapshots[i].UUID = UUID
+		}
+	}
+	return j.save()
+}
+
+// KeepSnapshot keeps the snapshot of an interrupted backup for the next backup
+// of its VM to resume from
+func (j *Journal) KeepSnapshot(name, UUID, consistency string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for i := range j.Snapshots {
+		if j.Snapshots[i].Name == name {
+			j.Snapshots[i].UUID = UUID
+			j.Snapshots[i].Resume = true
+			j.Snapshots[i].Consistency = consistency
+		}
+	}
+	return j.save()
+}
+
+// ResumeSnapshot returns the snapshot kept by an interrupted backup of the VM.
+// It is no longer kept, the backup resuming from it deletes it as usual.
+func (j *Journal) ResumeSnapshot(vmUUID string) (JournalSnapshot, bool, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for i := range j.Snapshots {
+		if j.Snapshots[i].VMUUID == vmUUID && j.Snapshots[i].Resume && j.Snapshots[i].UUID != "" {
+			j.Snapshots[i].Resume = false
+			return j.Snapshots[i], true, j.save()
+		}
+	}
+	return JournalSnapshot{}, false, nil
+}
+
+func (j *Journal) RemoveSnapshot(name string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var remaining []JournalSnapshot
+	for _, snap := range j.Snapshots {
+		if snap.Name != name {
+			remaining = append(remaining, snap)
+		}
+	}
+	j.Snapshots = remaining
+	return j.save()
+}
+
+func (j *Journal) AddMount(path string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.Mounts = append(j.Mounts, path)
+	return j.save()
+}
+
+func (j *Journal) RemoveMount(path string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var remaining []string
+	for _, mount := range j.Mounts {
+		if mount != path {
+			remaining = append(remaining, mount)
+		}
+	}
+	j.Mounts = remaining
+	return j.save()
+}
+
+// save writes the journal to a temporary file and renames it over the old one,
+// so a crash never leaves a half written journal behind. Must be called with j.mu held
+func (j *Journal) save() error {
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+
+	e := json.NewEncoder(f)
+	e.SetIndent("", "\t")
+	if err := e.Encode(j); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.path)
+}
+
+// Cleanup unmounts stale mounts and deletes orphaned snapshots listed in the journal.
+// Snapshots kept for resuming interrupted backups are left alone when resume
+// is set. It must not run concurrently with a backup
+func (j *Journal) Cleanup(ntnx *nutanixapi.Client, resume bool) error {
+	for _, mountpath := range j.Mounts {
+		if IsMounted(mountpath) {
+			log.Infof("Unmounting stale mount %s", mountpath)
+			if err := mounts.Umount(mountpath); err != nil {
+				return fmt.Errorf("Unable to unmount %s: %s", mountpath, err)
+			}
+		}
+		if err := j.RemoveMount(mountpath); err != nil {
+			return err
+		}
+	}
+
+	var orphaned []JournalSnapshot
+	for _, snap := range j.Snapshots {
+		if !(resume && snap.Resume) {
+			orphaned = append(orphaned, snap)
+		}
+	}
+	if len(orphaned) == 0 {
+		return nil
+	}
+
+	existing, err := ntnx.GetSnapshots()
+	if err != nil {
+		return err
+	}
+
+	for _, snap := range orphaned {
+		snapshot_uuid, pending, err := journalSnapshotUUID(ntnx, snap, existing)
+		if err != nil {
+			return err
+		}
+		if pending {
+			log.Infof("Snapshot %s may still be being created, leaving it for a later cleanup", snap.Name)
+			continue
+		}
+
+		if snapshot_uuid != "" {
+			log.Infof("Deleting orphaned snapshot %s (%s)", snap.Name, snapshot_uuid)
+			delete_task, err := ntnx.DeleteVMSnapshotByUUID(snapshot_uuid)
+			if err != nil {
+				return err
+			}
+			if _, err := ntnx.PollTaskForCompletion(context.Background(), delete_task); err != nil {
+				return err
+			}
+		} else {
+			log.Infof("Snapshot %s no longer exists", snap.Name)
+		}
+
+		if err := j.RemoveSnapshot(snap.Name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// journalSnapshotUUID returns the UUID of the snapshot of a journal entry if
+// it exists. Snapshots recorded before their creation task finished have no
+// UUID yet, they are looked up by name and by their task. pending is set
+// while the snapshot may still show up.
+func journalSnapshotUUID(ntnx *nutanixapi.Client, snap JournalSnapshot, existing []nutanixapi.AHVSnapshotInfo) (snapshot_uuid string, pending bool, err error) {
+	for _, s := range existing {
+		if (snap.UUID != "" && s.UUID == snap.UUID) || (snap.UUID == "" && s.SnapshotName == snap.Name && s.VMUUID == snap.VMUUID) {
+			return s.UUID, false, nil
+		}
+	}
+	if snap.UUID != "" {
+		return "", false, nil
+	}
+
+	if snap.Task == "" {
+		//Interrupted before PRISM answered, the snapshot may show up later
+		return "", time.Since(snap.Added) < snapshotCreateGrace, nil
+	}
+	task, err := ntnx.GetTaskByUUID(snap.Task)
+	if err != nil {
+		return "", false, err
+	}
+	switch {
+	case task.ProgressStatus == "Failed":
+		return "", false, nil
+	case task.PercentageComplete < 100:
+		return "", true, nil
+	}
+
+	//The task finished after the snapshots were listed
+	snapshots, err := ntnx.GetSnapshots()
+	if err != nil {
+		return "", false, err
+	}
+	for _, entity := range task.EntityList {
+		for _, s := range snapshots {
+			if entity.EntityType == "Snapshot" && entity.UUID == s.UUID {
+				return s.UUID, false, nil
+			}
+		}
+	}
+	return "", false, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/loginoff/nutanix-backup/nutanixapi/prismtest"
+)
+
+func TestJournalCleanupWithoutUUID(t *testing.T) {
+	tests := []struct {
+		name string
+		//Polls the creation task reports as running
+		polls int
+		fail  bool
+		//The task isn't recorded, the run was interrupted before PRISM answered
+		no_task bool
+		//The snapshot isn't created at all
+		no_snapshot bool
+		added       time.Duration
+		//Snapshot and journal entry left after each cleanup
+		left []bool
+	}{
+		{name: "snapshot created", left: []bool{false}},
+		{name: "task still running", polls: 1, left: []bool{true, false}},
+		{name: "task failed", fail: true, left: []bool{false}},
+		{name: "found by name", no_task: true, left: []bool{false}},
+		{name: "not created yet", no_task: true, no_snapshot: true, left: []bool{true}},
+		{name: "never created", no_task: true, no_snapshot: true, added: -2 * snapshotCreateGrace, left: []bool{false}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			prism := prismtest.NewServer()
+			defer prism.Close()
+			prism.AddContainer(testContainer, "ctr1", t.TempDir())
+			vm_uuid := prism.AddVM("web1", "", prismtest.Disk{Bus: "scsi", Index: 0, ContainerUUID: testContainer, Data: testDisk(1, 4096)})
+			ntnx, err := prism.Client()
+			if err != nil {
+				t.Fatal(err)
+			}
+			j, err := OpenJournal(filepath.Join(t.TempDir(), journalFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			const name = "web1_backup_20240115_1000"
+			if err := j.AddSnapshot(vm_uuid, name); err != nil {
+				t.Fatal(err)
+			}
+			j.Snapshots[0].Added = j.Snapshots[0].Added.Add(test.added)
+			prism.TaskPolls = test.polls
+			if test.fail {
+				prism.FailTask(prismtest.OpSnapshotCreate, "no space")
+			}
+			if !test.no_snapshot {
+				task, err := ntnx.CreateVMSnapshot(vm_uuid, name, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !test.no_task {
+					if err := j.SetSnapshotTask(name, task); err != nil {
+						t.Fatal(err)
+					}
+				} else if _, err := ntnx.PollTaskForCompletion(context.Background(), task); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for i, left := range test.left {
+				if err := j.Cleanup(ntnx, false); err != nil {
+					t.Fatal(err)
+				}
+				if (len(j.Snapshots) == 1) != left {
+					t.Fatalf("cleanup %d: journal has %v, want the entry left %v", i+1, j.Snapshots, left)
+				}
+				if !left && len(prism.Snapshots()) != 0 {
+					t.Fatalf("cleanup %d: snapshot left behind", i+1)
+				}
+			}
+		})
+	}
+}
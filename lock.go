@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const lockFile = ".nutanix_backup.lock"
+
+// Lock keeps runs from taking snapshots and cleaning up the journal at the
+// same time. The kernel releases it when the process exits, however it exits.
+type Lock struct {
+	f *os.File
+}
+
+func AcquireLock(path string) (*Lock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("Another run is in progress, it holds %s", path)
+		}
+		return nil, fmt.Errorf("Unable to lock %s: %s", path, err)
+	}
+
+	//For whoever wonders which process holds the lock
+	f.Truncate(0)
+	fmt.Fprintf(f, "%d\n", os.Getpid())
+	return &Lock{f: f}, nil
+}
+
+func (l *Lock) Release() {
+	if l.f == nil {
+		return
+	}
+	syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+	l.f.Close()
+	l.f = nil
+}
+
+// lockBackupRoot takes the lock for a command that changes backup_root, or
+// exits when another run holds it
+func lockBackupRoot() *Lock {
+	lock, err := AcquireLock(filepath.Join(BackupConfig.Backup_root, lockFile))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return lock
+}
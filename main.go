@@ -2,14 +2,19 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/loginoff/nutanix-backup/nutanixapi"
@@ -23,9 +28,26 @@ var (
 	password   *string
 	configfile *string
 	bwlimit    *string
+	keepgoing  *bool
+	workers    *int
 	debug      *bool
+	assumeyes  *bool
+	planonly   *bool
 	help       *bool
-	mounter    *NutanixMounter
+	//How the containers are read from
+	containers ContainerAccess
+	journal    *Journal
+	catalog    *Catalog
+	//Backups are encrypted with this key when one is configured
+	encryptionKey *EncryptionKey
+	//Where the disk images are stored
+	storage Storage
+	//Limits the number of disk images copied at the same time
+	copySlots chan struct{}
+	//Shared by the copies of a run, so bwlimit caps the run and not each copy
+	bandwidth *RateLimiter
+	//Clock the snapshots are named by
+	now = time.Now
 )
 
 var BackupConfig struct {
@@ -34,22 +56,83 @@ var BackupConfig struct {
 	Nutanix_mount_root string
 	Nutanix_cvm_addr   string
 	BWLimit            string
+	Continue_on_error  bool
+	Concurrency        int
+	Max_copies         int
+	Prune_after_backup bool
+	Verify_source      bool
+	Retention          RetentionPolicy
+	Incremental        bool
+	Full_every         int
+	Dedup              bool
+	Compression        string
+	//Either of these enables encryption
+	Encryption_key_file   string
+	Encryption_passphrase string
+	Storage               StorageConfig
+	Replication           ReplicationConfig
+	//nfs (default), local, userspace-nfs or sftp
+	Transport        string
+	Sftp_port        int
+	Sftp_known_hosts string
+	//Cron expression for the daemon, for VMs without a schedule of their own
+	Schedule string
+	//Address the daemon serves metrics on, eg. :9469, and a file the metrics
+	//are written to after every run, for the textfile collector of node_exporter
+	Metrics_listen   string
+	Metrics_textfile string
+	//crash (default) or application, and what to do when a VM can't be
+	//quiesced for an application consistent snapshot, fail (default) or crash
+	Consistency          string
+	Consistency_fallback string
 
-	VMs []VMBackup
+	//Glob patterns of VM names that selectors never pick
+	Exclude []string
+	VMs     []VMBackup
 }
 
+// VMBackup names a VM to back up, or selects VMs by the rules below. The
+// settings of a selector apply to every VM it selects.
 type VMBackup struct {
-	Name           string
-	Disks          []string
+	Name string
+	//Glob pattern, eg. prod-*
+	Name_pattern string
+	Name_regex   string
+	//#tags in the description of the VM, all of which must be there
+	Tags []string
+	//Every VM on the cluster
+	All bool
+	//Glob patterns of VM names this selector doesn't pick
+	Exclude []string
+	//Disks to back up, eg. scsi.0. Without them all disks that aren't CD-ROMs
+	//or empty are backed up, less the ones the rules below leave out.
+	Disks []string
+	//crash or application, and fail or crash when the VM can't be quiesced
+	Consistency          string
+	Consistency_fallback string
+	//Buses, indexes or glob patterns of disks, eg. scsi, 0 or scsi.*
+	Include_disks  []string
+	Exclude_disks  []string
+	Min_disk_size  string
+	Max_disk_size  string
+	Schedule       string
+	Pre_snapshot   *Hook
+	Post_snapshot  *Hook
+	Retention      *RetentionPolicy
+	Incremental    *bool
+	Dedup          *bool
+	Compression    string
 	SizeEstimation int64
 	VMInfo         nutanixapi.AHVVM
+	//How the VM was selected, for the preview
+	SelectedBy string
 }
 
 func (VM *VMBackup) EstimateBackupSize() string {
 	var total int64
 	for _, disk := range VM.Disks {
 		for _, diskinfo := range VM.VMInfo.Config.VMDisks {
-			if disk == fmt.Sprintf("%s.%d", diskinfo.Addr.DeviceBus, diskinfo.Addr.DeviceIndex) {
+			if disk == diskAddress(diskinfo.Addr.DeviceBus, diskinfo.Addr.DeviceIndex) {
 				total += diskinfo.VMDiskSize
 			}
 		}
@@ -59,6 +142,30 @@ func (VM *VMBackup) EstimateBackupSize() string {
 	return formatBytes(total)
 }
 
+// parseSize parses sizes like 500G or 2T into bytes. Numbers without a suffix are multiplied by unit.
+func parseSize(size string, unit float64) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	multipliers := map[byte]float64{
+		'K': 1024,
+		'M': 1024 * 1024,
+		'G': 1024 * 1024 * 1024,
+		'T': 1024 * 1024 * 1024 * 1024,
+	}
+	multiplier := unit
+	if n := len(s); n > 0 {
+		if m, ok := multipliers[s[n-1]]; ok {
+			multiplier = m
+			s = s[:n-1]
+		}
+	}
+
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("Invalid size %q", size)
+	}
+	return int64(value * multiplier), nil
+}
+
 func formatBytes(bytes int64) string {
 	gigabyte := int64(1024 * 1024 * 1024)
 	megabyte := int64(1024 * 1024)
@@ -73,13 +180,46 @@ func formatBytes(bytes int64) string {
 
 const defaultconfig = "/root/bin/backupconf.yml"
 
+// Number of times copying a disk image is attempted, each attempt resuming where the last one stopped
+const copyAttempts = 3
+
+// Exit statuses of a backup run
+const (
+	exitFailed = 1
+	//Some VMs were backed up, others failed
+	exitPartialFailure = 3
+	//Stopped by SIGINT or SIGTERM
+	exitInterrupted = 130
+)
+
 func init() {
 	username = flag.String("username", "", "Nutanix PRISM username")
 	password = flag.String("password", "", "Nutanix PRISM password")
 	configfile = flag.String("config", defaultconfig, "Configuration file for the entire backup process")
 	bwlimit = flag.String("bwlimit", "", "Limit the bandwidth of image copying eg 15M, 300K")
+	keepgoing = flag.Bool("continue-on-error", false, "Keep backing up the remaining VMs when one of them fails")
+	workers = flag.Int("concurrency", 0, "Number of VMs to back up in parallel")
 	debug = flag.Bool("debug", false, "Turn on debug logging")
+	assumeyes = flag.Bool("yes", false, "Don't ask for confirmation, for unattended runs")
+	planonly = flag.Bool("dry-run", false, "Only print what would be done, without changing anything")
 	help = flag.Bool("help", false, "Display help")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] [command]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Commands:\n")
+		fmt.Fprintf(os.Stderr, "  backup                         Back up the VMs listed in the configuration file (default)\n")
+		fmt.Fprintf(os.Stderr, "  restore [options] <backup_dir> Recreate a VM from a backup directory in backup_root\n")
+		fmt.Fprintf(os.Stderr, "  cleanup                        Delete snapshots and unmount containers left behind by an interrupted run\n")
+		fmt.Fprintf(os.Stderr, "  prune [-dry-run]               Delete backups according to the retention policies\n")
+		fmt.Fprintf(os.Stderr, "  list [options]                 List the backups in the catalog\n")
+		fmt.Fprintf(os.Stderr, "  show <backup>                  Show the details of a backup in the catalog\n")
+		fmt.Fprintf(os.Stderr, "  verify [-source] [backup...]   Check the disk images against their checksums\n")
+		fmt.Fprintf(os.Stderr, "  gc [-dry-run]                  Delete chunks no backup refers to from the deduplicating repository\n")
+		fmt.Fprintf(os.Stderr, "  replicate [-dry-run]           Copy the backups the replication target lacks to it\n")
+		fmt.Fprintf(os.Stderr, "  daemon                         Back up the VMs on their schedules, without asking for confirmation\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		flag.PrintDefaults()
+	}
 }
 
 func evaluateConfig() {
@@ -111,19 +251,104 @@ func evaluateConfig() {
 	if *bwlimit != "" {
 		BackupConfig.BWLimit = *bwlimit
 	}
+	if BackupConfig.BWLimit != "" {
+		if _, err := parseBandwidth(BackupConfig.BWLimit); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	if BackupConfig.Prism_host == "" {
-		log.Fatalf("Must specify prism_host in %s", *configfile)
+	if *keepgoing {
+		BackupConfig.Continue_on_error = true
 	}
 
-	if len(BackupConfig.VMs) < 1 {
-		log.Fatalf("Specify at least 1 VM to be backed up in %s", *configfile)
+	if *workers > 0 {
+		BackupConfig.Concurrency = *workers
+	}
+	if BackupConfig.Concurrency < 1 {
+		BackupConfig.Concurrency = 1
+	}
+	if BackupConfig.Max_copies < 1 || BackupConfig.Max_copies > BackupConfig.Concurrency {
+		BackupConfig.Max_copies = BackupConfig.Concurrency
+	}
+
+	if err := validConsistency(BackupConfig.Consistency, BackupConfig.Consistency_fallback); err != nil {
+		log.Fatal(err)
+	}
+	for i := range BackupConfig.VMs {
+		if err := BackupConfig.VMs[i].validateSelector(); err != nil {
+			log.Fatal(err)
+		}
+		if err := BackupConfig.VMs[i].validateDisks(); err != nil {
+			log.Fatal(err)
+		}
+		if err := validSchedule(scheduleFor(&BackupConfig.VMs[i])); err != nil {
+			log.Fatal(err)
+		}
+		if err := validConsistency(BackupConfig.VMs[i].Consistency, BackupConfig.VMs[i].Consistency_fallback); err != nil {
+			log.Fatal(err)
+		}
+		for _, hook := range []*Hook{BackupConfig.VMs[i].Pre_snapshot, BackupConfig.VMs[i].Post_snapshot} {
+			if hook == nil {
+				continue
+			}
+			if err := hook.validate(); err != nil {
+				log.Fatalf("%s: %s", BackupConfig.VMs[i].describe(), err)
+			}
+		}
+	}
+
+	codecs := []string{BackupConfig.Compression}
+	for _, vm := range BackupConfig.VMs {
+		codecs = append(codecs, vm.Compression)
+	}
+	for _, codec := range codecs {
+		if codec != "" {
+			if err := validCompression(codec); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	if BackupConfig.Encryption_key_file != "" || BackupConfig.Encryption_passphrase != "" {
+		encryptionKey, err = loadEncryptionKey(BackupConfig.Encryption_key_file, BackupConfig.Encryption_passphrase)
+		if err != nil {
+			log.Fatalf("Unable to load encryption key: %s", err)
+		}
+	}
+
+	policies := []RetentionPolicy{BackupConfig.Retention, BackupConfig.Replication.Retention}
+	for _, vm := range BackupConfig.VMs {
+		if vm.Retention != nil {
+			policies = append(policies, *vm.Retention)
+		}
+	}
+	for _, policy := range policies {
+		if policy.Max_total_size != "" {
+			if _, err := parseSize(policy.Max_total_size, 1); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	if BackupConfig.Prism_host == "" {
+		log.Fatalf("Must specify prism_host in %s", *configfile)
 	}
 
 	if BackupConfig.Nutanix_cvm_addr == "" {
 		log.Fatalf("Must specify a CVM IP using nutanix_cvm_addr in %s", *configfile)
 	}
 
+	switch BackupConfig.Transport {
+	case "":
+		BackupConfig.Transport = transportNFS
+	case transportNFS, transportLocal, transportUserNFS, transportSFTP:
+	default:
+		log.Fatalf("Unknown transport %q, use nfs, local, userspace-nfs or sftp", BackupConfig.Transport)
+	}
+	if BackupConfig.Sftp_port == 0 {
+		BackupConfig.Sftp_port = defaultSFTPPort
+	}
+
 	if BackupConfig.Backup_root == "" {
 		log.Fatalf("Must specify a local directory for VM images using backup_root in %s", *configfile)
 	}
@@ -135,6 +360,18 @@ func evaluateConfig() {
 	if !info.IsDir() {
 		log.Fatalf("%s must be a directory", BackupConfig.Backup_root)
 	}
+
+	storage, err = openStorage(BackupConfig.Storage)
+	if err != nil {
+		log.Fatalf("Unable to set up storage: %s", err)
+	}
+	if remoteStorage() {
+		for _, vm := range BackupConfig.VMs {
+			if incrementalFor(&vm) || dedupFor(&vm) {
+				log.Fatalf("Incremental and deduplicated backups need local storage, disable them for %s", vm.describe())
+			}
+		}
+	}
 }
 
 func setupLogging() {
@@ -155,40 +392,82 @@ func setupLogging() {
 	log.SetOutput(io.MultiWriter(f, os.Stderr))
 }
 
-func BackupVM(ntnx *nutanixapi.Client, vm *VMBackup) error {
+func BackupVM(ctx context.Context, ntnx *nutanixapi.Client, vm *VMBackup, result *BackupResult) error {
 	log.Infof("Starting with the backup of %s", vm.Name)
 
 	if len(vm.Disks) < 1 {
-		log.Infof("No disks specified to backup for VM %s", vm.Name)
+		log.Infof("No disks to backup for VM %s", vm.Name)
 		log.Infof("Skipping VM %s ...", vm.Name)
 		return nil
 	}
 	ahvvm := vm.VMInfo
 
-	log.Infof("Creating a snapshot of %s (%s)", ahvvm.Config.Name, ahvvm.UUID)
-
+	snapshot_time := now()
 	snapshot_name := getSnapshotName(vm.Name)
 
-	taskUUID, err := ntnx.CreateVMSnapshot(ahvvm.UUID, snapshot_name)
-	snapshot_task, err := ntnx.PollTaskForCompletion(taskUUID)
-	if err != nil {
-		return err
+	snapshot_start := time.Now()
+	var snapshot_uuid, consistency string
+	resumed, ok, err := resumableSnapshot(ntnx, vm)
+	if ok {
+		log.Infof("Resuming the interrupted backup of %s from snapshot %s", vm.Name, resumed.Name)
+		snapshot_name, snapshot_uuid, consistency = resumed.Name, resumed.UUID, resumed.Consistency
+		_, snapshot_time, _ = parseBackupName(snapshot_name)
+	} else if err == nil {
+		log.Infof("Creating a snapshot of %s (%s)", ahvvm.Config.Name, ahvvm.UUID)
+		var snapshot_task *nutanixapi.TaskInfo
+		snapshot_task, consistency, err = takeSnapshot(ctx, ntnx, vm, snapshot_name)
+
+		//Get snapshot info from the task
+		if snapshot_task != nil {
+			for _, entity := range snapshot_task.EntityList {
+				if entity.EntityType == "Snapshot" && entity.EntityName == snapshot_name {
+					snapshot_uuid = entity.UUID
+					break
+				}
+			}
+		}
 	}
+	result.Snapshot = snapshot_name
 
-	//Get snapshot info from the task
-	var snapshot_uuid string
-	for _, entity := range snapshot_task.EntityList {
-		if entity.EntityType == "Snapshot" && entity.EntityName == snapshot_name {
-			snapshot_uuid = entity.UUID
-			break
+	//Don't leave the snapshot behind if the backup fails before it is
+	//deleted below. The journal only cleans it up when we crash or can't
+	//delete it now. When interrupted, the snapshot and the partial copies
+	//are kept for the next run to resume from.
+	snapshot_deleted := false
+	defer func() {
+		if snapshot_uuid != "" && !snapshot_deleted && ctx.Err() != nil && consistency != "" {
+			log.Warnf("The backup of %s was interrupted, keeping snapshot %s to resume from", vm.Name, snapshot_name)
+			if err := journal.KeepSnapshot(snapshot_name, snapshot_uuid, consistency); err == nil {
+				return
+			}
 		}
+		if snapshot_uuid != "" && !snapshot_deleted {
+			log.Warnf("The backup of %s failed, deleting snapshot %s", vm.Name, snapshot_name)
+			if delerr := deleteSnapshot(ntnx, snapshot_uuid, snapshot_name); delerr != nil {
+				log.Errorf("Unable to delete snapshot %s: %s", snapshot_name, delerr)
+			}
+		}
+	}()
+	if err != nil {
+		return err
 	}
+	observePhase(vm.Name, phaseSnapshot, snapshot_start)
+
 	log.Debugf("Created snapshot %s", snapshot_uuid)
+	if err := journal.SetSnapshotUUID(snapshot_name, snapshot_uuid); err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
 
 	snapshot_info, err := ntnx.GetSnapshotByUUID(snapshot_uuid)
 	if err != nil {
 		return err
 	}
+	if consistency, err = checkConsistency(vm, consistency, snapshot_info); err != nil {
+		return err
+	}
 
 	//A little sanity check
 	if snapshot_info.SnapshotName != snapshot_name ||
@@ -212,88 +491,376 @@ func BackupVM(ntnx *nutanixapi.Client, vm *VMBackup) error {
 		return err
 	}
 
+	entry := CatalogEntry{
+		Name:         snapshot_name,
+		VM:           vm.Name,
+		VMUUID:       ahvvm.UUID,
+		SnapshotUUID: snapshot_uuid,
+		Time:         snapshot_time,
+	}
+
+	//The repository already stores unchanged data only once
+	dedup := dedupFor(vm)
+	incremental := incrementalFor(vm) && !dedup
+	if incremental {
+		entry.Base = incrementalBase(vm.Name)
+		if entry.Base != "" {
+			log.Infof("Backing up the changes of %s since %s", vm.Name, entry.Base)
+		}
+	}
+	chain := &ChainDescriptor{Base: entry.Base, Disks: make(map[string]ChainDisk)}
+	format := StorageFormat{Codec: compressionFor(vm), Key: encryptionKey}
+	meta := &BackupMeta{Compression: format.Codec, Consistency: consistency, Checksums: make(map[string]string)}
+	if format.Key != nil {
+		meta.KeyID = format.Key.ID
+	}
+	entry.Compression = meta.Compression
+	entry.KeyID = meta.KeyID
+	entry.Consistency = meta.Consistency
+	//Files in the backup directory, which the manifest lists
+	var stored []CatalogDisk
+
+	copy_start := time.Now()
 	//For each vdisk to be backed up, find it in the snapshot
 	for _, disk := range vm.Disks {
-		disk_uuid := ""
-		container_uuid := ""
-		for _, vdisk := range snapshot_info.VMCreateSpecification.VMDisks {
-			if disk == fmt.Sprintf("%s.%d", vdisk.DiskAddress.DeviceBus, vdisk.DiskAddress.DeviceIndex) {
-				disk_uuid = vdisk.VMDiskClone.VMDiskUUID
-				container_uuid = vdisk.VMDiskClone.ContainerUUID
-				break
-			}
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
 
-		if disk_uuid == "" || container_uuid == "" {
+		container_uuid, disk_container_path, ok := snapshotDiskPath(snapshot_info, disk)
+		if !ok {
 			log.Errorf("Unable to find VM %s disk %s in snapshot %s", vm.Name, disk, snapshot_info.UUID)
 			return fmt.Errorf("Unable to find all disks to backup for VM %s", vm.Name)
 		}
 
-		disk_container_path := fmt.Sprintf(".acropolis/snapshot/%s/vmdisk/%s", snapshot_info.GroupUUID, disk_uuid)
 		log.Debugf("Starting backup of %s", disk_container_path)
-		err := BackupVDisk(container_uuid, disk_container_path, backup_path, disk)
-		if err != nil {
+		catalog_disk := CatalogDisk{Name: disk}
+		stored_disk := CatalogDisk{Name: disk}
+		switch {
+		case dedup:
+			index, stored_bytes, err := BackupVDiskDedup(ctx, container_uuid, disk_container_path, backup_path, disk, format)
+			if err != nil {
+				return err
+			}
+			stored_disk.Name = disk + indexSuffix
+			if stored_disk.Checksum, err = hashFile(ctx, filepath.Join(backup_path, stored_disk.Name), nil); err != nil {
+				return err
+			}
+			catalog_disk.Checksum = index.Checksum
+			//Only the new chunks take up space
+			catalog_disk.Size = stored_bytes
+		case incremental:
+			chain_disk, file_checksum, content_checksum, err := BackupVDiskIncremental(ctx, container_uuid, disk_container_path, backup_path, disk, entry.Base, format)
+			if err != nil {
+				return err
+			}
+			chain.Disks[disk] = chain_disk
+			catalog_disk.Checksum = chain_disk.Checksum
+			stored_disk.Name = disk + format.Ext()
+			if chain_disk.Delta != "" {
+				stored_disk.Name = chain_disk.Delta
+			}
+			stored_disk.Checksum = file_checksum
+			meta.Checksums[stored_disk.Name] = content_checksum
+		default:
+			checksum, file_checksum, err := BackupVDisk(ctx, container_uuid, disk_container_path, backup_path, disk, format, nil)
+			if err != nil {
+				return err
+			}
+			catalog_disk.Checksum = checksum
+			stored_disk.Name = disk + format.Ext()
+			stored_disk.Checksum = file_checksum
+			meta.Checksums[stored_disk.Name] = checksum
+		}
+
+		if size, err := storage.Stat(ctx, objectName(snapshot_name, stored_disk.Name)); err == nil && !dedup {
+			catalog_disk.Size = size
+		}
+		result.BytesCopied += catalog_disk.Size
+		entry.Disks = append(entry.Disks, catalog_disk)
+		entry.Size += catalog_disk.Size
+		stored = append(stored, stored_disk)
+	}
+	observePhase(vm.Name, phaseCopy, copy_start)
+
+	if entry.Base != "" {
+		if err := writeChain(backup_path, chain); err != nil {
+			log.Errorf("Unable to write chain descriptor for %s", vm.Name)
 			return err
 		}
 	}
 
+	//The manifest already has the checksums of files stored as they are, and
+	//chunks are not files of the backup
+	if format.Raw() || dedup {
+		meta.Checksums = nil
+	}
+	if err := writeBackupMeta(backup_path, meta); err != nil {
+		log.Errorf("Unable to write backup metadata for %s", vm.Name)
+		return err
+	}
+
+	if err := writeManifest(backup_path, stored); err != nil {
+		log.Errorf("Unable to write checksum manifest for %s", vm.Name)
+		return err
+	}
+
+	//The manifest goes last, the backup is complete in the storage once it is there
+	if remoteStorage() {
+		if err := uploadMetadata(ctx, backup_path); err != nil {
+			log.Errorf("Unable to upload the metadata of %s to %s", snapshot_name, storage)
+			return err
+		}
+	}
+
+	entry.Status = statusOK
+	entry.SnapshotRetained = incremental
+	if err := catalog.Add(entry); err != nil {
+		log.Errorf("Unable to add %s to the catalog", snapshot_name)
+		return err
+	}
+
 	//After all disks are successfully backed up, delete the snapshot
 	if snapshot_info.SnapshotName != snapshot_name {
 		log.Fatal("Wrong snapshot")
 	}
 
-	delete_task, err := ntnx.DeleteVMSnapshotByUUID(snapshot_info.UUID)
+	snapshot_deleted = true
+	defer observePhase(vm.Name, phaseCleanup, time.Now())
+	if incremental {
+		//Keep the snapshot for the next incremental backup, it is no longer a leftover
+		if err := journal.RemoveSnapshot(snapshot_name); err != nil {
+			return err
+		}
+		releaseSnapshots(ntnx, vm.Name, snapshot_name)
+		return nil
+	}
+	return deleteSnapshot(ntnx, snapshot_info.UUID, snapshot_name)
+}
+
+// resumableSnapshot returns the snapshot an interrupted backup of the VM kept,
+// if it still exists
+func resumableSnapshot(ntnx *nutanixapi.Client, vm *VMBackup) (JournalSnapshot, bool, error) {
+	snap, ok, err := journal.ResumeSnapshot(vm.VMInfo.UUID)
+	if !ok || err != nil {
+		return snap, false, err
+	}
+	if _, err := ntnx.GetSnapshotByUUID(snap.UUID); err != nil {
+		//Left in the journal for the cleanup to delete if it still exists
+		log.Warnf("Not resuming from snapshot %s: %s", snap.Name, err)
+		return snap, false, nil
+	}
+	return snap, true, nil
+}
+
+// takeSnapshot creates the snapshot of the VM between its pre-snapshot and
+// post-snapshot hooks. The snapshot isn't taken when the pre-snapshot hook
+// fails. The post-snapshot hook always runs, right after the snapshot and
+// even when interrupted, so the guest isn't left frozen. Returns the
+// consistency of the snapshot, and the task that took it along with the
+// error when only the post-snapshot hook failed.
+func takeSnapshot(ctx context.Context, ntnx *nutanixapi.Client, vm *VMBackup, snapshot_name string) (*nutanixapi.TaskInfo, string, error) {
+	if err := vm.Pre_snapshot.run(ctx, "pre-snapshot", vm); err != nil {
+		//The hook may have frozen the guest before failing
+		if posterr := vm.Post_snapshot.run(context.Background(), "post-snapshot", vm); posterr != nil {
+			log.Error(posterr)
+		}
+		return nil, "", fmt.Errorf("Not taking the snapshot of %s: %s", vm.Name, err)
+	}
+
+	snapshot_task, consistency, err := createSnapshot(ctx, ntnx, vm, snapshot_name)
+
+	if posterr := vm.Post_snapshot.run(context.Background(), "post-snapshot", vm); posterr != nil {
+		if err != nil {
+			log.Error(posterr)
+			return nil, "", err
+		}
+		return snapshot_task, "", fmt.Errorf("%s, the guest may still be frozen", posterr)
+	}
+	return snapshot_task, consistency, err
+}
+
+// createSnapshot takes the snapshot with the consistency configured for the
+// VM, falling back to a crash consistent one if the VM can't be quiesced and
+// that is allowed
+func createSnapshot(ctx context.Context, ntnx *nutanixapi.Client, vm *VMBackup, snapshot_name string) (*nutanixapi.TaskInfo, string, error) {
+	//Record the snapshot before creating it, so it can be cleaned up if we get interrupted
+	if err := journal.AddSnapshot(vm.VMInfo.UUID, snapshot_name); err != nil {
+		return nil, "", err
+	}
+
+	consistency := consistencyFor(vm)
+	snapshot_task, err := snapshotTask(ctx, ntnx, vm, snapshot_name, consistency == consistencyApplication)
+	if err != nil && consistency == consistencyApplication {
+		if fallbackFor(vm) != fallbackCrash || ctx.Err() != nil {
+			return nil, "", fmt.Errorf("Unable to take an application consistent snapshot of %s: %s", vm.Name, err)
+		}
+		log.Warnf("Unable to take an application consistent snapshot of %s, taking a crash consistent one: %s", vm.Name, err)
+		consistency = consistencyCrash
+		snapshot_task, err = snapshotTask(ctx, ntnx, vm, snapshot_name, false)
+	}
+	return snapshot_task, consistency, err
+}
+
+// snapshotTask creates the snapshot and waits for it. When ctx is cancelled
+// the snapshot is left to the journal, which knows its task.
+func snapshotTask(ctx context.Context, ntnx *nutanixapi.Client, vm *VMBackup, snapshot_name string, app_consistent bool) (*nutanixapi.TaskInfo, error) {
+	taskUUID, err := ntnx.CreateVMSnapshot(vm.VMInfo.UUID, snapshot_name, app_consistent)
+	if err != nil {
+		return nil, err
+	}
+	if err := journal.SetSnapshotTask(snapshot_name, taskUUID); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	snapshot_task, err := ntnx.PollTaskForCompletion(ctx, taskUUID)
+	snapshotWait.WithLabelValues(vm.Name).Set(time.Since(start).Seconds())
+	return snapshot_task, err
+}
+
+// snapshotDiskPath finds a disk of the VM, like scsi.0, in the snapshot and
+// returns the container it is on and its path relative to the container root
+func snapshotDiskPath(snapshot_info *nutanixapi.AHVSnapshotInfo, disk string) (container_uuid, disk_container_path string, ok bool) {
+	for _, vdisk := range snapshot_info.VMCreateSpecification.VMDisks {
+		if disk == diskAddress(vdisk.DiskAddress.DeviceBus, vdisk.DiskAddress.DeviceIndex) {
+			if vdisk.VMDiskClone.VMDiskUUID == "" || vdisk.VMDiskClone.ContainerUUID == "" {
+				return "", "", false
+			}
+			disk_container_path = fmt.Sprintf(".acropolis/snapshot/%s/vmdisk/%s", snapshot_info.GroupUUID, vdisk.VMDiskClone.VMDiskUUID)
+			return vdisk.VMDiskClone.ContainerUUID, disk_container_path, true
+		}
+	}
+	return "", "", false
+}
+
+func deleteSnapshot(ntnx *nutanixapi.Client, snapshot_uuid, snapshot_name string) error {
+	delete_task, err := ntnx.DeleteVMSnapshotByUUID(snapshot_uuid)
 	if err != nil {
-		log.Warning("Error initiating snapshot deletion %s", snapshot_info.UUID)
+		log.Warningf("Error initiating snapshot deletion %s", snapshot_uuid)
 		return err
 	}
 
-	snapshot_task, err = ntnx.PollTaskForCompletion(delete_task)
+	_, err = ntnx.PollTaskForCompletion(context.Background(), delete_task)
 	if err != nil {
-		log.Warning("Trouble waiting for task %s", snapshot_task.UUID)
+		log.Warningf("Trouble waiting for task %s", delete_task)
 		return err
 	}
 
-	return err
+	return journal.RemoveSnapshot(snapshot_name)
 }
 
+// WriteSnapshotInfo writes the VM info, encrypted when encryption is configured
 func WriteSnapshotInfo(spec *nutanixapi.AHVSnapshotInfo, path string) error {
-	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0640)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	e := json.NewEncoder(f)
+	w, err := StorageFormat{Codec: compressionNone, Key: encryptionKey}.Writer(f)
+	if err != nil {
+		return err
+	}
+	e := json.NewEncoder(w)
 	e.SetIndent("", "\t")
-	return e.Encode(spec)
+	if err := e.Encode(spec); err != nil {
+		return err
+	}
+	return w.Close()
 }
 
-func BackupVDisk(container_UUID, disk_container_path, vm_root, disk_name string) (err error) {
-	container_root, err := mounter.GetContainerMountPathByUUID(container_UUID)
+// BackupVDisk copies a vdisk from the container, stored in format, and returns
+// the checksum of the image and of the file it is stored in. The block map of
+// the image is computed into blocks unless it is nil.
+func BackupVDisk(ctx context.Context, container_UUID, disk_container_path, vm_root, disk_name string, format StorageFormat, blocks *blockHasher) (checksum, file_checksum string, err error) {
+	container_root, err := containers.Root(container_UUID)
 	if err != nil {
-		return err
+		return "", "", err
 	}
 	vdisk_path := filepath.Join(container_root, disk_container_path)
-	backup_path := filepath.Join(vm_root, disk_name)
+	backup_path := filepath.Join(vm_root, disk_name+format.Ext())
+
+	select {
+	case copySlots <- struct{}{}:
+		defer func() { <-copySlots }()
+	case <-ctx.Done():
+		return "", "", ctx.Err()
+	}
+
+	if remoteStorage() {
+		backup_path = objectName(filepath.Base(vm_root), disk_name+format.Ext())
+	}
 	log.Infof("Backing up %s to %s", vdisk_path, backup_path)
-	if BackupConfig.BWLimit != "" {
-		log.Infof("Bandwidth limited to %s", BackupConfig.BWLimit)
-		err = runCMD("rsync", "-P", "--sparse", "--bwlimit", BackupConfig.BWLimit, vdisk_path, backup_path)
-	} else {
-		err = runCMD("rsync", "-P", "--sparse", vdisk_path, backup_path)
+	for attempt := 1; ; attempt++ {
+		if remoteStorage() {
+			//Uploads can't be resumed either
+			checksum, file_checksum, err = storeObject(ctx, vdisk_path, backup_path, format, blocks)
+		} else if format.Raw() {
+			checksum, err = copyImage(ctx, vdisk_path, backup_path, blocks)
+			file_checksum = checksum
+		} else {
+			//Compressed or encrypted copies can't be resumed, they start over
+			checksum, file_checksum, err = storeImage(ctx, vdisk_path, backup_path, format, bandwidth, blocks)
+		}
+		if err == nil || ctx.Err() != nil || attempt == copyAttempts {
+			break
+		}
+		log.Warnf("Copying %s failed (attempt %d of %d), resuming: %s", vdisk_path, attempt, copyAttempts, err)
 	}
-	return
+	if err != nil {
+		//An interrupted copy is resumed by the next run
+		if !remoteStorage() && ctx.Err() == nil {
+			removePartial(backup_path)
+		}
+		return "", "", err
+	}
+
+	//Read the vdisk again to make sure the copy matches it
+	if BackupConfig.Verify_source {
+		log.Infof("Verifying %s against %s", backup_path, vdisk_path)
+		source_checksum, err := hashFile(ctx, vdisk_path, bandwidth)
+		if err != nil {
+			return "", "", err
+		}
+		if source_checksum != checksum {
+			return "", "", fmt.Errorf("Copy of %s does not match the vdisk", vdisk_path)
+		}
+	}
+	return checksum, file_checksum, nil
+}
+
+// copyImage copies src to dst, computing the block map of src into blocks
+// unless it is nil
+func copyImage(ctx context.Context, src, dst string, blocks *blockHasher) (string, error) {
+	copier := &Copier{Progress: logProgress, Limiter: bandwidth, Blocks: blocks}
+	return copier.Copy(ctx, src, dst)
+}
+
+// bandwidthLimiter returns a limiter for bwlimit, or nil when the bandwidth is
+// not limited. Built once per run, see bandwidth.
+func bandwidthLimiter() *RateLimiter {
+	if BackupConfig.BWLimit == "" {
+		return nil
+	}
+	log.Infof("Bandwidth limited to %s", BackupConfig.BWLimit)
+	//Validated in evaluateConfig
+	rate, _ := parseBandwidth(BackupConfig.BWLimit)
+	return NewRateLimiter(rate)
 }
 
 func getSnapshotName(vmname string) string {
-	t := time.Now()
+	t := now()
 
-	return fmt.Sprintf("%s_backup_%s", vmname, t.Format("20060102_1504"))
+	return fmt.Sprintf("%s_backup_%s", vmname, t.Format(snapshotTimeFormat))
 }
 
 func runCMD(cmd string, args ...string) (err error) {
-	proc := exec.Command(cmd, args...)
+	return runCMDContext(context.Background(), cmd, args...)
+}
+
+// runCMDContext kills the command if ctx is cancelled before it finishes
+func runCMDContext(ctx context.Context, cmd string, args ...string) (err error) {
+	proc := exec.CommandContext(ctx, cmd, args...)
 	proc.Stdin = os.Stdin
 	proc.Stdout = os.Stdout
 	proc.Stderr = os.Stderr
@@ -306,60 +873,290 @@ func main() {
 	setupLogging()
 	evaluateConfig()
 
+	var err error
+	catalog, err = OpenCatalog(filepath.Join(BackupConfig.Backup_root, catalogFile))
+	if err != nil {
+		log.Fatalf("Unable to open catalog: %s", err)
+	}
+
+	journal, err = OpenJournal(filepath.Join(BackupConfig.Backup_root, journalFile))
+	if err != nil {
+		log.Fatalf("Unable to open journal: %s", err)
+	}
+
+	//Commands that only work on backup_root don't need the cluster
+	switch flag.Arg(0) {
+	case "prune":
+		runPrune(flag.Args()[1:])
+		return
+	case "list":
+		runList(flag.Args()[1:])
+		return
+	case "show":
+		runShow(flag.Args()[1:])
+		return
+	case "verify":
+		runVerify(flag.Args()[1:])
+		return
+	case "gc":
+		runGC(flag.Args()[1:])
+		return
+	case "replicate":
+		runReplicate(flag.Args()[1:])
+		return
+	}
+
+	ntnx := connect()
+
+	if *planonly {
+		if flag.Arg(0) != "" && flag.Arg(0) != "backup" {
+			log.Fatalf("--dry-run is not supported by %s", flag.Arg(0))
+		}
+		runPlan(ntnx)
+		return
+	}
+
+	//The daemon takes the lock for each of its runs
+	if flag.Arg(0) == "daemon" {
+		runDaemon(ntnx)
+		return
+	}
+
+	//Keeps another run from cleaning up after, or backing up alongside, this one
+	lock := lockBackupRoot()
+	defer lock.Release()
+
+	if flag.Arg(0) == "cleanup" {
+		if err := journal.Cleanup(ntnx, false); err != nil {
+			log.Fatalf("Cleanup failed: %s", err)
+		}
+		return
+	}
+
+	//Clean up after a previous run that did not finish. Backups resume from
+	//the snapshots of the interrupted ones.
+	backup := flag.Arg(0) == "" || flag.Arg(0) == "backup"
+	if !journal.Empty() {
+		log.Warnf("Found leftovers from an interrupted run in %s, cleaning up", journal.path)
+		if err := journal.Cleanup(ntnx, backup); err != nil {
+			log.Fatalf("Cleanup failed, resolve manually or run the cleanup command: %s", err)
+		}
+	}
+
+	switch flag.Arg(0) {
+	case "", "backup":
+		runBackup(ntnx)
+	case "restore":
+		runRestore(ntnx, flag.Args()[1:])
+	default:
+		flag.Usage()
+		log.Fatalf("Unknown command %s", flag.Arg(0))
+	}
+}
+
+func connect() *nutanixapi.Client {
 	ntnx, err := nutanixapi.NewClient(BackupConfig.Prism_host, *username, *password, false)
 	if err != nil {
 		log.Fatal(err)
 	}
+	return ntnx
+}
+
+func runBackup(ntnx *nutanixapi.Client) {
+	vms := selectVMs(ntnx)
+
+	var totalSize int64
+	for i := range vms {
+		vm := &vms[i]
+		fmt.Printf("%20s (%d disks, %s total) selected by %s\n", vm.Name, len(vm.Disks), vm.EstimateBackupSize(), vm.SelectedBy)
+		totalSize += vm.SizeEstimation
+	}
+
+	if !askForConfirmation(fmt.Sprintf("Backup these %d VMs, totalling %s?\n", len(vms), formatBytes(totalSize))) {
+		log.Info("User cancelled backup")
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	loadMetrics()
+	succeeded, failed := backupVMs(ctx, ntnx, vms)
+	writeMetrics()
+	if ctx.Err() != nil {
+		//Let a second signal terminate us right away
+		stop()
+		log.Warn("Backup interrupted, cleaning up")
+		if err := containers.Release(); err != nil {
+			log.Error(err)
+		}
+		os.Exit(exitInterrupted)
+	}
+
+	//Snapshots kept for VMs that were not backed up this time
+	if !journal.Empty() {
+		if err := journal.Cleanup(ntnx, false); err != nil {
+			log.Errorf("Cleanup failed, resolve manually or run the cleanup command: %s", err)
+		}
+	}
+
+	if failed > 0 {
+		if succeeded > 0 {
+			os.Exit(exitPartialFailure)
+		}
+		os.Exit(exitFailed)
+	}
+}
+
+// selectVMs resolves the names and selectors in the configuration against
+// the VMs on the cluster
+func selectVMs(ntnx *nutanixapi.Client) []VMBackup {
+	if len(BackupConfig.VMs) < 1 {
+		log.Fatalf("Specify at least 1 VM to be backed up in %s", *configfile)
+	}
 
-	//Populate VM list with VM information
 	allvms, err := ntnx.GetVMs()
 	if err != nil {
 		log.Fatalf("Unable to retrieve VM list from PRISM %s", err)
 	}
-	for vmidx, vm := range BackupConfig.VMs {
-		for _, nvm := range allvms {
-			if vm.Name == nvm.Config.Name {
-				if vm.VMInfo.UUID != "" {
-					log.Fatalf("More than one VM found with the name %s, aborting", vm.Name)
-				} else {
-					BackupConfig.VMs[vmidx].VMInfo = nvm
+	vms, err := resolveVMs(allvms)
+	if err != nil {
+		log.Fatalf("%s, aborting", err)
+	}
+	if len(vms) < 1 {
+		log.Fatalf("None of the VMs on the cluster are selected in %s", *configfile)
+	}
+	return vms
+}
+
+// backupVMs backs up the VMs, writes the summary and prunes and replicates
+// when configured to. Returns the number of VMs backed up and failed. When ctx
+// is cancelled, the running backups are stopped and the containers are left
+// mounted for the caller to clean up.
+func backupVMs(ctx context.Context, ntnx *nutanixapi.Client, vms []VMBackup) (succeeded, failed int) {
+	results := make([]BackupResult, len(vms))
+	for i, vm := range vms {
+		results[i] = BackupResult{VM: vm.Name, Status: statusSkipped}
+	}
+
+	var err error
+	containers, err = newContainerAccess(ntnx, false)
+	if err != nil {
+		log.Errorf("Unable to access the containers: %s", err)
+		for i := range results {
+			results[i].Status = statusFailed
+			results[i].Error = err.Error()
+		}
+		writeSummary(results)
+		return 0, len(vms)
+	}
+	defer func() {
+		if ctx.Err() == nil {
+			if err := containers.Release(); err != nil {
+				log.Error(err)
+			}
+		}
+	}()
+
+	copySlots = make(chan struct{}, BackupConfig.Max_copies)
+	bandwidth = bandwidthLimiter()
+	log.Infof("Backing up %d VMs at a time, copying at most %d disks at a time", BackupConfig.Concurrency, BackupConfig.Max_copies)
+
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	jobs := make(chan int)
+	for w := 0; w < BackupConfig.Concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				vm := vms[i]
+				start := time.Now()
+				err := BackupVM(ctx, ntnx, &vm, &results[i])
+
+				mu.Lock()
+				results[i].Duration = time.Since(start)
+				switch {
+				case ctx.Err() != nil:
+					log.Warnf("Backup of %s interrupted", vm.Name)
+					results[i].Status = statusInterrupted
+				case err != nil:
+					log.Errorf("Failed to backup VM %s: %s", vm.Name, err)
+					results[i].Status = statusFailed
+					results[i].Error = err.Error()
+					failed++
+				default:
+					results[i].Status = statusOK
+					succeeded++
 				}
+				recordBackup(&results[i])
+				mu.Unlock()
 			}
+		}()
+	}
+
+	//Hand out VMs to the workers until we are interrupted or, unless
+	//continue_on_error is set, a backup fails. Running backups are finished.
+	for i := range vms {
+		mu.Lock()
+		abort := failed > 0 && !BackupConfig.Continue_on_error
+		mu.Unlock()
+		if abort {
+			break
+		}
+
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
 		}
-		if BackupConfig.VMs[vmidx].VMInfo.UUID == "" {
-			log.Fatalf("Did not find a VM named %s, aborting", vm.Name)
+		if ctx.Err() != nil {
+			break
 		}
 	}
+	close(jobs)
+	wg.Wait()
 
-	var totalSize int64
-	for _, vm := range BackupConfig.VMs {
-		fmt.Printf("%20s (%d disks, %s total)\n", vm.Name, len(vm.Disks), vm.EstimateBackupSize())
-		totalSize += vm.SizeEstimation
+	writeSummary(results)
+	if ctx.Err() != nil {
+		return succeeded, failed
 	}
 
-	if !askForConfirmation(fmt.Sprintf("Backup these %d VMs, totalling %s?\n", len(BackupConfig.VMs), formatBytes(totalSize))) {
-		log.Info("User cancelled backup")
-		os.Exit(1)
+	if BackupConfig.Prune_after_backup {
+		if failed > 0 {
+			log.Warn("Not pruning old backups, because some VMs failed to back up")
+		} else if err := prune(false); err != nil {
+			log.Errorf("Pruning failed: %s", err)
+		} else if exists(filepath.Join(BackupConfig.Backup_root, chunkDir)) {
+			if err := gc(false); err != nil {
+				log.Errorf("Garbage collection failed: %s", err)
+			}
+		}
 	}
 
-	mounter = NewNutanixMounter(ntnx, BackupConfig.Nutanix_cvm_addr, BackupConfig.Nutanix_mount_root)
-	defer mounter.UmountAll()
-
-	for _, vm := range BackupConfig.VMs {
-		err = BackupVM(ntnx, &vm)
-		if err != nil {
-			log.Fatalf("Failed to backup VM %s", vm.Name)
+	if BackupConfig.Replication.After_backup && succeeded > 0 {
+		if err := replicate(ctx, false); err != nil {
+			log.Errorf("Replication failed: %s", err)
 		}
 	}
+	return succeeded, failed
 }
 
 func askForConfirmation(s string) bool {
+	if *assumeyes {
+		fmt.Printf("%s [y/n]: y (--yes)\n", s)
+		return true
+	}
 	reader := bufio.NewReader(os.Stdin)
 
 	for {
 		fmt.Printf("%s [y/n]: ", s)
 
 		response, err := reader.ReadString('\n')
+		if err == io.EOF {
+			log.Fatal("No answer on stdin, pass --yes for unattended runs")
+		}
 		if err != nil {
 			log.Fatal(err)
 		}
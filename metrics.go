@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const metricsNamespace = "nutanix_backup"
+
+// Phases of the backup of a VM, timed in the metrics
+const (
+	//Running the hooks and taking the snapshot
+	phaseSnapshot = "snapshot"
+	phaseCopy     = "copy"
+	//Deleting or keeping the snapshot
+	phaseCleanup = "cleanup"
+)
+
+// The metrics only hold backups, not the internals of the process, so the
+// textfile holds nothing node_exporter exports itself
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	lastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_success_timestamp_seconds",
+		Help:      "Time of the snapshot of the last good backup of the VM.",
+	}, []string{"vm"})
+	bytesCopied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "bytes_copied_total",
+		Help:      "Bytes of disk images stored for the VM.",
+	}, []string{"vm"})
+	phaseDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "phase_duration_seconds",
+		Help:      "How long the phases of the last backup of the VM took.",
+	}, []string{"vm", "phase"})
+	snapshotWait = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "snapshot_wait_seconds",
+		Help:      "How long the last snapshot task of the VM took to complete on the cluster.",
+	}, []string{"vm"})
+	failures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "failures_total",
+		Help:      "Failed backups of the VM.",
+	}, []string{"vm"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(lastSuccess, bytesCopied, phaseDuration, snapshotWait, failures)
+}
+
+// loadMetrics sets the time of the last good backup of the VMs from the
+// catalog, so VMs not backed up by this run keep it
+func loadMetrics() {
+	for _, entry := range catalog.Find("", time.Time{}, time.Time{}) {
+		if entry.Status == statusOK {
+			lastSuccess.WithLabelValues(entry.VM).Set(float64(entry.Time.Unix()))
+		}
+	}
+}
+
+// recordBackup counts the outcome of the backup of a VM
+func recordBackup(result *BackupResult) {
+	bytesCopied.WithLabelValues(result.VM).Add(float64(result.BytesCopied))
+	failed := failures.WithLabelValues(result.VM)
+	switch result.Status {
+	case statusOK:
+		if entry, ok := catalog.Get(result.Snapshot); ok {
+			lastSuccess.WithLabelValues(result.VM).Set(float64(entry.Time.Unix()))
+		}
+	case statusFailed:
+		failed.Inc()
+	}
+}
+
+func observePhase(vm, phase string, start time.Time) {
+	phaseDuration.WithLabelValues(vm, phase).Set(time.Since(start).Seconds())
+}
+
+// writeMetrics writes the metrics to metrics_textfile, if it is set. The
+// file is replaced at once, node_exporter never reads half of it.
+func writeMetrics() {
+	if BackupConfig.Metrics_textfile == "" {
+		return
+	}
+	if err := prometheus.WriteToTextfile(BackupConfig.Metrics_textfile, metricsRegistry); err != nil {
+		log.Errorf("Unable to write metrics to %s: %s", BackupConfig.Metrics_textfile, err)
+	}
+}
+
+// serveMetrics serves the metrics on /metrics at metrics_listen, if it is
+// set, until ctx is cancelled
+func serveMetrics(ctx context.Context) error {
+	if BackupConfig.Metrics_listen == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", BackupConfig.Metrics_listen)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	server := &http.Server{Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	go func() {
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			log.Errorf("Serving metrics failed: %s", err)
+		}
+	}()
+	log.Infof("Serving metrics on http://%s/metrics", listener.Addr())
+	return nil
+}
@@ -1,92 +1,112 @@
 package main
 
 import (
-	"github.com/loginoff/nutanix-backup/nutanixapi"
+	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
+
+	"github.com/loginoff/nutanix-backup/nutanixapi"
 
 	log "github.com/Sirupsen/logrus"
 )
 
-type NutanixMounter struct {
-	ntnx       *nutanixapi.Client
+// NFSAccess mounts the containers over NFS with the kernel client, which
+// needs root. It is safe for concurrent use, containers are mounted once
+// and shared between all the backups running in parallel.
+type NFSAccess struct {
+	mu         sync.Mutex
+	names      *containerNames
 	nfs_server string
 	mount_root string
-	Containers map[string]*NutanixContainer
-}
-
-type NutanixContainer struct {
-	Name    string
-	Mounted bool
+	readwrite  bool
+	//Mount points of the mounted containers, by UUID
+	mounted map[string]string
 }
 
-func NewNutanixMounter(ntnx *nutanixapi.Client, nfsurl, local_mount_path string) *NutanixMounter {
-	info, err := os.Stat(local_mount_path)
-	if err != nil {
-		log.Fatal(err)
-	}
-	if !info.IsDir() {
-		log.Fatalf("%s must be a directory", local_mount_path)
+func NewNFSAccess(ntnx *nutanixapi.Client, nfsurl, local_mount_path string, readwrite bool) (*NFSAccess, error) {
+	if !IsDir(local_mount_path) {
+		return nil, fmt.Errorf("%s must be a directory", local_mount_path)
 	}
 
-	return &NutanixMounter{
-		ntnx:       ntnx,
+	return &NFSAccess{
+		names:      newContainerNames(ntnx),
 		nfs_server: nfsurl,
 		mount_root: local_mount_path,
-		Containers: make(map[string]*NutanixContainer),
-	}
+		readwrite:  readwrite,
+		mounted:    make(map[string]string),
+	}, nil
 }
 
-func (m *NutanixMounter) GetContainerMountPathByUUID(UUID string) (string, error) {
-	if cont, ok := m.Containers[UUID]; ok {
-		log.Debugf("container mount for %s cached", cont.Name)
-		return filepath.Join(m.mount_root, cont.Name), nil
+func (m *NFSAccess) Root(UUID string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	} else {
-		cname, err := m.ntnx.GetContainerNameByUUID(UUID)
-		if err != nil {
-			log.Warning("Unable to retreive name for container %s", UUID)
-			return "", err
-		}
-
-		return m.Mount(UUID, cname)
+	if mountpath, ok := m.mounted[UUID]; ok {
+		log.Debugf("container mount %s cached", mountpath)
+		return mountpath, nil
+	}
+	cname, err := m.names.name(UUID)
+	if err != nil {
+		return "", err
 	}
+	return m.mount(UUID, cname)
 }
 
-func (m *NutanixMounter) Mount(UUID, cname string) (string, error) {
+// mount must be called with m.mu held
+func (m *NFSAccess) mount(UUID, cname string) (string, error) {
 	mountpath := filepath.Join(m.mount_root, cname)
 	log.Infof("Mounting %s:/%s to %s", m.nfs_server, cname, mountpath)
 
 	if !IsDir(mountpath) {
 		log.Debugf("%s does not exist, creating...", mountpath)
 		if err := Mkdir(mountpath); err != nil {
-			log.Fatal(err)
+			return "", err
 		}
 	}
 
 	if IsMounted(mountpath) {
-		log.Fatalf("%s is already mounted", mountpath)
+		return "", fmt.Errorf("%s is already mounted", mountpath)
 	}
 
-	err := runCMD("mount", "-t", "nfs", "-o", "ro", m.nfs_server+":/"+cname, mountpath)
-	if err != nil {
-		log.Fatal(err)
+	if err := journal.AddMount(mountpath); err != nil {
+		return "", err
+	}
+
+	mode := "ro"
+	if m.readwrite {
+		mode = "rw"
 	}
-	m.Containers[UUID] = &NutanixContainer{cname, true}
 
-	return mountpath, err
+	if err := mounts.Mount(m.nfs_server+":/"+cname, mountpath, mode); err != nil {
+		journal.RemoveMount(mountpath)
+		return "", fmt.Errorf("Unable to mount %s:/%s: %s", m.nfs_server, cname, err)
+	}
+	m.mounted[UUID] = mountpath
+
+	return mountpath, nil
 }
 
-func (m *NutanixMounter) UmountAll() error {
-	for _, cont := range m.Containers {
-		mountpath := filepath.Join(m.mount_root, cont.Name)
-		err := runCMD("umount", mountpath)
-		if err != nil {
-			log.Fatal(err)
+// Release unmounts all containers. Containers that fail to unmount stay in
+// the journal for the next run to clean up.
+func (m *NFSAccess) Release() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var failed error
+	for UUID, mountpath := range m.mounted {
+		if err := mounts.Umount(mountpath); err != nil {
+			log.Errorf("Unable to unmount %s: %s", mountpath, err)
+			failed = fmt.Errorf("Unable to unmount %s: %s", mountpath, err)
+			continue
 		}
+		delete(m.mounted, UUID)
 		log.Infof("Unmounted %s", mountpath)
+		if err := journal.RemoveMount(mountpath); err != nil {
+			return err
+		}
 	}
-	return nil
+	return failed
 }
 
 func exists(path string) bool {
@@ -106,13 +126,34 @@ func IsDir(path string) bool {
 }
 
 func IsMounted(path string) bool {
-	err := runCMD("mountpoint", "-q", path)
-	if err != nil {
-		return false
-	}
-	return true
+	return mounts.IsMounted(path)
 }
 
 func Mkdir(path string) error {
 	return os.MkdirAll(path, 0750)
 }
+
+// MountLayer mounts and unmounts the NFS exports of the containers. The
+// tests replace it with a fake that needs no root and no cluster.
+type MountLayer interface {
+	Mount(source, target, mode string) error
+	Umount(target string) error
+	IsMounted(target string) bool
+}
+
+var mounts MountLayer = commandMounts{}
+
+// commandMounts runs mount, umount and mountpoint
+type commandMounts struct{}
+
+func (commandMounts) Mount(source, target, mode string) error {
+	return runCMD("mount", "-t", "nfs", "-o", mode, source, target)
+}
+
+func (commandMounts) Umount(target string) error {
+	return runCMD("umount", target)
+}
+
+func (commandMounts) IsMounted(target string) bool {
+	return runCMD("mountpoint", "-q", target) == nil
+}
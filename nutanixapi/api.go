@@ -2,11 +2,13 @@ package nutanixapi
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -17,9 +19,17 @@ type Client struct {
 	baseurl_ahv   string
 	base64authstr string
 	httpclient    http.Client
+	//How often PollTaskForCompletion checks on a task
+	PollPeriod time.Duration
 }
 
 func NewClient(host, username, password string, verify_ssl bool) (*Client, error) {
+	return NewClientWithURL(fmt.Sprintf("https://%s:9440", host), username, password, verify_ssl)
+}
+
+// NewClientWithURL connects to PRISM at baseurl, eg. https://10.0.0.10:9440,
+// or a fake PRISM server in tests
+func NewClientWithURL(baseurl, username, password string, verify_ssl bool) (*Client, error) {
 	transport := http.DefaultTransport
 	if !verify_ssl {
 		transport = &http.Transport{
@@ -32,8 +42,9 @@ func NewClient(host, username, password string, verify_ssl bool) (*Client, error
 			Timeout:   time.Second * 10,
 			Transport: transport,
 		},
-		baseurl_v1:  fmt.Sprintf("https://%s:9440/PrismGateway/services/rest/v1/", host),
-		baseurl_ahv: fmt.Sprintf("https://%s:9440/api/nutanix/v0.8/", host),
+		baseurl_v1:  strings.TrimSuffix(baseurl, "/") + "/PrismGateway/services/rest/v1/",
+		baseurl_ahv: strings.TrimSuffix(baseurl, "/") + "/api/nutanix/v0.8/",
+		PollPeriod:  10 * time.Second,
 	}
 	req, _ := http.NewRequest("GET", c.baseurl_v1+"cluster", nil)
 	err := c.do_request(req, nil)
@@ -111,11 +122,14 @@ func (c *Client) GetVMByName(name string) (*AHVVM, error) {
 	return &last, nil
 }
 
-func (c *Client) CreateVMSnapshot(vmUUID, snapshotName string) (TaskUUID string, err error) {
+// CreateVMSnapshot starts taking a snapshot of the VM, an application
+// consistent one when appConsistent is set
+func (c *Client) CreateVMSnapshot(vmUUID, snapshotName string, appConsistent bool) (TaskUUID string, err error) {
 	vmspec := AHVSnapshotSpecList{
 		SnapshotSpecs: []AHVSnapshotSpec{
 			{VMUuid: vmUUID,
-				SnapshotName: snapshotName},
+				SnapshotName:  snapshotName,
+				AppConsistent: appConsistent},
 		},
 	}
 	bodybytes, err := json.Marshal(vmspec)
@@ -136,6 +150,25 @@ func (c *Client) CreateVMSnapshot(vmUUID, snapshotName string) (TaskUUID string,
 	return
 }
 
+func (c *Client) CreateVM(spec AHVVMCreateSpec) (TaskUUID string, err error) {
+	bodybytes, err := json.Marshal(spec)
+	log.Debugf("Create VM req: %s", string(bodybytes))
+	req, err := http.NewRequest("POST", c.baseurl_ahv+"vms", bytes.NewBuffer(bodybytes))
+	if err != nil {
+		return "", err
+	}
+
+	err = c.do_request(req, func(body []byte) error {
+		taskstruct := struct {
+			TaskUUID string `json:"taskUuid"`
+		}{}
+		err := json.Unmarshal(body, &taskstruct)
+		TaskUUID = taskstruct.TaskUUID
+		return err
+	})
+	return
+}
+
 func (c *Client) DeleteVMSnapshotByUUID(UUID string) (TaskUUID string, err error) {
 	req, _ := http.NewRequest("DELETE", c.baseurl_ahv+"snapshots/"+UUID, nil)
 
@@ -150,6 +183,22 @@ func (c *Client) DeleteVMSnapshotByUUID(UUID string) (TaskUUID string, err error
 	return
 }
 
+func (c *Client) GetSnapshots() ([]AHVSnapshotInfo, error) {
+	var snapshots []AHVSnapshotInfo
+	req, _ := http.NewRequest("GET", c.baseurl_ahv+"snapshots", nil)
+	err := c.do_request(req, func(body []byte) error {
+		var apiresponse APIResponse_Snapshots
+		err := json.Unmarshal(body, &apiresponse)
+		if err != nil {
+			log.Debugf("Unable to decode API response for %s", req.URL)
+			return err
+		}
+		snapshots = apiresponse.Entities
+		return nil
+	})
+	return snapshots, err
+}
+
 func (c *Client) GetSnapshotByUUID(UUID string) (*AHVSnapshotInfo, error) {
 	req, _ := http.NewRequest("GET", c.baseurl_ahv+"snapshots/"+UUID, nil)
 
@@ -181,8 +230,10 @@ func (c *Client) GetTaskByUUID(UUID string) (*TaskInfo, error) {
 	return &task, err
 }
 
-func (c *Client) PollTaskForCompletion(UUID string) (*TaskInfo, error) {
-	poll_period := 10 * time.Second
+// PollTaskForCompletion waits for a task to complete. It stops waiting when
+// ctx is cancelled, the task itself keeps running.
+func (c *Client) PollTaskForCompletion(ctx context.Context, UUID string) (*TaskInfo, error) {
+	poll_period := c.PollPeriod
 	var waited time.Duration
 	log.Debugf("Polling task %s for completion", UUID)
 
@@ -198,7 +249,11 @@ func (c *Client) PollTaskForCompletion(UUID string) (*TaskInfo, error) {
 			return task, err
 		}
 		log.Infof("Waiting for operation %s to complete. Progress %d. Taken so far %s", task.OperationType, task.PercentageComplete, waited)
-		time.Sleep(poll_period)
+		select {
+		case <-time.After(poll_period):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 		waited += poll_period
 	}
 }
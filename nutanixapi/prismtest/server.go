@@ -0,0 +1,518 @@
+// Package prismtest runs a fake PRISM server for tests, with the v1 and v0.8
+// endpoints the backups use. VMs and containers are set up by the test, tasks
+// can be made to run for a number of polls or to fail, and requests can be
+// made to fail with an HTTP status.
+package prismtest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/loginoff/nutanix-backup/nutanixapi"
+)
+
+// Operation types of the tasks the server runs
+const (
+	OpSnapshotCreate = "kSnapshotCreate"
+	OpSnapshotDelete = "kSnapshotDelete"
+	OpVMCreate       = "kVmCreate"
+	OpImageCreate    = "kImageCreate"
+)
+
+const (
+	v1Prefix  = "/PrismGateway/services/rest/v1/"
+	ahvPrefix = "/api/nutanix/v0.8/"
+)
+
+// Disk is a disk of a fake VM. Its data is written to the container when a
+// snapshot of the VM is taken.
+type Disk struct {
+	Bus           string
+	Index         int
+	ContainerUUID string
+	Data          []byte
+	Cdrom         bool
+}
+
+type container struct {
+	name string
+	//Directory standing in for the container, vdisks of snapshots are written here
+	dir string
+}
+
+// NIC is a network interface of a fake VM
+type NIC struct {
+	NetworkUUID string `json:"networkUuid"`
+	MacAddress  string `json:"macAddress"`
+}
+
+type vm struct {
+	info  nutanixapi.AHVVM
+	disks []Disk
+	nics  []NIC
+	//Application consistent snapshots fail without guest tools
+	noGuestTools bool
+}
+
+type task struct {
+	info nutanixapi.TaskInfo
+	//Polls left before the task completes
+	polls  int
+	fail   string
+	onDone func()
+}
+
+type failure struct {
+	method string
+	path   string
+	status int
+	count  int
+}
+
+// Server is a fake PRISM server listening on a local TLS port
+type Server struct {
+	*httptest.Server
+	Username string
+	Password string
+	//Number of polls tasks report as running before they complete
+	TaskPolls int
+
+	mu         sync.Mutex
+	containers map[string]*container
+	vms        []*vm
+	snapshots  map[string]*nutanixapi.AHVSnapshotInfo
+	tasks      map[string]*task
+	taskFails  map[string]string
+	failures   []*failure
+	images     []nutanixapi.AHVImageSpec
+	created    []nutanixapi.AHVVMCreateSpec
+	requests   []string
+}
+
+func NewServer() *Server {
+	s := &Server{
+		Username:   "admin",
+		Password:   "nutanix/4u",
+		containers: make(map[string]*container),
+		snapshots:  make(map[string]*nutanixapi.AHVSnapshotInfo),
+		tasks:      make(map[string]*task),
+		taskFails:  make(map[string]string),
+	}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Client returns a client for the server that doesn't wait between polls of tasks
+func (s *Server) Client() (*nutanixapi.Client, error) {
+	c, err := nutanixapi.NewClientWithURL(s.URL, s.Username, s.Password, false)
+	if err != nil {
+		return nil, err
+	}
+	c.PollPeriod = time.Millisecond
+	return c, nil
+}
+
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	h := hex.EncodeToString(b)
+	return fmt.Sprintf("%s-%s-%s-%s-%s", h[:8], h[8:12], h[12:16], h[16:20], h[20:])
+}
+
+// AddContainer adds a container with dir standing in for its root
+func (s *Server) AddContainer(uuid, name, dir string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.containers[uuid] = &container{name: name, dir: dir}
+}
+
+// AddVM adds a VM and returns its UUID
+func (s *Server) AddVM(name, description string, disks ...Disk) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v := &vm{disks: disks}
+	v.info.UUID = newUUID()
+	v.info.State = "on"
+	v.info.Config.Name = name
+	v.info.Config.Description = description
+	v.info.Config.NumVcpus = 1
+	v.info.Config.NumCoresPerVcpu = 1
+	v.info.Config.MemoryMb = 1024
+	//The disks are anonymous structs in AHVVM, they are filled in from JSON
+	var vmdisks []map[string]interface{}
+	for _, disk := range disks {
+		d := map[string]interface{}{
+			"addr":    map[string]interface{}{"deviceBus": disk.Bus, "deviceIndex": disk.Index},
+			"id":      fmt.Sprintf("%s.%d", disk.Bus, disk.Index),
+			"isCdrom": disk.Cdrom,
+			"isEmpty": disk.Cdrom && len(disk.Data) == 0,
+		}
+		if !(disk.Cdrom && len(disk.Data) == 0) {
+			d["vmDiskUuid"] = newUUID()
+			d["containerUuid"] = disk.ContainerUUID
+			d["vmDiskSize"] = len(disk.Data)
+		}
+		vmdisks = append(vmdisks, d)
+	}
+	disks_json, _ := json.Marshal(vmdisks)
+	json.Unmarshal(disks_json, &v.info.Config.VMDisks)
+	s.vms = append(s.vms, v)
+	return v.info.UUID
+}
+
+// NoGuestTools makes application consistent snapshots of the VM fail, as if
+// Nutanix Guest Tools weren't installed or reachable in it
+func (s *Server) NoGuestTools(uuid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range s.vms {
+		if v.info.UUID == uuid {
+			v.noGuestTools = true
+		}
+	}
+}
+
+// AddNICs adds network interfaces to the VM, snapshots of it have them too
+func (s *Server) AddNICs(uuid string, nics ...NIC) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range s.vms {
+		if v.info.UUID == uuid {
+			v.nics = append(v.nics, nics...)
+		}
+	}
+}
+
+// FailTask makes the next task of the operation fail with the message
+func (s *Server) FailTask(operation, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.taskFails[operation] = message
+}
+
+// FailRequests makes the next count requests of the method to the path, eg.
+// GET /api/nutanix/v0.8/vms, fail with the HTTP status
+func (s *Server) FailRequests(method, path string, status, count int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, &failure{method: method, path: path, status: status, count: count})
+}
+
+// Snapshots returns the snapshots that exist on the server
+func (s *Server) Snapshots() []nutanixapi.AHVSnapshotInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var snapshots []nutanixapi.AHVSnapshotInfo
+	for _, snap := range s.snapshots {
+		snapshots = append(snapshots, *snap)
+	}
+	return snapshots
+}
+
+// CreatedVMs returns the specifications of the VMs created through the API
+func (s *Server) CreatedVMs() []nutanixapi.AHVVMCreateSpec {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]nutanixapi.AHVVMCreateSpec{}, s.created...)
+}
+
+// Images returns the specifications of the images created through the API
+func (s *Server) Images() []nutanixapi.AHVImageSpec {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]nutanixapi.AHVImageSpec{}, s.images...)
+}
+
+// Requests returns the requests the server received, as "METHOD path"
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	//The client joins some paths with an extra slash
+	p := path.Clean(r.URL.Path)
+	s.requests = append(s.requests, r.Method+" "+p)
+
+	username, password, ok := r.BasicAuth()
+	if !ok || username != s.Username || password != s.Password {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	for _, f := range s.failures {
+		if f.count > 0 && f.method == r.Method && f.path == p {
+			f.count--
+			http.Error(w, "scripted failure", f.status)
+			return
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(p+"/", v1Prefix):
+		s.serveV1(w, r, strings.TrimPrefix(p, strings.TrimSuffix(v1Prefix, "/")))
+	case strings.HasPrefix(p+"/", ahvPrefix):
+		s.serveAHV(w, r, strings.TrimPrefix(p, strings.TrimSuffix(ahvPrefix, "/")))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) serveV1(w http.ResponseWriter, r *http.Request, p string) {
+	switch {
+	case r.Method == "GET" && p == "/cluster":
+		reply(w, map[string]string{"name": "prismtest"})
+	case r.Method == "GET" && p == "/containers":
+		var entities []map[string]string
+		for uuid, c := range s.containers {
+			entities = append(entities, map[string]string{"containerUuid": uuid, "name": c.name})
+		}
+		reply(w, map[string]interface{}{"entities": entities})
+	case r.Method == "GET" && strings.HasPrefix(p, "/containers/"):
+		uuid := strings.TrimPrefix(p, "/containers/")
+		c, ok := s.containers[uuid]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		reply(w, map[string]string{"containerUuid": uuid, "name": c.name})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) serveAHV(w http.ResponseWriter, r *http.Request, p string) {
+	switch {
+	case r.Method == "GET" && p == "/vms":
+		var response nutanixapi.APIResponse_VMS
+		for _, v := range s.vms {
+			response.Entities = append(response.Entities, v.info)
+		}
+		response.Metadata.TotalEntities = len(response.Entities)
+		response.Metadata.GrandTotalEntities = len(response.Entities)
+		reply(w, response)
+	case r.Method == "POST" && p == "/vms":
+		var spec nutanixapi.AHVVMCreateSpec
+		if !decode(w, r, &spec) {
+			return
+		}
+		t := s.newTask(OpVMCreate, func() {
+			s.created = append(s.created, spec)
+		})
+		reply(w, map[string]string{"taskUuid": t.info.UUID})
+	case r.Method == "GET" && p == "/snapshots":
+		var response nutanixapi.APIResponse_Snapshots
+		for _, snap := range s.snapshots {
+			response.Entities = append(response.Entities, *snap)
+		}
+		response.Metadata.TotalEntities = len(response.Entities)
+		response.Metadata.GrandTotalEntities = len(response.Entities)
+		reply(w, response)
+	case r.Method == "POST" && p == "/snapshots":
+		s.createSnapshots(w, r)
+	case r.Method == "GET" && strings.HasPrefix(p, "/snapshots/"):
+		snap, ok := s.snapshots[strings.TrimPrefix(p, "/snapshots/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		reply(w, snap)
+	case r.Method == "DELETE" && strings.HasPrefix(p, "/snapshots/"):
+		uuid := strings.TrimPrefix(p, "/snapshots/")
+		if _, ok := s.snapshots[uuid]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		t := s.newTask(OpSnapshotDelete, func() {
+			delete(s.snapshots, uuid)
+		})
+		reply(w, map[string]string{"taskUuid": t.info.UUID})
+	case r.Method == "GET" && strings.HasPrefix(p, "/tasks/"):
+		t, ok := s.tasks[strings.TrimPrefix(p, "/tasks/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		s.poll(t)
+		reply(w, t.info)
+	case r.Method == "POST" && p == "/images":
+		var spec nutanixapi.AHVImageSpec
+		if !decode(w, r, &spec) {
+			return
+		}
+		t := s.newTask(OpImageCreate, func() {
+			s.images = append(s.images, spec)
+		})
+		reply(w, t.info)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// createSnapshots takes the snapshots once their task completes. The vdisks
+// of a snapshot are written to the directories of their containers, where
+// the backup reads them from.
+func (s *Server) createSnapshots(w http.ResponseWriter, r *http.Request) {
+	var specs nutanixapi.AHVSnapshotSpecList
+	if !decode(w, r, &specs) {
+		return
+	}
+
+	var snaps []*nutanixapi.AHVSnapshotInfo
+	var sources []*vm
+	quiesce_failed := ""
+	for _, spec := range specs.SnapshotSpecs {
+		var source *vm
+		for _, v := range s.vms {
+			if v.info.UUID == spec.VMUuid {
+				source = v
+			}
+		}
+		if source == nil {
+			http.Error(w, "no VM "+spec.VMUuid, http.StatusNotFound)
+			return
+		}
+		if spec.AppConsistent && source.noGuestTools {
+			quiesce_failed = "Unable to quiesce VM " + source.info.Config.Name + ", guest tools not reachable"
+		}
+		app_consistent := spec.AppConsistent
+		snap := &nutanixapi.AHVSnapshotInfo{
+			UUID:          newUUID(),
+			GroupUUID:     newUUID(),
+			VMUUID:        spec.VMUuid,
+			SnapshotName:  spec.SnapshotName,
+			CreatedTime:   time.Now().UnixNano() / 1000,
+			AppConsistent: &app_consistent,
+		}
+		//The create specification has the same shape as the VM, with clones of the vdisks
+		spec_json, _ := json.Marshal(map[string]interface{}{
+			"name":            source.info.Config.Name,
+			"description":     source.info.Config.Description,
+			"numVcpus":        source.info.Config.NumVcpus,
+			"numCoresPerVcpu": source.info.Config.NumCoresPerVcpu,
+			"memoryMb":        source.info.Config.MemoryMb,
+			"vmDisks":         snapshotDisks(source),
+			"vmNics":          append([]NIC{}, source.nics...),
+		})
+		json.Unmarshal(spec_json, &snap.VMCreateSpecification)
+		snaps = append(snaps, snap)
+		sources = append(sources, source)
+	}
+
+	t := s.newTask(OpSnapshotCreate, func() {
+		for i, snap := range snaps {
+			s.snapshots[snap.UUID] = snap
+			s.writeVDisks(snap, sources[i])
+		}
+	})
+	if quiesce_failed != "" {
+		t.fail = quiesce_failed
+	}
+	for _, snap := range snaps {
+		t.info.EntityList = append(t.info.EntityList, struct {
+			UUID       string `json:"uuid"`
+			EntityType string `json:"entityType"`
+			EntityName string `json:"entityName"`
+		}{UUID: snap.UUID, EntityType: "Snapshot", EntityName: snap.SnapshotName})
+	}
+	reply(w, map[string]string{"taskUuid": t.info.UUID})
+}
+
+func snapshotDisks(v *vm) []map[string]interface{} {
+	var disks []map[string]interface{}
+	for i, disk := range v.disks {
+		d := map[string]interface{}{
+			"diskAddress": map[string]interface{}{"deviceBus": disk.Bus, "deviceIndex": disk.Index},
+			"isCdrom":     disk.Cdrom,
+			"isEmpty":     v.info.Config.VMDisks[i].IsEmpty,
+		}
+		if !v.info.Config.VMDisks[i].IsEmpty {
+			d["vmDiskClone"] = map[string]interface{}{
+				"vmDiskUuid":    v.info.Config.VMDisks[i].VMDiskUUID,
+				"containerUuid": disk.ContainerUUID,
+			}
+		}
+		disks = append(disks, d)
+	}
+	return disks
+}
+
+func (s *Server) writeVDisks(snap *nutanixapi.AHVSnapshotInfo, v *vm) {
+	for i, disk := range v.disks {
+		c, ok := s.containers[disk.ContainerUUID]
+		if !ok || v.info.Config.VMDisks[i].IsEmpty {
+			continue
+		}
+		vdisk := filepath.Join(c.dir, ".acropolis", "snapshot", snap.GroupUUID, "vmdisk", v.info.Config.VMDisks[i].VMDiskUUID)
+		os.MkdirAll(filepath.Dir(vdisk), 0750)
+		ioutil.WriteFile(vdisk, disk.Data, 0640)
+	}
+}
+
+// newTask starts a task that runs onDone when it completes. Must be called with s.mu held
+func (s *Server) newTask(operation string, onDone func()) *task {
+	t := &task{polls: s.TaskPolls, onDone: onDone}
+	t.info.UUID = newUUID()
+	t.info.OperationType = operation
+	t.info.ProgressStatus = "Running"
+	t.info.CreateTime = time.Now().UnixNano() / 1000
+	t.info.StartTime = t.info.CreateTime
+	if message, ok := s.taskFails[operation]; ok {
+		t.fail = message
+		delete(s.taskFails, operation)
+	}
+	s.tasks[t.info.UUID] = t
+	return t
+}
+
+// poll advances a task. Must be called with s.mu held
+func (s *Server) poll(t *task) {
+	if t.info.ProgressStatus != "Running" {
+		return
+	}
+	if t.polls > 0 {
+		t.polls--
+		t.info.PercentageComplete = 100 / (t.polls + 2)
+		return
+	}
+	t.info.CompleteTime = time.Now().UnixNano() / 1000
+	t.info.LastUpdatedTime = t.info.CompleteTime
+	if t.fail != "" {
+		t.info.ProgressStatus = "Failed"
+		t.info.MetaResponse.Error = "kError"
+		t.info.MetaResponse.ErrorDetail = t.fail
+		return
+	}
+	t.info.ProgressStatus = "Succeeded"
+	t.info.PercentageComplete = 100
+	t.onDone()
+}
+
+func decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func reply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
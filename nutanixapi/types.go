@@ -46,6 +46,9 @@ type APIResponse_VMS struct {
 type AHVSnapshotSpec struct {
 	VMUuid       string `json:"vmUuid"`
 	SnapshotName string `json:"snapshotName"`
+	//Quiesce the guest through Nutanix Guest Tools (VSS on Windows) before
+	//taking the snapshot. Fails the task when the guest can't be quiesced.
+	AppConsistent bool `json:"appConsistent,omitempty"`
 }
 
 type AHVSnapshotSpecList struct {
@@ -60,6 +63,7 @@ type AHVSnapshotInfo struct {
 	GroupUUID             string `json:"groupUuid"`
 	VMUUID                string `json:"vmUuid"`
 	SnapshotName          string `json:"snapshotName"`
+	AppConsistent         *bool  `json:"appConsistent,omitempty"`
 	VMCreateSpecification struct {
 		Name            string `json:"name"`
 		Description     string `json:"description"`
@@ -94,6 +98,14 @@ type AHVSnapshotInfo struct {
 	} `json:"vmCreateSpecification"`
 }
 
+type APIResponse_Snapshots struct {
+	Metadata struct {
+		GrandTotalEntities int `json:"grandTotalEntities"`
+		TotalEntities      int `json:"totalEntities"`
+	} `json:"metadata"`
+	Entities []AHVSnapshotInfo `json:"entities"`
+}
+
 type TaskInfo struct {
 	UUID        string `json:"uuid"`
 	MetaRequest struct {
@@ -117,3 +129,28 @@ type TaskInfo struct {
 	PercentageComplete int    `json:"percentageComplete"`
 	ProgressStatus     string `json:"progressStatus"`
 }
+
+type AHVVMCreateSpec struct {
+	Name            string                `json:"name"`
+	Description     string                `json:"description,omitempty"`
+	NumVcpus        int                   `json:"numVcpus"`
+	NumCoresPerVcpu int                   `json:"numCoresPerVcpu"`
+	MemoryMb        int                   `json:"memoryMb"`
+	VMDisks         []AHVVMDiskCreateSpec `json:"vmDisks"`
+	VMNics          []AHVVMNicSpec        `json:"vmNics"`
+}
+
+type AHVVMDiskCreateSpec struct {
+	DiskAddress struct {
+		DeviceBus   string `json:"deviceBus"`
+		DeviceIndex int    `json:"deviceIndex"`
+	} `json:"diskAddress"`
+	VMDiskClone struct {
+		NdfsFilepath string `json:"ndfs_filepath"`
+	} `json:"vmDiskClone"`
+}
+
+type AHVVMNicSpec struct {
+	NetworkUUID string `json:"networkUuid"`
+	MacAddress  string `json:"macAddress,omitempty"`
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/loginoff/nutanix-backup/nutanixapi"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// runPlan prints what a backup run would do: the snapshots it would take, the
+// containers it would mount and where the disk images would go. Nothing is
+// changed on the cluster or in backup_root. Exits with exitFailed when the
+// run could not succeed.
+func runPlan(ntnx *nutanixapi.Client) {
+	vms := selectVMs(ntnx)
+	problems := 0
+
+	fmt.Printf("Dry run, nothing is changed on the cluster or in %s\n\n", BackupConfig.Backup_root)
+	if !journal.Empty() {
+		fmt.Printf("Leftovers of an interrupted run in %s would be cleaned up first\n\n", journal.path)
+	}
+
+	var totalSize int64
+	by_container := make(map[string][]string)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for i := range vms {
+		vm := &vms[i]
+		size := vm.EstimateBackupSize()
+		totalSize += vm.SizeEstimation
+		snapshot_name := getSnapshotName(vm.Name)
+		fmt.Fprintf(w, "%s\t%d disks, %s\tselected by %s\t\n", vm.Name, len(vm.Disks), size, vm.SelectedBy)
+		fmt.Fprintf(w, "  snapshot\t%s\t%s consistent\t\n", snapshot_name, consistencyFor(vm))
+		//Hooks are not run in a dry run
+		if vm.Pre_snapshot != nil {
+			fmt.Fprintf(w, "  pre-snapshot\t%s\t\t\n", vm.Pre_snapshot.describe())
+		}
+		if vm.Post_snapshot != nil {
+			fmt.Fprintf(w, "  post-snapshot\t%s\t\t\n", vm.Post_snapshot.describe())
+		}
+
+		dedup := dedupFor(vm)
+		base := ""
+		if incrementalFor(vm) && !dedup {
+			base = incrementalBase(vm.Name)
+		}
+		format := StorageFormat{Codec: compressionFor(vm), Key: encryptionKey}
+		for _, disk := range vm.Disks {
+			vdisk, ok := findVMDisk(vm, disk)
+			if !ok {
+				fmt.Fprintf(w, "  %s\tnot found on the VM\t\t\n", disk)
+				problems++
+				continue
+			}
+			by_container[vdisk.ContainerUUID] = append(by_container[vdisk.ContainerUUID], vm.Name+" "+disk)
+
+			file := disk + format.Ext()
+			switch {
+			case dedup:
+				file = disk + indexSuffix
+			case base != "":
+				file = disk + deltaSuffix + format.Ext()
+			}
+			dst := filepath.Join(BackupConfig.Backup_root, snapshot_name, file)
+			if remoteStorage() {
+				dst = fmt.Sprintf("%s/%s", storage, objectName(snapshot_name, file))
+			}
+			fmt.Fprintf(w, "  %s\t%s\t-> %s\t\n", disk, formatBytes(vdisk.VMDiskSize), dst)
+		}
+		if base != "" {
+			fmt.Fprintf(w, "  \tchanges since %s\t\t\n", base)
+		}
+	}
+	w.Flush()
+
+	fmt.Println()
+	problems += planContainers(ntnx, by_container)
+	fmt.Println()
+	problems += planSpace(totalSize)
+
+	fmt.Println()
+	if problems > 0 {
+		log.Errorf("Found %d problems, the backup would fail", problems)
+		os.Exit(exitFailed)
+	}
+	log.Infof("Would back up %d VMs, totalling %s", len(vms), formatBytes(totalSize))
+}
+
+type vmDisk struct {
+	ContainerUUID string
+	VMDiskSize    int64
+}
+
+func findVMDisk(vm *VMBackup, disk string) (vmDisk, bool) {
+	for _, vdisk := range vm.VMInfo.Config.VMDisks {
+		if disk == diskAddress(vdisk.Addr.DeviceBus, vdisk.Addr.DeviceIndex) {
+			return vmDisk{ContainerUUID: vdisk.ContainerUUID, VMDiskSize: vdisk.VMDiskSize}, true
+		}
+	}
+	return vmDisk{}, false
+}
+
+// planContainers prints the containers the backup would read from and checks
+// that they exist and can be reached. Returns the number of problems.
+func planContainers(ntnx *nutanixapi.Client, by_container map[string][]string) int {
+	port := 2049
+	if BackupConfig.Transport == transportSFTP {
+		port = BackupConfig.Sftp_port
+	}
+	addr := net.JoinHostPort(BackupConfig.Nutanix_cvm_addr, strconv.Itoa(port))
+	reachable := "reachable"
+	problems := 0
+	if BackupConfig.Transport != transportLocal {
+		if conn, err := net.DialTimeout("tcp", addr, 10*time.Second); err != nil {
+			reachable = fmt.Sprintf("unreachable: %s", err)
+			problems++
+		} else {
+			conn.Close()
+		}
+	}
+
+	var uuids []string
+	for uuid := range by_container {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER\tDISKS\tACCESS\tSTATUS")
+	for _, uuid := range uuids {
+		cname, err := ntnx.GetContainerNameByUUID(uuid)
+		if err != nil || cname == "" {
+			fmt.Fprintf(w, "%s\t%d\t\tnot found: %v\n", uuid, len(by_container[uuid]), err)
+			problems++
+			continue
+		}
+		local_path := filepath.Join(BackupConfig.Nutanix_mount_root, cname)
+		access, status := fmt.Sprintf("mount %s:/%s on %s", BackupConfig.Nutanix_cvm_addr, cname, local_path), reachable
+		switch BackupConfig.Transport {
+		case transportSFTP:
+			access = fmt.Sprintf("sftp %s:/%s", addr, cname)
+		case transportUserNFS:
+			access = fmt.Sprintf("userspace nfs %s:/%s", BackupConfig.Nutanix_cvm_addr, cname)
+		case transportLocal:
+			access, status = "directory "+local_path, "available"
+			if !IsDir(local_path) {
+				status = "missing"
+				problems++
+			}
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", cname, len(by_container[uuid]), access, status)
+	}
+	w.Flush()
+	return problems
+}
+
+// planSpace checks that backup_root has room for the estimated size of the
+// backups. The estimate is the size of the vdisks, compression, sparse copies
+// and incremental backups take up less. Returns the number of problems.
+func planSpace(estimate int64) int {
+	if remoteStorage() {
+		fmt.Printf("Disk images go to %s, its free space is not checked\n", storage)
+		return 0
+	}
+	free, err := freeSpace(BackupConfig.Backup_root)
+	if err != nil {
+		log.Errorf("Unable to check the free space in %s: %s", BackupConfig.Backup_root, err)
+		return 1
+	}
+	fmt.Printf("%s has %s free, the backups take up at most %s\n", BackupConfig.Backup_root, formatBytes(free), formatBytes(estimate))
+	if free < estimate {
+		log.Warnf("%s may run out of space", BackupConfig.Backup_root)
+	}
+	return 0
+}
+
+func freeSpace(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/loginoff/nutanix-backup/nutanixapi/prismtest"
+)
+
+// planCase is the case of TestRunPlan run in a child process, which runPlan
+// can exit
+const planCase = "NUTANIX_BACKUP_PLAN_CASE"
+
+func TestRunPlan(t *testing.T) {
+	tests := []struct {
+		name string
+		//Disks of web1 to back up, all if empty
+		disks []string
+		//Container of the disk of web1
+		container string
+		//Exit status of the dry run
+		status int
+		//Parts of the plan, with the columns separated by single spaces
+		want []string
+	}{
+		{
+			name:      "ok",
+			container: testContainer,
+			want: []string{
+				"Dry run, nothing is changed on the cluster",
+				"web1_backup_20240115_1000",
+				"snapshot web1_backup_20240115_1000 crash consistent",
+				"scsi.0 0MB -> ",
+				"ctr1 1 directory",
+				"mnt/ctr1 available",
+			},
+		},
+		{
+			name:      "missing disk",
+			disks:     []string{"scsi.0", "scsi.1"},
+			container: testContainer,
+			status:    exitFailed,
+			want:      []string{"scsi.1 not found on the VM"},
+		},
+		{
+			name:      "missing container",
+			container: "0005a1b2-0000-4000-8000-0000000dead0",
+			status:    exitFailed,
+			want:      []string{"0005a1b2-0000-4000-8000-0000000dead0 1 not found"},
+		},
+	}
+
+	if name := os.Getenv(planCase); name != "" {
+		for _, test := range tests {
+			if test.name == name {
+				e := setupE2E(t)
+				e.prism.AddVM("web1", "", prismtest.Disk{Bus: "scsi", Index: 0, ContainerUUID: test.container, Data: testDisk(1, 64*1024)})
+				BackupConfig.VMs = []VMBackup{{Name: "web1", Disks: test.disks}}
+				BackupConfig.Transport = transportLocal
+				if err := os.Mkdir(filepath.Join(BackupConfig.Nutanix_mount_root, "ctr1"), 0750); err != nil {
+					t.Fatal(err)
+				}
+				now = func() time.Time { return time.Date(2024, 1, 15, 10, 0, 0, 0, time.Local) }
+				runPlan(e.ntnx)
+
+				//Nothing is changed
+				if len(e.prism.Snapshots()) > 0 {
+					t.Error("dry run took a snapshot")
+				}
+				if backups, _ := filepath.Glob(filepath.Join(BackupConfig.Backup_root, "web1_*")); len(backups) > 0 {
+					t.Errorf("dry run created %v", backups)
+				}
+			}
+		}
+		return
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cmd := exec.Command(os.Args[0], "-test.run=^TestRunPlan$")
+			cmd.Env = append(os.Environ(), planCase+"="+test.name)
+			out, err := cmd.Output()
+			status := 0
+			if exit, ok := err.(*exec.ExitError); ok {
+				status = exit.ExitCode()
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if status != test.status {
+				t.Errorf("dry run exited with %d, want %d\n%s", status, test.status, out)
+			}
+			plan := strings.Join(strings.Fields(string(out)), " ")
+			for _, want := range test.want {
+				if !strings.Contains(plan, want) {
+					t.Errorf("plan lacks %q\n%s", want, out)
+				}
+			}
+		})
+	}
+}
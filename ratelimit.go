@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket limiting throughput to a number of bytes per second.
+// A nil *RateLimiter does not limit anything.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	burst := float64(bytesPerSecond)
+	if burst < copyChunkSize {
+		burst = copyChunkSize
+	}
+	return &RateLimiter{
+		rate:   float64(bytesPerSecond),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// Wait blocks until n bytes may be transferred or ctx is cancelled
+func (l *RateLimiter) Wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if wait == 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// parseBandwidth parses a bandwidth limit like 15M or 300K into bytes per second.
+// Like rsync's --bwlimit, a number without a suffix is in kilobytes.
+func parseBandwidth(limit string) (int64, error) {
+	rate, err := parseSize(limit, 1024)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid bandwidth limit %q", limit)
+	}
+	return rate, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	const mb = 1024 * 1024
+	tests := []struct {
+		name string
+		rate int64
+		//Sizes waited for one after another
+		waits []int
+		//Time they should take
+		min, max time.Duration
+	}{
+		{name: "within the burst", rate: 4 * mb, waits: []int{mb, mb, 2 * mb}, max: 50 * time.Millisecond},
+		{name: "over the burst", rate: 4 * mb, waits: []int{4 * mb, mb, mb}, min: 450 * time.Millisecond, max: 800 * time.Millisecond},
+		//Bursts of at least a chunk, or copies would never get through
+		{name: "slower than a chunk", rate: mb / 4, waits: []int{mb}, max: 50 * time.Millisecond},
+		{name: "slower than a chunk, over the burst", rate: mb / 4, waits: []int{mb, mb / 8}, min: 450 * time.Millisecond, max: 800 * time.Millisecond},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := NewRateLimiter(test.rate)
+			start := time.Now()
+			for _, n := range test.waits {
+				if err := l.Wait(context.Background(), n); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if elapsed := time.Since(start); elapsed < test.min || elapsed > test.max {
+				t.Fatalf("took %s, want between %s and %s", elapsed, test.min, test.max)
+			}
+		})
+	}
+}
+
+func TestRateLimiterCancel(t *testing.T) {
+	l := NewRateLimiter(1024 * 1024)
+	if err := l.Wait(context.Background(), 1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := l.Wait(ctx, 1024*1024); err != context.DeadlineExceeded {
+		t.Fatalf("wait returned %v, want the deadline", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("cancelled wait took %s", elapsed)
+	}
+
+	//Without a limit nothing waits
+	var unlimited *RateLimiter
+	if err := unlimited.Wait(ctx, 1024*1024); err != nil {
+		t.Fatal(err)
+	}
+}
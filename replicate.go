@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// ReplicationConfig describes the second site backups are copied to
+type ReplicationConfig struct {
+	Target StorageConfig
+	//Applied to the backups at the target instead of the local policies,
+	//max_total_size limits the size of all backups at the target
+	Retention RetentionPolicy
+	//Replicate at the end of every backup run
+	After_backup bool
+}
+
+// replicator copies backup sets from backup_root to the replication target
+type replicator struct {
+	target Storage
+	//Chunks of the deduplicating repository at the target, loaded when the
+	//first deduplicated backup is replicated
+	chunks map[string]bool
+}
+
+// replicate copies the complete backups the target doesn't have yet, then
+// applies the retention policy of the target
+func replicate(ctx context.Context, dryrun bool) error {
+	config := BackupConfig.Replication.Target
+	if (config.Type == "" || config.Type == storageLocal) && config.Path == "" {
+		return fmt.Errorf("Replicating to a directory needs a path")
+	}
+	target, err := openStorage(config)
+	if err != nil {
+		return err
+	}
+	r := &replicator{target: target}
+
+	remote, err := r.listBackups(ctx)
+	if err != nil {
+		return fmt.Errorf("Unable to list backups in %s: %s", target, err)
+	}
+	present := make(map[string]bool)
+	for _, b := range remote {
+		present[b.Name] = b.Complete
+	}
+
+	local, err := listBackups(BackupConfig.Backup_root)
+	if err != nil {
+		return err
+	}
+	//Oldest first, so the bases of incremental backups get there before them
+	var pending []StoredBackup
+	for i := len(local) - 1; i >= 0; i-- {
+		b := local[i]
+		if !b.Complete || present[b.Name] {
+			continue
+		}
+		if entry, ok := catalog.Get(b.Name); ok && entry.Status == statusCorrupt {
+			log.Warnf("Not replicating %s, it failed verification", b.Name)
+			continue
+		}
+		pending = append(pending, b)
+	}
+
+	//Backups the retention policy of the target would delete right away are not copied
+	decisions, err := r.plan(sortBackups(append(append([]StoredBackup{}, remote...), pending...)))
+	if err != nil {
+		return err
+	}
+	if decisions != nil {
+		keep := make(map[string]bool)
+		for _, d := range decisions {
+			keep[d.Backup.Name] = d.Keep
+		}
+		kept := pending[:0]
+		for _, b := range pending {
+			if keep[b.Name] {
+				kept = append(kept, b)
+			}
+		}
+		pending = kept
+	}
+	log.Infof("%d backups to replicate to %s", len(pending), target)
+
+	failed := 0
+	for _, b := range pending {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if dryrun {
+			fmt.Printf("Would replicate %s (%s)\n", b.Name, formatBytes(b.Size))
+		} else if b.Base != "" && !present[b.Base] {
+			log.Errorf("Not replicating %s, its base %s is not at %s", b.Name, b.Base, target)
+			failed++
+			continue
+		} else if err := r.replicateBackup(ctx, b); err != nil {
+			log.Errorf("Unable to replicate %s: %s", b.Name, err)
+			failed++
+			continue
+		}
+
+		//Replaces an incomplete copy left behind by an earlier run
+		for i := range remote {
+			if remote[i].Name == b.Name {
+				remote = append(remote[:i], remote[i+1:]...)
+				break
+			}
+		}
+		b.Path = ""
+		remote = append(remote, b)
+		present[b.Name] = true
+	}
+
+	if err := r.prune(ctx, sortBackups(remote), dryrun); err != nil {
+		return fmt.Errorf("Unable to prune %s: %s", target, err)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d backups failed to replicate", failed, len(pending))
+	}
+	return nil
+}
+
+// listBackups returns the backups at the target, newest first. Backups whose
+// manifest, which is copied last, is missing are incomplete.
+func (r *replicator) listBackups(ctx context.Context) ([]StoredBackup, error) {
+	objects, err := r.target.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]*StoredBackup)
+	var backups []*StoredBackup
+	for name, size := range objects {
+		dir, file := path.Split(name)
+		dir = strings.TrimSuffix(dir, "/")
+		vm, t, ok := parseBackupName(dir)
+		if !ok {
+			continue
+		}
+		b, ok := byName[dir]
+		if !ok {
+			b = &StoredBackup{Name: dir, VM: vm, Time: t}
+			byName[dir] = b
+			backups = append(backups, b)
+		}
+		b.Size += size
+		switch file {
+		case manifestFile:
+			b.Complete = true
+		case chainFile:
+			chain, err := r.readChain(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+			b.Base = chain.Base
+		}
+	}
+
+	result := make([]StoredBackup, 0, len(backups))
+	for _, b := range backups {
+		result = append(result, *b)
+	}
+	return sortBackups(result), nil
+}
+
+// sortBackups sorts backups newest first
+func sortBackups(backups []StoredBackup) []StoredBackup {
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Time.After(backups[j].Time)
+	})
+	return backups
+}
+
+func (r *replicator) readChain(ctx context.Context, name string) (*ChainDescriptor, error) {
+	f, err := r.target.Open(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var chain ChainDescriptor
+	err = json.NewDecoder(f).Decode(&chain)
+	return &chain, err
+}
+
+// replicateBackup copies the files of a backup and the chunks it refers to,
+// with the manifest last
+func (r *replicator) replicateBackup(ctx context.Context, b StoredBackup) error {
+	log.Infof("Replicating %s to %s", b.Name, r.target)
+	sums, err := readManifest(b.Path)
+	if err != nil {
+		return err
+	}
+	objects, err := storage.List(ctx, b.Name+"/")
+	if err != nil {
+		return err
+	}
+
+	var files []string
+	for name := range objects {
+		file := path.Base(name)
+		if file == manifestFile || strings.HasSuffix(file, partialSuffix) {
+			continue
+		}
+		if strings.HasSuffix(file, indexSuffix) {
+			if err := r.replicateChunks(ctx, filepath.Join(b.Path, file)); err != nil {
+				return err
+			}
+		}
+		files = append(files, name)
+	}
+	sort.Strings(files)
+	files = append(files, objectName(b.Name, manifestFile))
+
+	for _, name := range files {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := r.copy(ctx, name, sums[path.Base(name)]); err != nil {
+			return err
+		}
+	}
+	log.Infof("Replicated %s to %s", b.Name, r.target)
+	return nil
+}
+
+// replicateChunks copies the chunks an index refers to that the target doesn't have
+func (r *replicator) replicateChunks(ctx context.Context, index_path string) error {
+	if r.chunks == nil {
+		objects, err := r.target.List(ctx, chunkDir+"/")
+		if err != nil {
+			return err
+		}
+		r.chunks = make(map[string]bool)
+		for name := range objects {
+			r.chunks[plainName(path.Base(name))] = true
+		}
+	}
+
+	index, err := readIndex(index_path)
+	if err != nil {
+		return err
+	}
+	for _, chunk := range index.Chunks {
+		if r.chunks[chunk.Hash] {
+			continue
+		}
+		chunk_path, ok := findChunk(BackupConfig.Backup_root, chunk.Hash)
+		if !ok {
+			return fmt.Errorf("Chunk %s of %s is missing", chunk.Hash, index_path)
+		}
+		name, err := filepath.Rel(BackupConfig.Backup_root, chunk_path)
+		if err != nil {
+			return err
+		}
+		if err := r.copy(ctx, filepath.ToSlash(name), ""); err != nil {
+			return err
+		}
+		r.chunks[chunk.Hash] = true
+	}
+	return nil
+}
+
+// copy copies a file from the storage to the target and reads it back to
+// check that it arrived intact. The file must also match its checksum in the
+// manifest, if it has one.
+func (r *replicator) copy(ctx context.Context, name, checksum string) error {
+	in, err := storage.Open(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := r.target.Create(ctx, name)
+	if err != nil {
+		return err
+	}
+	sum := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, sum), in); err != nil {
+		out.Abort()
+		return err
+	}
+	sent := hex.EncodeToString(sum.Sum(nil))
+	if checksum != "" && sent != checksum {
+		out.Abort()
+		return fmt.Errorf("%s does not match the manifest", name)
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	f, err := r.target.Open(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	arrived, err := hashReader(ctx, f)
+	if err != nil {
+		return err
+	}
+	if arrived != sent {
+		return fmt.Errorf("Copy of %s in %s does not match its checksum", name, r.target)
+	}
+	return nil
+}
+
+// plan applies the retention policy of the target to backups, newest first.
+// Returns nil when the target has no policy and keeps all backups.
+func (r *replicator) plan(backups []StoredBackup) ([]pruneDecision, error) {
+	policy := BackupConfig.Replication.Retention
+	if !policy.hasRules() && policy.Max_total_size == "" {
+		return nil, nil
+	}
+	vm_policy := policy
+	vm_policy.Max_total_size = ""
+	return planRetention(backups, func(string) RetentionPolicy { return vm_policy }, policy.Max_total_size)
+}
+
+// prune deletes the backups at the target its retention policy doesn't keep,
+// then the chunks the remaining backups don't refer to
+func (r *replicator) prune(ctx context.Context, backups []StoredBackup, dryrun bool) error {
+	decisions, err := r.plan(backups)
+	if err != nil || decisions == nil {
+		return err
+	}
+
+	freed := printDecisions(decisions)
+	if dryrun {
+		log.Infof("Dry run, would free %s in %s", formatBytes(freed), r.target)
+		return nil
+	}
+
+	deleted := false
+	for _, d := range decisions {
+		if d.Keep {
+			continue
+		}
+		log.Infof("Deleting backup %s from %s", d.Backup.Name, r.target)
+		if err := r.target.RemoveAll(ctx, d.Backup.Name+"/"); err != nil {
+			return err
+		}
+		deleted = true
+	}
+	if deleted {
+		return r.gc(ctx)
+	}
+	return nil
+}
+
+// gc deletes the chunks at the target that no index there refers to
+func (r *replicator) gc(ctx context.Context) error {
+	objects, err := r.target.List(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	referenced := make(map[string]bool)
+	for name := range objects {
+		if !strings.HasSuffix(name, indexSuffix) || strings.HasPrefix(name, chunkDir+"/") {
+			continue
+		}
+		f, err := r.target.Open(ctx, name)
+		if err != nil {
+			return err
+		}
+		index, err := parseIndex(name, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		for _, chunk := range index.Chunks {
+			referenced[chunk.Hash] = true
+		}
+	}
+
+	var count, freed int64
+	for name, size := range objects {
+		if !strings.HasPrefix(name, chunkDir+"/") || referenced[plainName(path.Base(name))] {
+			continue
+		}
+		if err := r.target.RemoveAll(ctx, name); err != nil {
+			return err
+		}
+		count++
+		freed += size
+	}
+	if count > 0 {
+		log.Infof("Deleted %d unreferenced chunks from %s, freed %s", count, r.target, formatBytes(freed))
+	}
+	return nil
+}
+
+func runReplicate(args []string) {
+	fs := flag.NewFlagSet("replicate", flag.ExitOnError)
+	dryrun := fs.Bool("dry-run", *planonly, "Only list the backups that would be replicated and deleted")
+	fs.Parse(args)
+
+	//A backup being written would be copied half done
+	lock := lockBackupRoot()
+	defer lock.Release()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := replicate(ctx, *dryrun); err != nil {
+		log.Fatalf("Replication failed: %s", err)
+	}
+}
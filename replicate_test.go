@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/loginoff/nutanix-backup/nutanixapi/prismtest"
+)
+
+// replicationTargets are the storages backups are replicated to in the
+// tests, by the directory the target keeps them in
+var replicationTargets = []struct {
+	name   string
+	config func(t *testing.T, dir string) StorageConfig
+}{
+	{name: "local", config: func(t *testing.T, dir string) StorageConfig {
+		return StorageConfig{Type: storageLocal, Path: dir}
+	}},
+	{name: "ssh", config: func(t *testing.T, dir string) StorageConfig {
+		server := newSFTPServer(t)
+		return StorageConfig{
+			Type:     "ssh",
+			Host:     net.JoinHostPort(server.host(), strconv.Itoa(server.port())),
+			User:     testSSHUser,
+			Password: testSSHPassword,
+			Path:     dir,
+		}
+	}},
+}
+
+func backupDay(day int) time.Time {
+	return time.Date(2024, 1, day, 10, 0, 0, 0, time.Local)
+}
+
+// sameFiles checks that the files of the local backup are at the target
+func sameFiles(t *testing.T, backup_path, target string) {
+	t.Helper()
+	files, err := ioutil.ReadDir(backup_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		want, err := ioutil.ReadFile(filepath.Join(backup_path, f.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadFile(filepath.Join(target, filepath.Base(backup_path), f.Name()))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s/%s differs at the target (%v)", filepath.Base(backup_path), f.Name(), err)
+		}
+	}
+}
+
+// chunksAt counts the chunks of a deduplicated backup the target has and lacks
+func chunksAt(t *testing.T, backup_path, target string) (present, missing int) {
+	t.Helper()
+	index, err := readIndex(filepath.Join(backup_path, "scsi.0"+indexSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chunk := range index.Chunks {
+		if _, ok := findChunk(target, chunk.Hash); ok {
+			present++
+		} else {
+			missing++
+		}
+	}
+	return present, missing
+}
+
+func TestReplicate(t *testing.T) {
+	for _, target := range replicationTargets {
+		t.Run(target.name, func(t *testing.T) {
+			e := setupE2E(t)
+			dedup := true
+			e.prism.AddVM("web1", "", prismtest.Disk{Bus: "scsi", Index: 0, ContainerUUID: testContainer, Data: testDisk(1, 256*1024)})
+			e.prism.AddVM("db1", "", prismtest.Disk{Bus: "scsi", Index: 0, ContainerUUID: testContainer, Data: randomData(13, 3*1024*1024)})
+			web1 := []string{
+				e.backupAt(t, VMBackup{Name: "web1"}, backupDay(15)),
+				e.backupAt(t, VMBackup{Name: "web1"}, backupDay(16)),
+			}
+			db1 := e.backupAt(t, VMBackup{Name: "db1", Dedup: &dedup}, backupDay(15))
+			containers.Release()
+
+			dir := t.TempDir()
+			BackupConfig.Replication.Target = target.config(t, dir)
+			if err := replicate(context.Background(), false); err != nil {
+				t.Fatal(err)
+			}
+			for _, b := range append(web1, db1) {
+				sameFiles(t, b, dir)
+			}
+			if _, missing := chunksAt(t, db1, dir); missing != 0 {
+				t.Fatalf("%d chunks of %s not replicated", missing, filepath.Base(db1))
+			}
+
+			//Complete backups at the target are left alone, a copy an
+			//earlier run didn't finish is copied again
+			replaced := []byte("not copied again")
+			if err := ioutil.WriteFile(filepath.Join(dir, filepath.Base(web1[0]), "ahv_vm"), replaced, 0640); err != nil {
+				t.Fatal(err)
+			}
+			unfinished := filepath.Join(dir, filepath.Base(web1[1]))
+			if err := os.Remove(filepath.Join(unfinished, manifestFile)); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(unfinished, "scsi.0"), []byte("partial"), 0640); err != nil {
+				t.Fatal(err)
+			}
+			web1 = append(web1, e.backupAt(t, VMBackup{Name: "web1"}, backupDay(17)))
+			containers.Release()
+
+			if err := replicate(context.Background(), false); err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := ioutil.ReadFile(filepath.Join(dir, filepath.Base(web1[0]), "ahv_vm")); !bytes.Equal(got, replaced) {
+				t.Error("complete backup at the target copied again")
+			}
+			sameFiles(t, web1[1], dir)
+			sameFiles(t, web1[2], dir)
+		})
+	}
+}
+
+// corruptingStorage flips a bit in the first write to every object
+type corruptingStorage struct {
+	Storage
+}
+
+type corruptingWriter struct {
+	ObjectWriter
+	written bool
+}
+
+func (s corruptingStorage) Create(ctx context.Context, name string) (ObjectWriter, error) {
+	w, err := s.Storage.Create(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &corruptingWriter{ObjectWriter: w}, nil
+}
+
+func (w *corruptingWriter) Write(p []byte) (int, error) {
+	if w.written || len(p) == 0 {
+		return w.ObjectWriter.Write(p)
+	}
+	w.written = true
+	corrupt := append([]byte(nil), p...)
+	corrupt[0] ^= 1
+	return w.ObjectWriter.Write(corrupt)
+}
+
+func TestReplicateVerifies(t *testing.T) {
+	tests := []struct {
+		name string
+		//The target corrupts what it stores
+		corrupt bool
+		//The local image no longer matches the manifest
+		modified bool
+		want     string
+	}{
+		{name: "read back differs", corrupt: true, want: "does not match its checksum"},
+		{name: "local image modified", modified: true, want: "does not match the manifest"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := setupE2E(t)
+			e.prism.AddVM("web1", "", prismtest.Disk{Bus: "scsi", Index: 0, ContainerUUID: testContainer, Data: testDisk(1, 256*1024)})
+			backup_path := e.backupAt(t, VMBackup{Name: "web1"}, backupDay(15))
+			containers.Release()
+			if test.modified {
+				if err := ioutil.WriteFile(filepath.Join(backup_path, "scsi.0"), testDisk(2, 256*1024), 0640); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			dir := t.TempDir()
+			var target Storage = &LocalStorage{root: dir}
+			if test.corrupt {
+				target = corruptingStorage{target}
+			}
+			backups, err := listBackups(BackupConfig.Backup_root)
+			if err != nil || len(backups) != 1 {
+				t.Fatalf("%d backups (%v)", len(backups), err)
+			}
+			r := &replicator{target: target}
+			err = r.replicateBackup(context.Background(), backups[0])
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("got error %v, want %q", err, test.want)
+			}
+			//Without the manifest the copy is incomplete, and copied again by the next run
+			if _, err := os.Stat(filepath.Join(dir, backups[0].Name, manifestFile)); !os.IsNotExist(err) {
+				t.Error("manifest copied after a failed file")
+			}
+		})
+	}
+}
+
+func TestReplicateRetention(t *testing.T) {
+	for _, target := range replicationTargets {
+		t.Run(target.name, func(t *testing.T) {
+			e := setupE2E(t)
+			dedup := true
+			data := randomData(14, 3*1024*1024)
+			e.prism.AddVM("web1", "", prismtest.Disk{Bus: "scsi", Index: 0, ContainerUUID: testContainer, Data: testDisk(1, 256*1024)})
+			e.prism.AddVM("db1", "", prismtest.Disk{Bus: "scsi", Index: 0, ContainerUUID: testContainer, Data: data})
+			old_web1 := e.backupAt(t, VMBackup{Name: "web1"}, backupDay(15))
+			old_db1 := e.backupAt(t, VMBackup{Name: "db1", Dedup: &dedup}, backupDay(15))
+			containers.Release()
+
+			dir := t.TempDir()
+			BackupConfig.Replication.Target = target.config(t, dir)
+			if err := replicate(context.Background(), false); err != nil {
+				t.Fatal(err)
+			}
+
+			//The disk of db1 is rewritten, its chunks all change
+			copy(data, randomData(15, len(data)))
+			new_web1 := e.backupAt(t, VMBackup{Name: "web1"}, backupDay(16))
+			new_db1 := e.backupAt(t, VMBackup{Name: "db1", Dedup: &dedup}, backupDay(16))
+			//Never makes it to the target, the policy there would delete it right away
+			skipped := e.backupAt(t, VMBackup{Name: "web1"}, backupDay(14))
+			containers.Release()
+
+			BackupConfig.Replication.Retention = RetentionPolicy{Keep_last: 1}
+			if err := replicate(context.Background(), false); err != nil {
+				t.Fatal(err)
+			}
+			for _, b := range []string{old_web1, old_db1, skipped} {
+				if _, err := os.Stat(filepath.Join(dir, filepath.Base(b))); !os.IsNotExist(err) {
+					t.Errorf("%s at the target, the policy keeps the last backup", filepath.Base(b))
+				}
+			}
+			sameFiles(t, new_web1, dir)
+			sameFiles(t, new_db1, dir)
+			if _, missing := chunksAt(t, new_db1, dir); missing != 0 {
+				t.Errorf("%d chunks of %s missing at the target", missing, filepath.Base(new_db1))
+			}
+			if present, _ := chunksAt(t, old_db1, dir); present != 0 {
+				t.Errorf("%d chunks of the deleted %s left at the target", present, filepath.Base(old_db1))
+			}
+			//Only the target is pruned
+			if _, err := os.Stat(old_web1); err != nil {
+				t.Error("local backup pruned by the replication")
+			}
+		})
+	}
+}
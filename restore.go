@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/loginoff/nutanix-backup/nutanixapi"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Directory on the Nutanix container where disk images are copied to
+// before the new VM disks are cloned from them
+const restoreStagingDir = "nutanix_backup_restore"
+
+func runRestore(ntnx *nutanixapi.Client, args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	name := fs.String("name", "", "Name of the restored VM (default: name of the backed up VM)")
+	container := fs.String("container", "", "UUID of the container to stage disk images on (default: container of the original disks)")
+	new_macs := fs.Bool("new-mac", false, "Let the cluster assign new MAC addresses to the NICs, eg. to restore next to the original VM")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		log.Fatal("Specify exactly one backup directory to restore")
+	}
+
+	backup_path := fs.Arg(0)
+	if !filepath.IsAbs(backup_path) {
+		backup_path = filepath.Join(BackupConfig.Backup_root, backup_path)
+	}
+	//Backups in remote storage can be restored on a host that doesn't have their metadata
+	if !IsDir(backup_path) && remoteStorage() {
+		log.Infof("Fetching the metadata of %s from %s", filepath.Base(backup_path), storage)
+		if err := fetchMetadata(context.Background(), filepath.Base(backup_path)); err != nil {
+			log.Fatalf("Unable to fetch %s: %s", filepath.Base(backup_path), err)
+		}
+	}
+	if !IsDir(backup_path) {
+		log.Fatalf("%s is not a backup directory", backup_path)
+	}
+
+	snapshot_info, err := ReadSnapshotInfo(filepath.Join(backup_path, "ahv_vm"))
+	if err != nil {
+		log.Fatalf("Unable to read VM info from %s: %s", backup_path, err)
+	}
+
+	vmname := snapshot_info.VMCreateSpecification.Name
+	if *name != "" {
+		vmname = *name
+	}
+
+	allvms, err := ntnx.GetVMs()
+	if err != nil {
+		log.Fatalf("Unable to retrieve VM list from PRISM %s", err)
+	}
+	for _, nvm := range allvms {
+		if nvm.Config.Name == vmname {
+			log.Fatalf("A VM named %s already exists, use -name to restore under a different name", vmname)
+		}
+		if nvm.UUID == snapshot_info.VMUUID && !*new_macs && len(snapshot_info.VMCreateSpecification.VMNics) > 0 {
+			log.Warnf("%s still exists and the restored VM gets the same MAC addresses, use -new-mac to restore next to it", nvm.Config.Name)
+		}
+	}
+
+	if !askForConfirmation(fmt.Sprintf("Restore %s as a new VM named %s?\n", filepath.Base(backup_path), vmname)) {
+		log.Info("User cancelled restore")
+		os.Exit(1)
+	}
+
+	containers, err = newContainerAccess(ntnx, true)
+	if err != nil {
+		log.Fatalf("Unable to access the containers: %s", err)
+	}
+
+	err = RestoreVM(ntnx, snapshot_info, backup_path, vmname, *container, *new_macs)
+	if release_err := containers.Release(); release_err != nil {
+		log.Error(release_err)
+	}
+	if err != nil {
+		log.Fatalf("Failed to restore VM %s: %s", vmname, err)
+	}
+}
+
+// RestoreVM creates a VM named vmname from a backup. The NICs keep their MAC
+// addresses unless new_macs is set, so the guest finds the same interfaces.
+func RestoreVM(ntnx *nutanixapi.Client, snapshot_info *nutanixapi.AHVSnapshotInfo, backup_path, vmname, container_UUID string, new_macs bool) error {
+	vmspec := snapshot_info.VMCreateSpecification
+	log.Infof("Restoring %s (%s) as %s", vmspec.Name, filepath.Base(backup_path), vmname)
+
+	spec := nutanixapi.AHVVMCreateSpec{
+		Name:            vmname,
+		Description:     vmspec.Description,
+		NumVcpus:        vmspec.NumVcpus,
+		NumCoresPerVcpu: vmspec.NumCoresPerVcpu,
+		MemoryMb:        vmspec.MemoryMb,
+	}
+
+	//Staging directories created on the containers, to be removed after the VM is created
+	staging_dirs := make(map[string]bool)
+	staging_name := path.Join(restoreStagingDir, filepath.Base(backup_path))
+
+	for _, vdisk := range vmspec.VMDisks {
+		disk := fmt.Sprintf("%s.%d", vdisk.DiskAddress.DeviceBus, vdisk.DiskAddress.DeviceIndex)
+		image_path, stored := storedImage(backup_path, disk)
+		if remoteStorage() {
+			image_path, stored = storedObject(context.Background(), filepath.Base(backup_path), disk)
+		}
+		chained := chainedDisk(backup_path, disk)
+		index_path := filepath.Join(backup_path, disk+indexSuffix)
+		indexed := exists(index_path)
+		if !stored && !chained && !indexed {
+			log.Infof("No image for disk %s in %s, skipping", disk, backup_path)
+			continue
+		}
+
+		disk_container := vdisk.VMDiskClone.ContainerUUID
+		if container_UUID != "" {
+			disk_container = container_UUID
+		}
+		if disk_container == "" {
+			return fmt.Errorf("Unable to determine a container for disk %s, specify one with -container", disk)
+		}
+
+		container_root, err := containers.Root(disk_container)
+		if err != nil {
+			return err
+		}
+
+		staging_path := filepath.Join(container_root, staging_name)
+		if err := Mkdir(staging_path); err != nil {
+			return err
+		}
+		staging_dirs[staging_path] = true
+
+		if indexed {
+			log.Infof("Assembling %s from the repository into %s", disk, staging_path)
+			if err := assembleImage(context.Background(), index_path, filepath.Join(staging_path, disk)); err != nil {
+				return err
+			}
+		} else if chained {
+			if err := materializeImage(context.Background(), backup_path, disk, filepath.Join(staging_path, disk)); err != nil {
+				return err
+			}
+		} else if remoteStorage() {
+			if err := extractObject(context.Background(), image_path, filepath.Join(staging_path, disk)); err != nil {
+				return err
+			}
+		} else {
+			log.Infof("Copying %s to %s", image_path, staging_path)
+			if err := extractImage(context.Background(), image_path, filepath.Join(staging_path, disk)); err != nil {
+				return err
+			}
+		}
+
+		var diskspec nutanixapi.AHVVMDiskCreateSpec
+		diskspec.DiskAddress.DeviceBus = vdisk.DiskAddress.DeviceBus
+		diskspec.DiskAddress.DeviceIndex = vdisk.DiskAddress.DeviceIndex
+		diskspec.VMDiskClone.NdfsFilepath = "/" + path.Join(filepath.Base(container_root), staging_name, disk)
+		spec.VMDisks = append(spec.VMDisks, diskspec)
+	}
+
+	if len(spec.VMDisks) < 1 {
+		return fmt.Errorf("No disk images found in %s", backup_path)
+	}
+
+	for _, nic := range vmspec.VMNics {
+		nicspec := nutanixapi.AHVVMNicSpec{NetworkUUID: nic.NetworkUUID, MacAddress: nic.MacAddress}
+		if new_macs {
+			nicspec.MacAddress = ""
+		}
+		spec.VMNics = append(spec.VMNics, nicspec)
+	}
+
+	log.Infof("Creating VM %s with %d disks", vmname, len(spec.VMDisks))
+	taskUUID, err := ntnx.CreateVM(spec)
+	if err != nil {
+		return err
+	}
+	if _, err := ntnx.PollTaskForCompletion(context.Background(), taskUUID); err != nil {
+		log.Warningf("VM creation failed, staged images were left in place for inspection")
+		return err
+	}
+	log.Infof("Created VM %s", vmname)
+
+	//The VM disks are now clones, the staged images are no longer needed
+	for staging_path := range staging_dirs {
+		log.Infof("Removing staged images in %s", staging_path)
+		if err := os.RemoveAll(staging_path); err != nil {
+			log.Warningf("Unable to remove %s: %s", staging_path, err)
+		}
+	}
+
+	return nil
+}
+
+func ReadSnapshotInfo(path string) (*nutanixapi.AHVSnapshotInfo, error) {
+	f, err := openStored(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var spec nutanixapi.AHVSnapshotInfo
+	err = json.NewDecoder(f).Decode(&spec)
+	return &spec, err
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/loginoff/nutanix-backup/nutanixapi/prismtest"
+)
+
+func TestRestoreVM(t *testing.T) {
+	dedup := true
+	tests := []struct {
+		name     string
+		entry    VMBackup
+		new_macs bool
+		//Creating the VM fails
+		fail bool
+	}{
+		{name: "raw", entry: VMBackup{Name: "web1"}},
+		{name: "new MAC addresses", entry: VMBackup{Name: "web1"}, new_macs: true},
+		{name: "compressed", entry: VMBackup{Name: "web1", Compression: compressionZstd}},
+		{name: "deduplicated", entry: VMBackup{Name: "web1", Dedup: &dedup}},
+		{name: "creation fails", entry: VMBackup{Name: "web1"}, fail: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := setupE2E(t)
+			root := testDisk(1, 2*1024*1024)
+			data := testDisk(9, 1024*1024)
+			uuid := e.prism.AddVM("web1", "frontend",
+				prismtest.Disk{Bus: "scsi", Index: 0, ContainerUUID: testContainer, Data: root},
+				prismtest.Disk{Bus: "scsi", Index: 1, ContainerUUID: testContainer, Data: data},
+			)
+			nics := []prismtest.NIC{
+				{NetworkUUID: "net-prod", MacAddress: "50:6b:8d:00:00:01"},
+				{NetworkUUID: "net-backup", MacAddress: "50:6b:8d:00:00:02"},
+			}
+			e.prism.AddNICs(uuid, nics...)
+
+			vms := e.resolve(t, test.entry)
+			var result BackupResult
+			if err := BackupVM(context.Background(), e.ntnx, &vms[0], &result); err != nil {
+				t.Fatal(err)
+			}
+			backup_path := filepath.Join(BackupConfig.Backup_root, result.Snapshot)
+			snapshot_info, err := ReadSnapshotInfo(filepath.Join(backup_path, "ahv_vm"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.fail {
+				e.prism.FailTask(prismtest.OpVMCreate, "out of memory")
+			}
+			err = RestoreVM(e.ntnx, snapshot_info, backup_path, "web1-restored", "", test.new_macs)
+			containers.Release()
+			staging := filepath.Join(e.container, restoreStagingDir, result.Snapshot)
+			if test.fail {
+				if err == nil {
+					t.Fatal("restore succeeded without creating the VM")
+				}
+				//Left for inspection
+				for disk, want := range map[string][]byte{"scsi.0": root, "scsi.1": data} {
+					got, err := ioutil.ReadFile(filepath.Join(staging, disk))
+					if err != nil || !bytes.Equal(got, want) {
+						t.Errorf("staged image %s differs from the vdisk (%v)", disk, err)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			created := e.prism.CreatedVMs()
+			if len(created) != 1 {
+				t.Fatalf("%d VMs created, want 1", len(created))
+			}
+			spec := created[0]
+			if spec.Name != "web1-restored" || spec.Description != "frontend" || spec.NumVcpus != 1 || spec.MemoryMb != 1024 {
+				t.Errorf("created %+v", spec)
+			}
+			if len(spec.VMDisks) != 2 {
+				t.Fatalf("created with %d disks, want 2", len(spec.VMDisks))
+			}
+			for i, disk := range spec.VMDisks {
+				want := fmt.Sprintf("/ctr1/%s/%s/scsi.%d", restoreStagingDir, result.Snapshot, i)
+				if disk.DiskAddress.DeviceBus != "scsi" || disk.DiskAddress.DeviceIndex != i || disk.VMDiskClone.NdfsFilepath != want {
+					t.Errorf("disk %d cloned from %s at %s.%d, want %s", i, disk.VMDiskClone.NdfsFilepath, disk.DiskAddress.DeviceBus, disk.DiskAddress.DeviceIndex, want)
+				}
+			}
+			if len(spec.VMNics) != len(nics) {
+				t.Fatalf("created with %d NICs, want %d", len(spec.VMNics), len(nics))
+			}
+			for i, nic := range spec.VMNics {
+				want := nics[i].MacAddress
+				if test.new_macs {
+					want = ""
+				}
+				if nic.NetworkUUID != nics[i].NetworkUUID || nic.MacAddress != want {
+					t.Errorf("NIC %d on %s with MAC %q, want %s with %q", i, nic.NetworkUUID, nic.MacAddress, nics[i].NetworkUUID, want)
+				}
+			}
+			if _, err := os.Stat(staging); !os.IsNotExist(err) {
+				t.Errorf("staged images left behind in %s", staging)
+			}
+		})
+	}
+}
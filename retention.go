@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// RetentionPolicy decides which backups of a VM are kept. A backup is kept
+// when any of the rules selects it. Without any rules all backups are kept.
+type RetentionPolicy struct {
+	Keep_last    int
+	Keep_daily   int
+	Keep_weekly  int
+	Keep_monthly int
+	//Maximum disk space used by the backups, eg. 500G or 2T
+	Max_total_size string
+}
+
+func (p RetentionPolicy) hasRules() bool {
+	return p.Keep_last > 0 || p.Keep_daily > 0 || p.Keep_weekly > 0 || p.Keep_monthly > 0
+}
+
+// StoredBackup is a backup directory in backup_root, named by getSnapshotName
+type StoredBackup struct {
+	Name string
+	VM   string
+	Time time.Time
+	Path string
+	Size int64
+	//Complete backups are in the catalog as good or, if they aren't in it, have
+	//their manifest, which is written last. And no partially copied images.
+	Complete bool
+	//Backup an incremental backup is based on
+	Base string
+}
+
+type pruneDecision struct {
+	Backup  StoredBackup
+	Keep    bool
+	Reasons []string
+}
+
+const snapshotTimeFormat = "20060102_1504"
+
+// parseBackupName splits a backup directory name into the VM name and backup time
+func parseBackupName(name string) (vm string, t time.Time, ok bool) {
+	idx := strings.LastIndex(name, "_backup_")
+	if idx < 1 {
+		return "", t, false
+	}
+	t, err := time.ParseInLocation(snapshotTimeFormat, name[idx+len("_backup_"):], time.Local)
+	if err != nil {
+		return "", t, false
+	}
+	return name[:idx], t, true
+}
+
+// listBackups returns the backups in root, newest first
+func listBackups(root string) ([]StoredBackup, error) {
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+
+	//Size of the objects of each backup in remote storage, and the backups
+	//whose manifest, which is uploaded last, is there
+	remote_sizes := make(map[string]int64)
+	uploaded := make(map[string]bool)
+	if remoteStorage() {
+		objects, err := storage.List(context.Background(), "")
+		if err != nil {
+			return nil, err
+		}
+		for name, size := range objects {
+			backup, file := path.Split(name)
+			backup = strings.TrimSuffix(backup, "/")
+			remote_sizes[backup] += size
+			if file == manifestFile {
+				uploaded[backup] = true
+			}
+		}
+	}
+
+	var backups []StoredBackup
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		vm, t, ok := parseBackupName(entry.Name())
+		if !ok {
+			continue
+		}
+
+		b := StoredBackup{
+			Name: entry.Name(),
+			VM:   vm,
+			Time: t,
+			Path: filepath.Join(root, entry.Name()),
+		}
+		//ahv_vm is written before the disks are copied, failed backups have it
+		//too. Backups are added to the catalog once they are complete.
+		if entry, ok := catalog.Get(b.Name); ok {
+			b.Complete = entry.Status == statusOK
+		} else {
+			b.Complete = exists(filepath.Join(b.Path, manifestFile))
+		}
+		if chain, err := readChain(b.Path); err == nil {
+			b.Base = chain.Base
+		}
+
+		files, err := ioutil.ReadDir(b.Path)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			b.Size += allocatedSize(f)
+			if strings.HasSuffix(f.Name(), partialSuffix) {
+				b.Complete = false
+			}
+		}
+		if remoteStorage() {
+			b.Complete = b.Complete && uploaded[b.Name]
+			b.Size += remote_sizes[b.Name]
+		}
+		backups = append(backups, b)
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Time.After(backups[j].Time)
+	})
+	return backups, nil
+}
+
+// retentionPolicyFor returns the policy configured for the VM, or the global one
+func retentionPolicyFor(vm, description string) RetentionPolicy {
+	if v, ok := vmConfigFor(vm, description); ok && v.Retention != nil {
+		return *v.Retention
+	}
+	return BackupConfig.Retention
+}
+
+// applyRetention decides which of the backups of a single VM, newest first, are kept
+func applyRetention(backups []StoredBackup, policy RetentionPolicy) []pruneDecision {
+	decisions := make([]pruneDecision, len(backups))
+	for i, b := range backups {
+		decisions[i].Backup = b
+	}
+
+	if !policy.hasRules() {
+		for i := range decisions {
+			decisions[i].Keep = true
+			decisions[i].Reasons = []string{"no retention rules"}
+		}
+		return decisions
+	}
+
+	keepPeriods := func(reason string, count int, period func(time.Time) string) {
+		seen := make(map[string]bool)
+		for i := range decisions {
+			if len(seen) >= count {
+				return
+			}
+			b := decisions[i].Backup
+			if !b.Complete {
+				continue
+			}
+			key := period(b.Time)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			decisions[i].Keep = true
+			decisions[i].Reasons = append(decisions[i].Reasons, reason)
+		}
+	}
+
+	keepPeriods("last", policy.Keep_last, func(t time.Time) string {
+		return t.Format(snapshotTimeFormat)
+	})
+	keepPeriods("daily", policy.Keep_daily, func(t time.Time) string {
+		return t.Format("2006-01-02")
+	})
+	keepPeriods("weekly", policy.Keep_weekly, func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-%d", year, week)
+	})
+	keepPeriods("monthly", policy.Keep_monthly, func(t time.Time) string {
+		return t.Format("2006-01")
+	})
+
+	for i := range decisions {
+		if !decisions[i].Keep && !decisions[i].Backup.Complete {
+			decisions[i].Reasons = []string{"incomplete"}
+		}
+	}
+	return decisions
+}
+
+// enforceMaxSize drops the oldest kept backups until the kept ones fit into max bytes.
+// The newest complete backup of every VM is always kept.
+func enforceMaxSize(decisions []pruneDecision, max int64) {
+	newest := make(map[string]int)
+	var total int64
+	for i, d := range decisions {
+		if !d.Keep {
+			continue
+		}
+		total += d.Backup.Size
+		if j, ok := newest[d.Backup.VM]; d.Backup.Complete && (!ok || d.Backup.Time.After(decisions[j].Backup.Time)) {
+			newest[d.Backup.VM] = i
+		}
+	}
+
+	for total > max {
+		oldest := -1
+		for i, d := range decisions {
+			if j, ok := newest[d.Backup.VM]; !d.Keep || (ok && j == i) {
+				continue
+			}
+			if oldest < 0 || d.Backup.Time.Before(decisions[oldest].Backup.Time) {
+				oldest = i
+			}
+		}
+		if oldest < 0 {
+			log.Warnf("Unable to fit backups into %s without deleting the latest backup of a VM", formatBytes(max))
+			return
+		}
+		decisions[oldest].Keep = false
+		decisions[oldest].Reasons = []string{"over size limit"}
+		total -= decisions[oldest].Backup.Size
+	}
+}
+
+// planPrune applies the configured retention policies to all backups in backup_root
+func planPrune() ([]pruneDecision, error) {
+	backups, err := listBackups(BackupConfig.Backup_root)
+	if err != nil {
+		return nil, err
+	}
+	//Selectors may need the description of the VM, which is in the VM info of its latest backup
+	descriptions := make(map[string]string)
+	for _, b := range backups {
+		if _, ok := descriptions[b.VM]; ok || !b.Complete {
+			continue
+		}
+		if info, err := ReadSnapshotInfo(filepath.Join(b.Path, "ahv_vm")); err == nil {
+			descriptions[b.VM] = info.VMCreateSpecification.Description
+		}
+	}
+	policyFor := func(vm string) RetentionPolicy {
+		return retentionPolicyFor(vm, descriptions[vm])
+	}
+	return planRetention(backups, policyFor, BackupConfig.Retention.Max_total_size)
+}
+
+// planRetention applies the policy of every VM to its backups, and limits the
+// size of all kept backups to max_total_size if it is set
+func planRetention(backups []StoredBackup, policyFor func(vm string) RetentionPolicy, max_total_size string) ([]pruneDecision, error) {
+	byVM := make(map[string][]StoredBackup)
+	var vms []string
+	for _, b := range backups {
+		if _, ok := byVM[b.VM]; !ok {
+			vms = append(vms, b.VM)
+		}
+		byVM[b.VM] = append(byVM[b.VM], b)
+	}
+	sort.Strings(vms)
+
+	var decisions []pruneDecision
+	for _, vm := range vms {
+		policy := policyFor(vm)
+		vm_decisions := applyRetention(byVM[vm], policy)
+		if policy.Max_total_size != "" {
+			max, err := parseSize(policy.Max_total_size, 1)
+			if err != nil {
+				return nil, err
+			}
+			enforceMaxSize(vm_decisions, max)
+		}
+		decisions = append(decisions, vm_decisions...)
+	}
+
+	if max_total_size != "" {
+		max, err := parseSize(max_total_size, 1)
+		if err != nil {
+			return nil, err
+		}
+		enforceMaxSize(decisions, max)
+	}
+	keepChainBases(decisions)
+	return decisions, nil
+}
+
+// keepChainBases keeps the backups that kept incremental backups are based on,
+// they are needed to restore them. Decisions are ordered newest first, so the
+// bases of a whole chain are kept in a single pass.
+func keepChainBases(decisions []pruneDecision) {
+	byName := make(map[string]int)
+	for i, d := range decisions {
+		byName[d.Backup.Name] = i
+	}
+
+	for i := range decisions {
+		base := decisions[i].Backup.Base
+		if !decisions[i].Keep || base == "" {
+			continue
+		}
+		j, ok := byName[base]
+		if !ok {
+			log.Warnf("Base %s of incremental backup %s is missing", base, decisions[i].Backup.Name)
+			continue
+		}
+		if !decisions[j].Keep {
+			decisions[j].Keep = true
+			decisions[j].Reasons = nil
+		}
+		decisions[j].Reasons = append(decisions[j].Reasons, "base of "+decisions[i].Backup.Name)
+	}
+}
+
+// printDecisions prints what happens to every backup and returns the size of
+// the backups that are deleted
+func printDecisions(decisions []pruneDecision) int64 {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "BACKUP\tSIZE\tACTION\tREASON")
+	var freed int64
+	for _, d := range decisions {
+		action := "keep"
+		if !d.Keep {
+			action = "delete"
+			freed += d.Backup.Size
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", d.Backup.Name, formatBytes(d.Backup.Size), action, strings.Join(d.Reasons, ","))
+	}
+	w.Flush()
+	return freed
+}
+
+// prune deletes the backups the retention policies don't keep. The caller must
+// hold the lock, the backup in progress would be deleted as incomplete.
+func prune(dryrun bool) error {
+	decisions, err := planPrune()
+	if err != nil {
+		return err
+	}
+
+	freed := printDecisions(decisions)
+	if dryrun {
+		log.Infof("Dry run, would free %s", formatBytes(freed))
+		return nil
+	}
+
+	for _, d := range decisions {
+		if d.Keep {
+			continue
+		}
+		log.Infof("Deleting backup %s", d.Backup.Path)
+		if remoteStorage() {
+			if err := storage.RemoveAll(context.Background(), d.Backup.Name+"/"); err != nil {
+				return err
+			}
+		}
+		if err := os.RemoveAll(d.Backup.Path); err != nil {
+			return err
+		}
+		if err := catalog.Remove(d.Backup.Name); err != nil {
+			return err
+		}
+	}
+	log.Infof("Pruning freed %s", formatBytes(freed))
+	return nil
+}
+
+func runPrune(args []string) {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	dryrun := fs.Bool("dry-run", *planonly, "Only list the backups that would be deleted")
+	fs.Parse(args)
+
+	if !BackupConfig.Retention.hasRules() && BackupConfig.Retention.Max_total_size == "" {
+		log.Warn("No global retention policy configured, only per VM policies are applied")
+	}
+
+	lock := lockBackupRoot()
+	defer lock.Release()
+
+	if err := prune(*dryrun); err != nil {
+		log.Fatalf("Pruning failed: %s", err)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testBackup returns a complete backup of vm taken at when, eg. 20240115_1000
+func testBackup(vm, when string, size int64) StoredBackup {
+	t, err := time.ParseInLocation(snapshotTimeFormat, when, time.Local)
+	if err != nil {
+		panic(err)
+	}
+	name := vm + "_backup_" + when
+	return StoredBackup{Name: name, VM: vm, Time: t, Path: "/backup/" + name, Size: size, Complete: true}
+}
+
+func incomplete(b StoredBackup) StoredBackup {
+	b.Complete = false
+	return b
+}
+
+func basedOn(b StoredBackup, base StoredBackup) StoredBackup {
+	b.Base = base.Name
+	return b
+}
+
+// kept returns the names of the kept backups with the reasons, and the
+// deleted ones with theirs
+func kept(decisions []pruneDecision) (keep, drop []string) {
+	for _, d := range decisions {
+		entry := strings.TrimPrefix(d.Backup.Name, d.Backup.VM+"_backup_") + ":" + strings.Join(d.Reasons, ",")
+		if d.Keep {
+			keep = append(keep, entry)
+		} else {
+			drop = append(drop, entry)
+		}
+	}
+	sort.Strings(keep)
+	sort.Strings(drop)
+	return keep, drop
+}
+
+func TestApplyRetention(t *testing.T) {
+	tests := []struct {
+		name    string
+		backups []StoredBackup
+		policy  RetentionPolicy
+		keep    []string
+		drop    []string
+	}{
+		{
+			name: "no rules",
+			backups: []StoredBackup{
+				testBackup("vm1", "20240115_1000", 1),
+				incomplete(testBackup("vm1", "20240114_1000", 1)),
+			},
+			keep: []string{"20240114_1000:no retention rules", "20240115_1000:no retention rules"},
+		},
+		{
+			name: "last",
+			backups: []StoredBackup{
+				testBackup("vm1", "20240115_1000", 1),
+				testBackup("vm1", "20240114_1000", 1),
+				testBackup("vm1", "20240113_1000", 1),
+			},
+			policy: RetentionPolicy{Keep_last: 2},
+			keep:   []string{"20240114_1000:last", "20240115_1000:last"},
+			drop:   []string{"20240113_1000:"},
+		},
+		{
+			name: "incomplete backups are skipped and deleted",
+			backups: []StoredBackup{
+				incomplete(testBackup("vm1", "20240115_1000", 1)),
+				testBackup("vm1", "20240114_1000", 1),
+				incomplete(testBackup("vm1", "20240113_1000", 1)),
+				testBackup("vm1", "20240112_1000", 1),
+				testBackup("vm1", "20240111_1000", 1),
+			},
+			policy: RetentionPolicy{Keep_last: 2},
+			keep:   []string{"20240112_1000:last", "20240114_1000:last"},
+			drop:   []string{"20240111_1000:", "20240113_1000:incomplete", "20240115_1000:incomplete"},
+		},
+		{
+			name: "daily keeps the newest of a day",
+			backups: []StoredBackup{
+				testBackup("vm1", "20240115_2200", 1),
+				testBackup("vm1", "20240115_1000", 1),
+				testBackup("vm1", "20240114_2200", 1),
+				testBackup("vm1", "20240114_1000", 1),
+				testBackup("vm1", "20240113_1000", 1),
+			},
+			policy: RetentionPolicy{Keep_daily: 2},
+			keep:   []string{"20240114_2200:daily", "20240115_2200:daily"},
+			drop:   []string{"20240113_1000:", "20240114_1000:", "20240115_1000:"},
+		},
+		{
+			name: "rules add up",
+			backups: []StoredBackup{
+				testBackup("vm1", "20240301_1000", 1),
+				testBackup("vm1", "20240229_1000", 1),
+				testBackup("vm1", "20240220_1000", 1),
+				testBackup("vm1", "20240131_1000", 1),
+				testBackup("vm1", "20231231_1000", 1),
+			},
+			policy: RetentionPolicy{Keep_last: 1, Keep_weekly: 2, Keep_monthly: 3},
+			keep: []string{
+				"20240131_1000:monthly",
+				"20240220_1000:weekly",
+				"20240229_1000:monthly",
+				"20240301_1000:last,weekly,monthly",
+			},
+			drop: []string{"20231231_1000:"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keep, drop := kept(applyRetention(test.backups, test.policy))
+			if !reflect.DeepEqual(keep, test.keep) || !reflect.DeepEqual(drop, test.drop) {
+				t.Fatalf("kept %q and deleted %q, want %q and %q", keep, drop, test.keep, test.drop)
+			}
+		})
+	}
+}
+
+func TestEnforceMaxSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		backups []StoredBackup
+		max     int64
+		keep    []string
+	}{
+		{
+			name: "fits",
+			backups: []StoredBackup{
+				testBackup("vm1", "20240115_1000", 10),
+				testBackup("vm1", "20240114_1000", 10),
+			},
+			max:  20,
+			keep: []string{"vm1_backup_20240114_1000", "vm1_backup_20240115_1000"},
+		},
+		{
+			name: "oldest first across VMs",
+			backups: []StoredBackup{
+				testBackup("vm1", "20240115_1000", 10),
+				testBackup("vm1", "20240113_1000", 10),
+				testBackup("vm2", "20240115_1000", 10),
+				testBackup("vm2", "20240114_1000", 10),
+			},
+			max:  30,
+			keep: []string{"vm1_backup_20240115_1000", "vm2_backup_20240114_1000", "vm2_backup_20240115_1000"},
+		},
+		{
+			name: "the newest backup of a VM stays over the limit",
+			backups: []StoredBackup{
+				testBackup("vm1", "20240115_1000", 50),
+				testBackup("vm1", "20240114_1000", 10),
+				testBackup("vm2", "20240110_1000", 50),
+			},
+			max:  20,
+			keep: []string{"vm1_backup_20240115_1000", "vm2_backup_20240110_1000"},
+		},
+		{
+			name: "an incomplete newest backup doesn't count as the newest",
+			backups: []StoredBackup{
+				incomplete(testBackup("vm1", "20240115_1000", 10)),
+				testBackup("vm1", "20240114_1000", 10),
+			},
+			max:  15,
+			keep: []string{"vm1_backup_20240114_1000"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decisions := make([]pruneDecision, len(test.backups))
+			for i, b := range test.backups {
+				decisions[i] = pruneDecision{Backup: b, Keep: true}
+			}
+			enforceMaxSize(decisions, test.max)
+
+			var keep []string
+			for _, d := range decisions {
+				if d.Keep {
+					keep = append(keep, d.Backup.Name)
+				} else if strings.Join(d.Reasons, ",") != "over size limit" {
+					t.Errorf("%s deleted for %q", d.Backup.Name, d.Reasons)
+				}
+			}
+			sort.Strings(keep)
+			if !reflect.DeepEqual(keep, test.keep) {
+				t.Fatalf("kept %q, want %q", keep, test.keep)
+			}
+		})
+	}
+}
+
+func TestPlanRetentionChains(t *testing.T) {
+	full := testBackup("vm1", "20240110_1000", 100)
+	inc1 := basedOn(testBackup("vm1", "20240111_1000", 10), full)
+	inc2 := basedOn(testBackup("vm1", "20240112_1000", 10), inc1)
+	old := testBackup("vm1", "20240101_1000", 100)
+	//Failed while copying, the next backup is still based on inc2
+	partial := incomplete(basedOn(testBackup("vm1", "20240113_1000", 5), inc2))
+
+	tests := []struct {
+		name    string
+		backups []StoredBackup
+		policy  RetentionPolicy
+		max     string
+		keep    []string
+		drop    []string
+	}{
+		{
+			name:    "bases of a kept backup are kept",
+			backups: []StoredBackup{inc2, inc1, full, old},
+			policy:  RetentionPolicy{Keep_last: 1},
+			keep: []string{
+				"20240110_1000:base of vm1_backup_20240111_1000",
+				"20240111_1000:base of vm1_backup_20240112_1000",
+				"20240112_1000:last",
+			},
+			drop: []string{"20240101_1000:"},
+		},
+		{
+			name:    "a partial backup keeps nothing",
+			backups: []StoredBackup{partial, inc2, inc1, full, old},
+			policy:  RetentionPolicy{Keep_last: 1},
+			keep: []string{
+				"20240110_1000:base of vm1_backup_20240111_1000",
+				"20240111_1000:base of vm1_backup_20240112_1000",
+				"20240112_1000:last",
+			},
+			drop: []string{"20240101_1000:", "20240113_1000:incomplete"},
+		},
+		{
+			name:    "the size limit doesn't break a chain",
+			backups: []StoredBackup{inc2, inc1, full, old},
+			policy:  RetentionPolicy{Keep_last: 4},
+			max:     "50",
+			keep: []string{
+				"20240110_1000:base of vm1_backup_20240111_1000",
+				"20240111_1000:last,base of vm1_backup_20240112_1000",
+				"20240112_1000:last",
+			},
+			drop: []string{"20240101_1000:over size limit"},
+		},
+		{
+			name:    "a missing base",
+			backups: []StoredBackup{inc2, old},
+			policy:  RetentionPolicy{Keep_last: 1},
+			keep:    []string{"20240112_1000:last"},
+			drop:    []string{"20240101_1000:"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policyFor := func(vm string) RetentionPolicy { return test.policy }
+			decisions, err := planRetention(test.backups, policyFor, test.max)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keep, drop := kept(decisions)
+			if !reflect.DeepEqual(keep, test.keep) || !reflect.DeepEqual(drop, test.drop) {
+				t.Fatalf("kept %q and deleted %q, want %q and %q", keep, drop, test.keep, test.drop)
+			}
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/loginoff/nutanix-backup/nutanixapi"
+	"github.com/robfig/cron/v3"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const scheduleStateFile = ".nutanix_backup_schedule"
+
+// How often the daemon checks for due schedules
+const scheduleInterval = time.Minute
+
+// validSchedule checks a cron expression, eg. "0 2 * * *"
+func validSchedule(spec string) error {
+	if spec == "" {
+		return nil
+	}
+	if _, err := cron.ParseStandard(spec); err != nil {
+		return fmt.Errorf("Invalid schedule %q: %s", spec, err)
+	}
+	return nil
+}
+
+// scheduleFor returns the schedule of the VM entry, or the global one
+func scheduleFor(vm *VMBackup) string {
+	if vm.Schedule != "" {
+		return vm.Schedule
+	}
+	return BackupConfig.Schedule
+}
+
+// ScheduleState records when the daemon last backed up the VMs of each entry
+// in the configuration, so runs missed while it was down are caught up when
+// it starts again
+type ScheduleState struct {
+	path    string
+	LastRun map[string]time.Time `json:"lastRun"`
+}
+
+func OpenScheduleState(path string) (*ScheduleState, error) {
+	s := &ScheduleState{path: path, LastRun: make(map[string]time.Time)}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(s); err != nil {
+		return nil, fmt.Errorf("Corrupt schedule state %s: %s", path, err)
+	}
+	if s.LastRun == nil {
+		s.LastRun = make(map[string]time.Time)
+	}
+	return s, nil
+}
+
+// save writes the state to a temporary file and renames it over the old one
+func (s *ScheduleState) save() error {
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+
+	e := json.NewEncoder(f)
+	e.SetIndent("", "\t")
+	if err := e.Encode(s); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// scheduledEntry is an entry in the configuration with a schedule. Entries
+// are told apart in the state by how they select VMs.
+type scheduledEntry struct {
+	key      string
+	spec     string
+	schedule cron.Schedule
+}
+
+func runDaemon(ntnx *nutanixapi.Client) {
+	var entries []scheduledEntry
+	for i := range BackupConfig.VMs {
+		vm := &BackupConfig.VMs[i]
+		spec := scheduleFor(vm)
+		if spec == "" {
+			log.Warnf("%s has no schedule, the daemon doesn't back it up", vm.describe())
+			continue
+		}
+		//Validated in evaluateConfig
+		schedule, _ := cron.ParseStandard(spec)
+		entries = append(entries, scheduledEntry{key: vm.describe(), spec: spec, schedule: schedule})
+	}
+	if len(entries) < 1 {
+		log.Fatalf("Set a schedule in %s, globally or on the VMs", *configfile)
+	}
+
+	state, err := OpenScheduleState(filepath.Join(BackupConfig.Backup_root, scheduleStateFile))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	loadMetrics()
+	if err := serveMetrics(ctx); err != nil {
+		log.Fatalf("Unable to serve metrics: %s", err)
+	}
+
+	log.Infof("Running as a daemon with %d schedules", len(entries))
+	for {
+		runScheduled(ctx, ntnx, entries, state)
+		if ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-time.After(scheduleInterval):
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	stop()
+	log.Info("Daemon stopped")
+	if containers != nil {
+		if err := containers.Release(); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// runScheduled backs up the VMs of the entries whose schedule came up since
+// their last run. Runs missed while the daemon was down are caught up once.
+func runScheduled(ctx context.Context, ntnx *nutanixapi.Client, entries []scheduledEntry, state *ScheduleState) {
+	now := time.Now()
+	due := make(map[string]bool)
+	for _, entry := range entries {
+		last, ok := state.LastRun[entry.key]
+		if !ok {
+			//Backed up at the first time the schedule comes up from now on
+			state.LastRun[entry.key] = now
+			if err := state.save(); err != nil {
+				log.Errorf("Unable to save schedule state: %s", err)
+			}
+			continue
+		}
+		next := entry.schedule.Next(last)
+		if next.After(now) {
+			continue
+		}
+		if now.Sub(next) > scheduleInterval {
+			log.Infof("Catching up on the run of %s missed at %s", entry.key, next.Format(time.RFC3339))
+		}
+		due[entry.key] = true
+	}
+	if len(due) == 0 {
+		return
+	}
+
+	//Due entries stay due until they can be run
+	lock, err := AcquireLock(filepath.Join(BackupConfig.Backup_root, lockFile))
+	if err != nil {
+		log.Warnf("%s, trying again in a minute", err)
+		return
+	}
+	defer lock.Release()
+
+	if !journal.Empty() {
+		log.Warnf("Found leftovers from an interrupted run in %s, cleaning up", journal.path)
+		if err := journal.Cleanup(ntnx, true); err != nil {
+			log.Errorf("Cleanup failed, resolve manually or run the cleanup command: %s", err)
+			return
+		}
+	}
+
+	allvms, err := ntnx.GetVMs()
+	if err != nil {
+		log.Errorf("Unable to retrieve VM list from PRISM %s", err)
+		return
+	}
+	selected, err := resolveVMs(allvms)
+	if err != nil {
+		log.Errorf("%s, not backing up", err)
+		return
+	}
+	var vms []VMBackup
+	for _, vm := range selected {
+		if due[vm.SelectedBy] {
+			vms = append(vms, vm)
+		}
+	}
+
+	if len(vms) > 0 {
+		log.Infof("Backing up %d VMs on schedule", len(vms))
+		succeeded, failed := backupVMs(ctx, ntnx, vms)
+		//Backups finished before an interruption are in the metrics too
+		writeMetrics()
+		if ctx.Err() != nil {
+			//Run again when the daemon is started again
+			return
+		}
+		log.Infof("Scheduled run finished, %d VMs backed up, %d failed", succeeded, failed)
+	}
+
+	//Failed backups are retried at the next scheduled time, not every minute
+	for key := range due {
+		state.LastRun[key] = now
+	}
+	if err := state.save(); err != nil {
+		log.Errorf("Unable to save schedule state: %s", err)
+	}
+}
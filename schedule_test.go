@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/loginoff/nutanix-backup/nutanixapi/prismtest"
+	"github.com/robfig/cron/v3"
+)
+
+func TestValidSchedule(t *testing.T) {
+	tests := []struct {
+		spec string
+		ok   bool
+	}{
+		{spec: "", ok: true},
+		{spec: "0 2 * * *", ok: true},
+		{spec: "@daily", ok: true},
+		{spec: "*/15 * * * 1-5", ok: true},
+		{spec: "0 2 * *"},
+		{spec: "61 * * * *"},
+		{spec: "daily"},
+	}
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			if err := validSchedule(test.spec); (err == nil) != test.ok {
+				t.Fatalf("validSchedule(%q) returned %v", test.spec, err)
+			}
+		})
+	}
+}
+
+func TestRunScheduled(t *testing.T) {
+	//Comes up once a year, not while the test runs
+	const yearly = "0 0 1 1 *"
+
+	tests := []struct {
+		name string
+		//Schedules of web1 and db1
+		web1, db1 string
+		//Time of the last runs before now, none if zero
+		web1_last, db1_last time.Duration
+		//Interrupted before the backups finish
+		interrupted bool
+		//VMs backed up
+		want []string
+	}{
+		{
+			name: "first start",
+			web1: "@hourly", db1: "@hourly",
+		},
+		{
+			name: "missed run",
+			web1: "@daily", db1: yearly,
+			web1_last: 25 * time.Hour, db1_last: time.Minute,
+			want: []string{"web1"},
+		},
+		{
+			name: "missed runs caught up once",
+			web1: "@hourly", db1: "@hourly",
+			web1_last: 72 * time.Hour, db1_last: 5 * time.Hour,
+			want: []string{"web1", "db1"},
+		},
+		{
+			name: "not due",
+			web1: yearly, db1: yearly,
+			web1_last: time.Hour, db1_last: time.Minute,
+		},
+		{
+			name: "first start of one entry",
+			web1: "@hourly", db1: "@hourly",
+			db1_last: 2 * time.Hour,
+			want:     []string{"db1"},
+		},
+		{
+			name: "interrupted",
+			web1: "@hourly", db1: yearly,
+			web1_last: 2 * time.Hour, db1_last: time.Minute,
+			interrupted: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := setupE2E(t)
+			e.prism.AddVM("web1", "", prismtest.Disk{Bus: "scsi", Index: 0, ContainerUUID: testContainer, Data: testDisk(1, 4096)})
+			e.prism.AddVM("db1", "", prismtest.Disk{Bus: "scsi", Index: 0, ContainerUUID: testContainer, Data: testDisk(2, 4096)})
+			BackupConfig.VMs = []VMBackup{{Name: "web1", Schedule: test.web1}, {Name: "db1", Schedule: test.db1}}
+			BackupConfig.Metrics_textfile = filepath.Join(t.TempDir(), "nutanix_backup.prom")
+
+			state, err := OpenScheduleState(filepath.Join(BackupConfig.Backup_root, scheduleStateFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var entries []scheduledEntry
+			start := time.Now()
+			for i, last := range []time.Duration{test.web1_last, test.db1_last} {
+				vm := &BackupConfig.VMs[i]
+				schedule, err := cron.ParseStandard(vm.Schedule)
+				if err != nil {
+					t.Fatal(err)
+				}
+				entries = append(entries, scheduledEntry{key: vm.describe(), spec: vm.Schedule, schedule: schedule})
+				if last != 0 {
+					state.LastRun[vm.describe()] = start.Add(-last)
+				}
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if test.interrupted {
+				cancel()
+			}
+			runScheduled(ctx, e.ntnx, entries, state)
+			if _, err := os.Stat(BackupConfig.Metrics_textfile); (err == nil) != (len(test.want) > 0 || test.interrupted) {
+				t.Errorf("metrics written: %v", err == nil)
+			}
+
+			backed_up := make(map[string]bool)
+			for _, vm := range test.want {
+				backed_up[vm] = true
+			}
+			for _, vm := range []string{"web1", "db1"} {
+				n := 0
+				for _, b := range catalog.Find(vm, time.Time{}, time.Time{}) {
+					if b.Status == statusOK {
+						n++
+					}
+				}
+				if n > 1 || (n == 1) != backed_up[vm] {
+					t.Errorf("%d backups of %s, want it backed up %v", n, vm, backed_up[vm])
+				}
+			}
+
+			for i, last := range []time.Duration{test.web1_last, test.db1_last} {
+				key := BackupConfig.VMs[i].describe()
+				name := BackupConfig.VMs[i].Name
+				recorded, ok := state.LastRun[key]
+				if !ok {
+					t.Errorf("no run of %s recorded", name)
+				} else if (last == 0 || backed_up[name]) && recorded.Before(start) {
+					t.Errorf("run of %s recorded at %s, before the run started", name, recorded)
+				} else if last != 0 && !backed_up[name] && !recorded.Equal(start.Add(-last)) {
+					t.Errorf("run of %s recorded at %s, but it wasn't due", name, recorded)
+				}
+			}
+		})
+	}
+}
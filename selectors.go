@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/loginoff/nutanix-backup/nutanixapi"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// isSelector reports whether a VM entry selects VMs by pattern, tags or all
+// VMs, instead of naming a single VM
+func (vm *VMBackup) isSelector() bool {
+	return vm.Name_pattern != "" || vm.Name_regex != "" || len(vm.Tags) > 0 || vm.All
+}
+
+// describe returns how the entry selects VMs, for the preview
+func (vm *VMBackup) describe() string {
+	if !vm.isSelector() {
+		return "name " + vm.Name
+	}
+	var rules []string
+	if vm.All {
+		rules = append(rules, "all VMs")
+	}
+	if vm.Name_pattern != "" {
+		rules = append(rules, "pattern "+vm.Name_pattern)
+	}
+	if vm.Name_regex != "" {
+		rules = append(rules, "regex "+vm.Name_regex)
+	}
+	if len(vm.Tags) > 0 {
+		rules = append(rules, "tags "+strings.Join(vm.Tags, ","))
+	}
+	return strings.Join(rules, ", ")
+}
+
+// validateSelector checks the patterns of a VM entry
+func (vm *VMBackup) validateSelector() error {
+	if vm.Name != "" && vm.isSelector() {
+		return fmt.Errorf("VM %s has a name and selectors, use one or the other", vm.Name)
+	}
+	if vm.Name == "" && !vm.isSelector() {
+		return fmt.Errorf("VM entries need a name, name_pattern, name_regex, tags or all")
+	}
+	if vm.Name_pattern != "" {
+		if _, err := filepath.Match(vm.Name_pattern, ""); err != nil {
+			return fmt.Errorf("Invalid name_pattern %q: %s", vm.Name_pattern, err)
+		}
+	}
+	if vm.Name_regex != "" {
+		if _, err := regexp.Compile(vm.Name_regex); err != nil {
+			return fmt.Errorf("Invalid name_regex %q: %s", vm.Name_regex, err)
+		}
+	}
+	for _, pattern := range append(vm.Exclude, BackupConfig.Exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid exclude pattern %q: %s", pattern, err)
+		}
+	}
+	return nil
+}
+
+// matches reports whether the entry selects the VM with the name and
+// description. All rules of a selector must match.
+func (vm *VMBackup) matches(name, description string) bool {
+	if !vm.isSelector() {
+		return vm.Name == name
+	}
+	for _, pattern := range vm.Exclude {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return false
+		}
+	}
+	if vm.Name_pattern != "" {
+		if ok, _ := filepath.Match(vm.Name_pattern, name); !ok {
+			return false
+		}
+	}
+	if vm.Name_regex != "" && !regexp.MustCompile(vm.Name_regex).MatchString(name) {
+		return false
+	}
+	tags := descriptionTags(description)
+	for _, tag := range vm.Tags {
+		if !tags[strings.TrimPrefix(tag, "#")] {
+			return false
+		}
+	}
+	return true
+}
+
+// descriptionTags returns the #tags in the description of a VM, without the #
+func descriptionTags(description string) map[string]bool {
+	tags := make(map[string]bool)
+	for _, word := range strings.Fields(description) {
+		if len(word) > 1 && word[0] == '#' {
+			tags[word[1:]] = true
+		}
+	}
+	return tags
+}
+
+func excluded(name string) bool {
+	for _, pattern := range BackupConfig.Exclude {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// vmConfigFor returns the VM entry that applies to a VM. Entries naming the
+// VM take precedence over selectors, which are tried in order.
+func vmConfigFor(name, description string) (*VMBackup, bool) {
+	for i := range BackupConfig.VMs {
+		if vm := &BackupConfig.VMs[i]; !vm.isSelector() && vm.Name == name {
+			return vm, true
+		}
+	}
+	if excluded(name) {
+		return nil, false
+	}
+	for i := range BackupConfig.VMs {
+		if vm := &BackupConfig.VMs[i]; vm.isSelector() && vm.matches(name, description) {
+			return vm, true
+		}
+	}
+	return nil, false
+}
+
+// resolveVMs returns the VMs on the cluster to back up, with the settings of
+// the entry that selected them. VMs named explicitly must exist.
+func resolveVMs(allvms []nutanixapi.AHVVM) ([]VMBackup, error) {
+	byName := make(map[string][]nutanixapi.AHVVM)
+	for _, nvm := range allvms {
+		byName[nvm.Config.Name] = append(byName[nvm.Config.Name], nvm)
+	}
+	for _, entry := range BackupConfig.VMs {
+		if !entry.isSelector() && len(byName[entry.Name]) == 0 {
+			return nil, fmt.Errorf("Did not find a VM named %s", entry.Name)
+		}
+	}
+
+	var vms []VMBackup
+	matched := make(map[*VMBackup]int)
+	order := make(map[string]int)
+	skipped := make(map[string]bool)
+	for _, nvm := range allvms {
+		entry, ok := vmConfigFor(nvm.Config.Name, nvm.Config.Description)
+		if !ok {
+			continue
+		}
+		matched[entry]++
+		//Backups are told apart by the VM name
+		if len(byName[nvm.Config.Name]) > 1 {
+			if !entry.isSelector() {
+				return nil, fmt.Errorf("More than one VM found with the name %s", nvm.Config.Name)
+			}
+			if !skipped[nvm.Config.Name] {
+				log.Warnf("Skipping %s, more than one VM has that name", nvm.Config.Name)
+				skipped[nvm.Config.Name] = true
+			}
+			continue
+		}
+		vm := *entry
+		vm.Name = nvm.Config.Name
+		vm.VMInfo = nvm
+		vm.SelectedBy = entry.describe()
+		vm.Disks = vm.selectDisks()
+		vms = append(vms, vm)
+		for i := range BackupConfig.VMs {
+			if &BackupConfig.VMs[i] == entry {
+				order[vm.Name] = i
+			}
+		}
+	}
+
+	for i := range BackupConfig.VMs {
+		if entry := &BackupConfig.VMs[i]; entry.isSelector() && matched[entry] == 0 {
+			log.Warnf("No VMs on the cluster match %s", entry.describe())
+		}
+	}
+	//In the order of the entries that selected them
+	sort.Slice(vms, func(i, j int) bool {
+		if order[vms[i].Name] != order[vms[j].Name] {
+			return order[vms[i].Name] < order[vms[j].Name]
+		}
+		return vms[i].Name < vms[j].Name
+	})
+	return vms, nil
+}
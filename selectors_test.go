@@ -0,0 +1,149 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/loginoff/nutanix-backup/nutanixapi"
+)
+
+func clusterVM(name, description string) nutanixapi.AHVVM {
+	var nvm nutanixapi.AHVVM
+	nvm.UUID = "uuid-" + name
+	nvm.Config.Name = name
+	nvm.Config.Description = description
+	return nvm
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		name        string
+		entry       VMBackup
+		vm          string
+		description string
+		want        bool
+	}{
+		{name: "name", entry: VMBackup{Name: "web1"}, vm: "web1", want: true},
+		{name: "other name", entry: VMBackup{Name: "web1"}, vm: "web10"},
+		{name: "glob", entry: VMBackup{Name_pattern: "web*"}, vm: "web10", want: true},
+		{name: "glob no match", entry: VMBackup{Name_pattern: "web?"}, vm: "web10"},
+		{name: "regex", entry: VMBackup{Name_regex: `^db-\d+$`}, vm: "db-12", want: true},
+		{name: "regex no match", entry: VMBackup{Name_regex: `^db-\d+$`}, vm: "db-12-old"},
+		{name: "tag", entry: VMBackup{Tags: []string{"backup"}}, vm: "x", description: "Mail server #backup", want: true},
+		{name: "tag with #", entry: VMBackup{Tags: []string{"#backup"}}, vm: "x", description: "#backup #prod", want: true},
+		{name: "tag missing", entry: VMBackup{Tags: []string{"backup", "prod"}}, vm: "x", description: "#backup"},
+		{name: "tag within a word", entry: VMBackup{Tags: []string{"backup"}}, vm: "x", description: "no#backup"},
+		{name: "all rules must match", entry: VMBackup{Name_pattern: "web*", Tags: []string{"prod"}}, vm: "web1", description: "#test"},
+		{name: "all", entry: VMBackup{All: true}, vm: "anything", want: true},
+		{name: "exclude", entry: VMBackup{All: true, Exclude: []string{"*-tmp"}}, vm: "web-tmp"},
+		{name: "exclude before pattern", entry: VMBackup{Name_pattern: "web*", Exclude: []string{"web2"}}, vm: "web2"},
+		{name: "exclude other VMs", entry: VMBackup{Name_pattern: "web*", Exclude: []string{"web2"}}, vm: "web1", want: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.entry.matches(test.vm, test.description); got != test.want {
+				t.Fatalf("matches(%q, %q) = %v, want %v", test.vm, test.description, got, test.want)
+			}
+		})
+	}
+}
+
+func TestResolveVMs(t *testing.T) {
+	saved_config := BackupConfig
+	t.Cleanup(func() { BackupConfig = saved_config })
+
+	cluster := []nutanixapi.AHVVM{
+		clusterVM("web1", "#prod"),
+		clusterVM("web2", ""),
+		clusterVM("db1", "#prod #backup"),
+		clusterVM("build-tmp", "#backup"),
+		clusterVM("dup", "#backup"),
+		clusterVM("dup", "#backup"),
+	}
+	tests := []struct {
+		name    string
+		vms     []VMBackup
+		exclude []string
+		//Names of the selected VMs with the entries that selected them
+		want [][2]string
+		ok   bool
+	}{
+		{
+			name: "by name",
+			vms:  []VMBackup{{Name: "db1"}, {Name: "web1"}},
+			want: [][2]string{{"db1", "name db1"}, {"web1", "name web1"}},
+			ok:   true,
+		},
+		{
+			name: "missing name",
+			vms:  []VMBackup{{Name: "web3"}},
+		},
+		{
+			name: "duplicate name",
+			vms:  []VMBackup{{Name: "dup"}},
+		},
+		{
+			name: "duplicate names skipped by selectors",
+			vms:  []VMBackup{{Tags: []string{"backup"}}},
+			want: [][2]string{{"build-tmp", "tags backup"}, {"db1", "tags backup"}},
+			ok:   true,
+		},
+		{
+			name: "names take precedence over selectors",
+			vms:  []VMBackup{{Name_pattern: "web*"}, {Name: "web2"}},
+			want: [][2]string{{"web1", "pattern web*"}, {"web2", "name web2"}},
+			ok:   true,
+		},
+		{
+			name: "first matching selector",
+			vms:  []VMBackup{{Tags: []string{"prod"}}, {Name_regex: "^(web|db)"}},
+			want: [][2]string{{"db1", "tags prod"}, {"web1", "tags prod"}, {"web2", "regex ^(web|db)"}},
+			ok:   true,
+		},
+		{
+			name:    "global exclude",
+			vms:     []VMBackup{{All: true, Exclude: []string{"dup"}}},
+			exclude: []string{"*-tmp", "web?"},
+			want:    [][2]string{{"db1", "all VMs"}},
+			ok:      true,
+		},
+		{
+			name:    "global exclude doesn't apply to names",
+			vms:     []VMBackup{{Name: "build-tmp"}},
+			exclude: []string{"*-tmp"},
+			want:    [][2]string{{"build-tmp", "name build-tmp"}},
+			ok:      true,
+		},
+		{
+			name: "no matches",
+			vms:  []VMBackup{{Name_pattern: "mail*"}},
+			ok:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			BackupConfig.VMs = test.vms
+			BackupConfig.Exclude = test.exclude
+			vms, err := resolveVMs(cluster)
+			if !test.ok {
+				if err == nil {
+					t.Fatalf("resolved %d VMs without an error", len(vms))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got [][2]string
+			for _, vm := range vms {
+				got = append(got, [2]string{vm.Name, vm.SelectedBy})
+				if vm.VMInfo.Config.Name != vm.Name {
+					t.Errorf("%s resolved to the cluster VM %s", vm.Name, vm.VMInfo.Config.Name)
+				}
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("resolved %v, want %v", got, test.want)
+			}
+		})
+	}
+}
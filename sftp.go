@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/loginoff/nutanix-backup/nutanixapi"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// CVMs serve the containers over SFTP on this port, to the PRISM users
+const defaultSFTPPort = 2222
+
+// Paths of vdisks read over SFTP start with this, followed by the path on the CVM
+const sftpPrefix = "sftp:"
+
+// SourceFile is a vdisk opened for reading, either on an NFS mount or over SFTP
+type SourceFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+}
+
+// SFTPAccess reads vdisks from a CVM over SFTP. The connection is opened on
+// first use and shared between all the backups running in parallel. Once it
+// is lost, eg. when the CVM restarts, the next use opens a new one.
+type SFTPAccess struct {
+	mu         sync.Mutex
+	names      *containerNames
+	addr       string
+	config     *ssh.ClientConfig
+	connection *ssh.Client
+	client     *sftp.Client
+}
+
+func NewSFTPAccess(ntnx *nutanixapi.Client, cvm string, port int, username, password, known_hosts string) (*SFTPAccess, error) {
+	if known_hosts == "" {
+		log.Warnf("sftp_known_hosts is not set, the host key of %s is not checked", cvm)
+	}
+	host_key, err := hostKeyCallback(known_hosts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SFTPAccess{
+		names: newContainerNames(ntnx),
+		addr:  net.JoinHostPort(cvm, strconv.Itoa(port)),
+		config: &ssh.ClientConfig{
+			User:            username,
+			Auth:            []ssh.AuthMethod{ssh.Password(password)},
+			HostKeyCallback: host_key,
+			Timeout:         30 * time.Second,
+		},
+	}, nil
+}
+
+func (s *SFTPAccess) connect() (*sftp.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client != nil {
+		return s.client, nil
+	}
+	log.Infof("Connecting to %s over SFTP", s.addr)
+	connection, client, err := dialSFTP(s.addr, s.config)
+	if err != nil {
+		return nil, err
+	}
+	s.connection, s.client = connection, client
+	go s.drop(connection)
+	return client, nil
+}
+
+// drop forgets the connection once it is closed or lost
+func (s *SFTPAccess) drop(connection *ssh.Client) {
+	connection.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	//Released, or already replaced
+	if s.connection != connection {
+		return
+	}
+	log.Warnf("Lost the SFTP connection to %s", s.addr)
+	s.client.Close()
+	s.connection, s.client = nil, nil
+}
+
+// hostKeyCallback checks host keys against a known_hosts file, or accepts
+// any key without one
+func hostKeyCallback(known_hosts string) (ssh.HostKeyCallback, error) {
+	if known_hosts == "" {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	return knownhosts.New(known_hosts)
+}
+
+func dialSFTP(addr string, config *ssh.ClientConfig) (*ssh.Client, *sftp.Client, error) {
+	connection, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to connect to %s: %s", addr, err)
+	}
+	//Several requests in flight per read or write make up for the latency
+	client, err := sftp.NewClient(connection, sftp.UseConcurrentReads(true), sftp.UseConcurrentWrites(true), sftp.MaxConcurrentRequestsPerFile(64))
+	if err != nil {
+		connection.Close()
+		return nil, nil, err
+	}
+	return connection, client, nil
+}
+
+// Root returns the path vdisks of a container are read from. The connection
+// is opened when the first vdisk is.
+func (s *SFTPAccess) Root(UUID string) (string, error) {
+	cname, err := s.names.name(UUID)
+	if err != nil {
+		return "", err
+	}
+	return sftpPrefix + "/" + cname, nil
+}
+
+func (s *SFTPAccess) Prefix() string {
+	return sftpPrefix
+}
+
+func (s *SFTPAccess) Open(path string) (SourceFile, error) {
+	client, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	return client.Open(path)
+}
+
+func (s *SFTPAccess) Stat(path string) (os.FileInfo, error) {
+	client, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	return client.Stat(path)
+}
+
+// Release closes the connection
+func (s *SFTPAccess) Release() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client == nil {
+		return nil
+	}
+	s.client.Close()
+	err := s.connection.Close()
+	s.connection, s.client = nil, nil
+	return err
+}
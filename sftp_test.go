@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	testSSHUser     = "backup"
+	testSSHPassword = "secret"
+)
+
+// sftpServer serves the local filesystem over SFTP to testSSHUser
+type sftpServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+	mu       sync.Mutex
+	conns    []net.Conn
+}
+
+func newSFTPServer(t *testing.T) *sftpServer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if meta.User() == testSSHUser && string(password) == testSSHPassword {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &sftpServer{listener: listener, config: config}
+	t.Cleanup(s.close)
+	go s.serve()
+	return s
+}
+
+func (s *sftpServer) host() string {
+	host, _, _ := net.SplitHostPort(s.listener.Addr().String())
+	return host
+}
+
+func (s *sftpServer) port() int {
+	_, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+func (s *sftpServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+func (s *sftpServer) handle(conn net.Conn) {
+	_, channels, requests, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for new_channel := range channels {
+		if new_channel.ChannelType() != "session" {
+			new_channel.Reject(ssh.UnknownChannelType, "only sessions")
+			continue
+		}
+		channel, requests, err := new_channel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				server, err := sftp.NewServer(channel)
+				if err != nil {
+					channel.Close()
+					return
+				}
+				go func() {
+					server.Serve()
+					server.Close()
+				}()
+			}
+		}()
+	}
+}
+
+// drop cuts all the connections, like a restart of the server
+func (s *sftpServer) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *sftpServer) close() {
+	s.listener.Close()
+	s.drop()
+}
+
+func TestSFTPAccessReconnects(t *testing.T) {
+	server := newSFTPServer(t)
+	path := filepath.Join(t.TempDir(), "vdisk")
+	data := testDisk(1, 4096)
+	if err := ioutil.WriteFile(path, data, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	access, err := NewSFTPAccess(nil, server.host(), server.port(), testSSHUser, testSSHPassword, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer access.Release()
+
+	read := func() {
+		t.Helper()
+		f, err := access.Open(path)
+		if err != nil {
+			t.Fatalf("Open: %s", err)
+		}
+		defer f.Close()
+		got, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatal("read different data")
+		}
+	}
+
+	read()
+	server.drop()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		access.mu.Lock()
+		dropped := access.client == nil
+		access.mu.Unlock()
+		if dropped {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the lost connection was not dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	read()
+}
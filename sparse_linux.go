@@ -0,0 +1,50 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lseek(2) whence values for finding data and holes in sparse files
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// nextDataRegion returns the start and end of the first region at or after
+// offset that contains data. When there is no more data, start and end are
+// both size. Filesystems without SEEK_DATA support report the rest of the
+// file as data.
+func nextDataRegion(f *os.File, offset, size int64) (start, end int64, err error) {
+	start, err = f.Seek(offset, seekData)
+	if errors.Is(err, syscall.ENXIO) {
+		return size, size, nil
+	}
+	if errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.EOPNOTSUPP) {
+		return offset, size, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	end, err = f.Seek(start, seekHole)
+	if err != nil {
+		return 0, 0, err
+	}
+	if end > size {
+		end = size
+	}
+	return start, end, nil
+}
+
+// allocatedSize returns the disk space used by a file, which for sparse
+// files is less than its size
+func allocatedSize(info os.FileInfo) int64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return st.Blocks * 512
+	}
+	return info.Size()
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// nextDataRegion reports the rest of the file as data, holes are still
+// recreated in the copy for blocks that only contain zeroes
+func nextDataRegion(f *os.File, offset, size int64) (start, end int64, err error) {
+	return offset, size, nil
+}
+
+// allocatedSize returns the size of the file, holes included
+func allocatedSize(info os.FileInfo) int64 {
+	return info.Size()
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Storage backends
+const (
+	storageLocal = "local"
+	storageSSH   = "ssh"
+	storageS3    = "s3"
+)
+
+// Storage is where the disk images and metadata of backups are kept. Objects are
+// named by slash separated paths relative to the root of the storage, eg. <backup>/<disk>.
+type Storage interface {
+	// Create returns a writer for a new object, which only appears under name
+	// once the writer is closed without errors
+	Create(ctx context.Context, name string) (ObjectWriter, error)
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+	// Stat returns the size of an object, or an error satisfying os.IsNotExist
+	Stat(ctx context.Context, name string) (int64, error)
+	// List returns the sizes of the objects below a prefix, by name
+	List(ctx context.Context, prefix string) (map[string]int64, error)
+	// RemoveAll removes all objects below a prefix
+	RemoveAll(ctx context.Context, prefix string) error
+	String() string
+}
+
+type ObjectWriter interface {
+	io.WriteCloser
+	// Abort discards everything written so far
+	Abort() error
+}
+
+type StorageConfig struct {
+	//local, ssh or s3
+	Type string
+	//Directory for local and ssh storage, local storage defaults to backup_root
+	Path string
+	//SSH host, as host or host:port, logged in to with a password or a private key
+	Host          string
+	User          string
+	Password      string
+	Identity_file string
+	Known_hosts   string
+	//S3 compatible object store
+	Endpoint   string
+	Region     string
+	Bucket     string
+	Prefix     string
+	Access_key string
+	Secret_key string
+	//Use plain HTTP
+	Insecure bool
+	//Size of the parts of multipart uploads, eg. 64M
+	Part_size string
+}
+
+func openStorage(config StorageConfig) (Storage, error) {
+	switch config.Type {
+	case "", storageLocal:
+		if config.Path == "" {
+			config.Path = BackupConfig.Backup_root
+		}
+		return &LocalStorage{root: config.Path}, nil
+	case storageSSH:
+		return NewSSHStorage(config)
+	case storageS3:
+		return NewS3Storage(config)
+	}
+	return nil, fmt.Errorf("Unknown storage type %q, use local, ssh or s3", config.Type)
+}
+
+// remoteStorage reports whether disk images are stored somewhere else than backup_root
+func remoteStorage() bool {
+	local, ok := storage.(*LocalStorage)
+	return storage != nil && !(ok && local.root == BackupConfig.Backup_root)
+}
+
+// LocalStorage keeps the backups in backup_root
+type LocalStorage struct {
+	root string
+}
+
+func (s *LocalStorage) path(name string) string {
+	return filepath.Join(s.root, filepath.FromSlash(name))
+}
+
+func (s *LocalStorage) Create(ctx context.Context, name string) (ObjectWriter, error) {
+	dst := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(dst), 0750); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(dst+partialSuffix, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &localWriter{File: f, dst: dst}, nil
+}
+
+type localWriter struct {
+	*os.File
+	dst string
+}
+
+func (w *localWriter) Close() error {
+	if err := w.File.Sync(); err != nil {
+		w.Abort()
+		return err
+	}
+	if err := w.File.Close(); err != nil {
+		os.Remove(w.Name())
+		return err
+	}
+	return os.Rename(w.Name(), w.dst)
+}
+
+func (w *localWriter) Abort() error {
+	w.File.Close()
+	return os.Remove(w.Name())
+}
+
+func (s *LocalStorage) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(s.path(name))
+}
+
+func (s *LocalStorage) Stat(ctx context.Context, name string) (int64, error) {
+	info, err := os.Stat(s.path(name))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (s *LocalStorage) List(ctx context.Context, prefix string) (map[string]int64, error) {
+	objects := make(map[string]int64)
+	err := filepath.Walk(s.path(prefix), func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || info.IsDir() {
+			return err
+		}
+		name, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		objects[filepath.ToSlash(name)] = info.Size()
+		return nil
+	})
+	return objects, err
+}
+
+func (s *LocalStorage) RemoveAll(ctx context.Context, prefix string) error {
+	return os.RemoveAll(s.path(prefix))
+}
+
+func (s *LocalStorage) String() string {
+	return s.root
+}
+
+// objectName returns the name of a file of a backup in the storage
+func objectName(backup, file string) string {
+	return path.Join(backup, file)
+}
+
+// storedObject returns the name of the object holding the image of a disk in a
+// backup, whichever format it was stored in
+func storedObject(ctx context.Context, backup, disk string) (string, bool) {
+	for _, ext := range compressionExtensions {
+		for _, suffix := range []string{"", encryptedSuffix} {
+			name := objectName(backup, disk+ext+suffix)
+			if _, err := storage.Stat(ctx, name); err == nil {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// storeObject uploads src to the object name, compressed and encrypted according
+// to format. Returns the checksum of the image and of the object.
+func storeObject(ctx context.Context, src, name string, format StorageFormat, blocks *blockHasher) (checksum, file_checksum string, err error) {
+	w, err := storage.Create(ctx, name)
+	if err != nil {
+		return "", "", err
+	}
+	checksum, file_checksum, err = streamImage(ctx, src, fmt.Sprintf("%s/%s", storage, name), w, format, bandwidth, blocks)
+	if err != nil {
+		w.Abort()
+		return "", "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", "", err
+	}
+	return checksum, file_checksum, nil
+}
+
+// uploadMetadata copies the files of a backup directory in backup_root, which
+// hold the metadata of the backup, to the storage
+func uploadMetadata(ctx context.Context, backup_path string) error {
+	files, err := filepath.Glob(filepath.Join(backup_path, "*"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if IsDir(file) || strings.HasSuffix(file, partialSuffix) {
+			continue
+		}
+		if err := uploadFile(ctx, file, objectName(filepath.Base(backup_path), filepath.Base(file))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func uploadFile(ctx context.Context, file, name string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w, err := storage.Create(ctx, name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+// fetchMetadata downloads the metadata of a backup from the storage into
+// backup_root, eg. to restore it on another host. The disk images listed in
+// the manifest are left in the storage.
+func fetchMetadata(ctx context.Context, backup string) error {
+	objects, err := storage.List(ctx, backup+"/")
+	if err != nil {
+		return err
+	}
+	if len(objects) == 0 {
+		return fmt.Errorf("No backup named %s in %s", backup, storage)
+	}
+
+	backup_path := filepath.Join(BackupConfig.Backup_root, backup)
+	if err := os.MkdirAll(backup_path, 0750); err != nil {
+		return err
+	}
+	if err := downloadFile(ctx, objectName(backup, manifestFile), filepath.Join(backup_path, manifestFile)); err != nil {
+		return err
+	}
+	images, err := readManifest(backup_path)
+	if err != nil {
+		return err
+	}
+
+	for name := range objects {
+		file := path.Base(name)
+		if _, image := images[file]; image || file == manifestFile {
+			continue
+		}
+		log.Infof("Downloading %s", name)
+		if err := downloadFile(ctx, name, filepath.Join(backup_path, file)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func downloadFile(ctx context.Context, name, file string) error {
+	r, err := storage.Open(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// hashBackupFile returns the checksum of a file of a backup, as it is stored
+func hashBackupFile(ctx context.Context, backup_path, file string) (string, error) {
+	if !remoteStorage() {
+		return hashFile(ctx, filepath.Join(backup_path, file), nil)
+	}
+	r, err := storage.Open(ctx, objectName(filepath.Base(backup_path), file))
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	return hashReader(ctx, r)
+}
+
+// hashStoredFile returns the checksum of the decrypted and decompressed contents
+// of a file of a backup
+func hashStoredFile(ctx context.Context, backup_path, file string) (string, error) {
+	if !remoteStorage() {
+		return hashStored(ctx, filepath.Join(backup_path, file))
+	}
+	r, err := openStoredObject(ctx, objectName(filepath.Base(backup_path), file))
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	return hashReader(ctx, r)
+}
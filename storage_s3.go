@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const defaultPartSize = "64M"
+
+// S3Storage keeps the backups in a bucket of an S3 compatible object store.
+// Objects are uploaded in parts while they are written, so disk images are
+// streamed from the container without staging them locally. An object can be
+// made of at most 10000 parts, which limits disk images to 10000 * part_size.
+type S3Storage struct {
+	client   *minio.Client
+	bucket   string
+	prefix   string
+	partSize uint64
+}
+
+func NewS3Storage(config StorageConfig) (*S3Storage, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, fmt.Errorf("S3 storage needs an endpoint and a bucket")
+	}
+	if config.Part_size == "" {
+		config.Part_size = defaultPartSize
+	}
+	part_size, err := parseSize(config.Part_size, 1024*1024)
+	if err != nil {
+		return nil, err
+	}
+	if part_size < 5*1024*1024 {
+		return nil, fmt.Errorf("part_size must be at least 5M")
+	}
+
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:        credentials.NewStaticV4(config.Access_key, config.Secret_key, ""),
+		Secure:       !config.Insecure,
+		Region:       config.Region,
+		BucketLookup: minio.BucketLookupPath,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := client.BucketExists(context.Background(), config.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to access bucket %s: %s", config.Bucket, err)
+	}
+	if !exists {
+		return nil, fmt.Errorf("Bucket %s does not exist", config.Bucket)
+	}
+
+	return &S3Storage{
+		client:   client,
+		bucket:   config.Bucket,
+		prefix:   strings.Trim(config.Prefix, "/"),
+		partSize: uint64(part_size),
+	}, nil
+}
+
+func (s *S3Storage) key(name string) string {
+	return path.Join(s.prefix, name)
+}
+
+// notExist turns missing objects into errors satisfying os.IsNotExist
+func notExist(err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return os.ErrNotExist
+	}
+	return err
+}
+
+func (s *S3Storage) Create(ctx context.Context, name string) (ObjectWriter, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	pr, pw := io.Pipe()
+	w := &s3Writer{PipeWriter: pw, cancel: cancel, done: make(chan error, 1)}
+	go func() {
+		//The size is unknown, so the object is uploaded in parts of partSize
+		_, err := s.client.PutObject(ctx, s.bucket, s.key(name), pr, -1, minio.PutObjectOptions{
+			PartSize:    s.partSize,
+			ContentType: "application/octet-stream",
+		})
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+	return w, nil
+}
+
+type s3Writer struct {
+	*io.PipeWriter
+	cancel context.CancelFunc
+	done   chan error
+}
+
+func (w *s3Writer) Close() error {
+	w.PipeWriter.Close()
+	err := <-w.done
+	w.cancel()
+	return err
+}
+
+// Abort fails the upload, which makes the client abort the multipart upload.
+// The context is only cancelled afterwards, aborting takes a request too.
+func (w *s3Writer) Abort() error {
+	w.PipeWriter.CloseWithError(fmt.Errorf("upload aborted"))
+	<-w.done
+	w.cancel()
+	return nil
+}
+
+func (s *S3Storage) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, s.key(name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, notExist(err)
+	}
+	//GetObject doesn't send a request until the object is read
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		return nil, notExist(err)
+	}
+	return obj, nil
+}
+
+func (s *S3Storage) Stat(ctx context.Context, name string) (int64, error) {
+	info, err := s.client.StatObject(ctx, s.bucket, s.key(name), minio.StatObjectOptions{})
+	if err != nil {
+		return 0, notExist(err)
+	}
+	return info.Size, nil
+}
+
+func (s *S3Storage) List(ctx context.Context, prefix string) (map[string]int64, error) {
+	objects := make(map[string]int64)
+	list_prefix := s.key(prefix)
+	if s.prefix != "" && prefix == "" {
+		list_prefix += "/"
+	}
+	if strings.HasSuffix(prefix, "/") {
+		list_prefix += "/"
+	}
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: list_prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		name := strings.TrimPrefix(obj.Key, s.prefix)
+		objects[strings.TrimPrefix(name, "/")] = obj.Size
+	}
+	return objects, nil
+}
+
+func (s *S3Storage) RemoveAll(ctx context.Context, prefix string) error {
+	objects, err := s.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for name := range objects {
+		if err := s.client.RemoveObject(ctx, s.bucket, s.key(name), minio.RemoveObjectOptions{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *S3Storage) String() string {
+	return fmt.Sprintf("s3://%s", path.Join(s.bucket, s.prefix))
+}
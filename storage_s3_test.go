@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an object store with a single bucket, speaking enough of the S3
+// API for S3Storage
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string][]byte
+	//Parts of the multipart uploads in progress, by upload ID
+	uploads map[string]map[int][]byte
+	//Parts of completed multipart uploads, and uploads aborted
+	parts   int
+	aborted int
+}
+
+func newFakeS3(t *testing.T, bucket string) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{bucket: bucket, objects: make(map[string][]byte), uploads: make(map[string]map[int][]byte)}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return f, server
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// body reads a request body, undoing the chunked signing of uploads over HTTP
+func body(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return ioutil.ReadAll(r.Body)
+	}
+	var data []byte
+	in := bufio.NewReader(r.Body)
+	for {
+		header, err := in.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.ParseInt(strings.SplitN(strings.TrimSpace(header), ";", 2)[0], 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return data, nil
+		}
+		chunk := make([]byte, size+2)
+		if _, err := io.ReadFull(in, chunk); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk[:size]...)
+	}
+}
+
+func s3Error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if parts[0] != f.bucket {
+		s3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	query := r.URL.Query()
+	if len(parts) == 1 || parts[1] == "" {
+		switch {
+		case r.Method == http.MethodHead:
+		case r.Method == http.MethodGet && query.Get("list-type") == "2":
+			f.list(w, query.Get("prefix"))
+		default:
+			s3Error(w, http.StatusNotImplemented, "NotImplemented")
+		}
+		return
+	}
+
+	key := parts[1]
+	upload_id := query.Get("uploadId")
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		upload_id = strconv.Itoa(len(f.uploads) + 1)
+		f.uploads[upload_id] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>", f.bucket, key, upload_id)
+	case r.Method == http.MethodPut && upload_id != "":
+		data, err := body(r)
+		if err != nil {
+			s3Error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		n, _ := strconv.Atoi(query.Get("partNumber"))
+		f.uploads[upload_id][n] = data
+		w.Header().Set("ETag", etag(data))
+	case r.Method == http.MethodPost && upload_id != "":
+		uploaded, ok := f.uploads[upload_id]
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		numbers := make([]int, 0, len(uploaded))
+		for n := range uploaded {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		var data []byte
+		for _, n := range numbers {
+			data = append(data, uploaded[n]...)
+		}
+		delete(f.uploads, upload_id)
+		f.objects[key] = data
+		f.parts += len(numbers)
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><ETag>%s</ETag></CompleteMultipartUploadResult>", f.bucket, key, etag(data))
+	case r.Method == http.MethodDelete && upload_id != "":
+		delete(f.uploads, upload_id)
+		f.aborted++
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		data, err := body(r)
+		if err != nil {
+			s3Error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		f.objects[key] = data
+		w.Header().Set("ETag", etag(data))
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("ETag", etag(data))
+		w.Header().Set("Last-Modified", time.Unix(0, 0).UTC().Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	type object struct {
+		Key          string
+		Size         int64
+		ETag         string
+		LastModified string
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Name        string
+		Prefix      string
+		KeyCount    int
+		IsTruncated bool
+		Contents    []object
+	}{Name: f.bucket, Prefix: prefix}
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		result.Contents = append(result.Contents, object{
+			Key:          key,
+			Size:         int64(len(f.objects[key])),
+			ETag:         etag(f.objects[key]),
+			LastModified: time.Unix(0, 0).UTC().Format(time.RFC3339),
+		})
+	}
+	result.KeyCount = len(keys)
+	xml.NewEncoder(w).Encode(result)
+}
+
+func TestS3Storage(t *testing.T) {
+	fake, server := newFakeS3(t, "backups")
+	s, err := NewS3Storage(StorageConfig{
+		Type:       "s3",
+		Endpoint:   strings.TrimPrefix(server.URL, "http://"),
+		Region:     "us-east-1",
+		Bucket:     "backups",
+		Prefix:     "/nutanix/",
+		Access_key: "access",
+		Secret_key: "secret",
+		Insecure:   true,
+		Part_size:  "5M",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	files := map[string][]byte{
+		//Three parts
+		"b1/scsi.0":     testDisk(1, 11*1024*1024),
+		"b1/SHA256SUMS": []byte("sums\n"),
+		"b2/scsi.0":     testDisk(2, 1000),
+	}
+	for name, data := range files {
+		w, err := s.Create(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close %s: %s", name, err)
+		}
+	}
+	if !bytes.Equal(fake.objects["nutanix/b1/scsi.0"], files["b1/scsi.0"]) {
+		t.Fatal("uploaded object differs")
+	}
+	if fake.parts != 5 {
+		t.Errorf("uploaded in %d parts, want 5", fake.parts)
+	}
+
+	w, err := s.Create(ctx, "b1/scsi.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(testDisk(3, 6*1024*1024))
+	w.Abort()
+	if _, ok := fake.objects["nutanix/b1/scsi.1"]; ok || len(fake.uploads) != 0 {
+		t.Error("aborted upload left an object or parts behind")
+	}
+
+	objects, err := s.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != len(files) {
+		t.Fatalf("listed %v", objects)
+	}
+	for name, data := range files {
+		if objects[name] != int64(len(data)) {
+			t.Errorf("listed %s with %d bytes, want %d", name, objects[name], len(data))
+		}
+	}
+	if objects, err := s.List(ctx, "b2/"); err != nil || len(objects) != 1 || objects["b2/scsi.0"] != 1000 {
+		t.Errorf("listed %v, %v under b2/", objects, err)
+	}
+
+	if size, err := s.Stat(ctx, "b1/SHA256SUMS"); err != nil || size != 5 {
+		t.Errorf("Stat: %d, %v", size, err)
+	}
+	if _, err := s.Stat(ctx, "b3/scsi.0"); !os.IsNotExist(err) {
+		t.Errorf("Stat of a missing object: %v", err)
+	}
+
+	r, err := s.Open(ctx, "b1/scsi.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(got, files["b1/scsi.0"]) {
+		t.Fatalf("read back %d bytes, %v", len(got), err)
+	}
+	if _, err := s.Open(ctx, "b3/scsi.0"); !os.IsNotExist(err) {
+		t.Errorf("Open of a missing object: %v", err)
+	}
+
+	if err := s.RemoveAll(ctx, "b1/"); err != nil {
+		t.Fatal(err)
+	}
+	if objects, err := s.List(ctx, ""); err != nil || len(objects) != 1 || objects["b2/scsi.0"] != 1000 {
+		t.Errorf("left %v, %v after removing b1", objects, err)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHStorage keeps the backups in a directory on another host, written over
+// SFTP. The connection is opened again once it is lost.
+type SSHStorage struct {
+	mu         sync.Mutex
+	host       string
+	addr       string
+	user       string
+	root       string
+	config     *ssh.ClientConfig
+	connection *ssh.Client
+	client     *sftp.Client
+}
+
+func NewSSHStorage(config StorageConfig) (*SSHStorage, error) {
+	if config.Host == "" || config.Path == "" {
+		return nil, fmt.Errorf("SSH storage needs a host and a path")
+	}
+	if config.Password == "" && config.Identity_file == "" {
+		return nil, fmt.Errorf("SSH storage needs a password or an identity_file")
+	}
+
+	auth, err := sshAuth(config.Password, config.Identity_file)
+	if err != nil {
+		return nil, err
+	}
+	host_key, err := hostKeyCallback(config.Known_hosts)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := config.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+	return &SSHStorage{
+		host: config.Host,
+		addr: addr,
+		user: config.User,
+		root: config.Path,
+		config: &ssh.ClientConfig{
+			User:            config.User,
+			Auth:            auth,
+			HostKeyCallback: host_key,
+			Timeout:         30 * time.Second,
+		},
+	}, nil
+}
+
+// sshAuth logs in with the private key in identity_file, or the password
+func sshAuth(password, identity_file string) ([]ssh.AuthMethod, error) {
+	var auth []ssh.AuthMethod
+	if identity_file != "" {
+		key, err := ioutil.ReadFile(identity_file)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse %s: %s", identity_file, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if password != "" {
+		auth = append(auth, ssh.Password(password))
+	}
+	return auth, nil
+}
+
+func (s *SSHStorage) connect() (*sftp.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client != nil {
+		return s.client, nil
+	}
+	connection, client, err := dialSFTP(s.addr, s.config)
+	if err != nil {
+		return nil, err
+	}
+	s.connection, s.client = connection, client
+	go s.drop(connection)
+	return client, nil
+}
+
+// drop forgets the connection once it is closed or lost, so a daemon
+// doesn't keep using a dead one
+func (s *SSHStorage) drop(connection *ssh.Client) {
+	connection.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.connection != connection {
+		return
+	}
+	log.Warnf("Lost the connection to %s", s)
+	s.client.Close()
+	s.connection, s.client = nil, nil
+}
+
+func (s *SSHStorage) path(name string) string {
+	return path.Join(s.root, name)
+}
+
+func (s *SSHStorage) Create(ctx context.Context, name string) (ObjectWriter, error) {
+	client, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	dst := s.path(name)
+	if err := client.MkdirAll(path.Dir(dst)); err != nil {
+		return nil, err
+	}
+	f, err := client.OpenFile(dst+partialSuffix, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return nil, err
+	}
+	return &sshWriter{File: f, client: client, dst: dst}, nil
+}
+
+type sshWriter struct {
+	*sftp.File
+	client *sftp.Client
+	dst    string
+}
+
+func (w *sshWriter) Close() error {
+	if err := w.File.Close(); err != nil {
+		w.client.Remove(w.Name())
+		return err
+	}
+	//Plain SFTP renames fail when the destination exists
+	return w.client.PosixRename(w.Name(), w.dst)
+}
+
+func (w *sshWriter) Abort() error {
+	w.File.Close()
+	return w.client.Remove(w.Name())
+}
+
+func (s *SSHStorage) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	client, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	return client.Open(s.path(name))
+}
+
+func (s *SSHStorage) Stat(ctx context.Context, name string) (int64, error) {
+	client, err := s.connect()
+	if err != nil {
+		return 0, err
+	}
+	info, err := client.Stat(s.path(name))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (s *SSHStorage) List(ctx context.Context, prefix string) (map[string]int64, error) {
+	client, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	objects := make(map[string]int64)
+	walker := client.Walk(s.path(prefix))
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		if walker.Stat().IsDir() {
+			continue
+		}
+		name := strings.TrimPrefix(walker.Path(), strings.TrimSuffix(s.root, "/")+"/")
+		objects[name] = walker.Stat().Size()
+	}
+	return objects, nil
+}
+
+func (s *SSHStorage) RemoveAll(ctx context.Context, prefix string) error {
+	client, err := s.connect()
+	if err != nil {
+		return err
+	}
+	err = client.RemoveAll(s.path(prefix))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *SSHStorage) String() string {
+	return fmt.Sprintf("%s@%s:%s", s.user, s.host, s.root)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestSSHStorage(t *testing.T, server *sftpServer) *SSHStorage {
+	s, err := NewSSHStorage(StorageConfig{
+		Type:     "ssh",
+		Host:     net.JoinHostPort(server.host(), strconv.Itoa(server.port())),
+		User:     testSSHUser,
+		Password: testSSHPassword,
+		Path:     t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSSHStorageReconnects(t *testing.T) {
+	server := newSFTPServer(t)
+	s := newTestSSHStorage(t, server)
+	ctx := context.Background()
+
+	if _, err := s.List(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+	server.drop()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		dropped := s.client == nil
+		s.mu.Unlock()
+		if dropped {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the lost connection was not dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := s.List(ctx, ""); err != nil {
+		t.Fatalf("List after the connection was lost: %s", err)
+	}
+}
+
+func TestSSHStorage(t *testing.T) {
+	server := newSFTPServer(t)
+	s := newTestSSHStorage(t, server)
+	ctx := context.Background()
+
+	files := map[string][]byte{
+		"b1/scsi.0":     testDisk(1, 300*1024),
+		"b1/SHA256SUMS": []byte("sums\n"),
+		"b2/scsi.0":     testDisk(2, 1000),
+	}
+	for name, data := range files {
+		w, err := s.Create(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close %s: %s", name, err)
+		}
+	}
+	//Written again, replacing the first copy
+	w, err := s.Create(ctx, "b2/scsi.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(files["b2/scsi.0"])
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close of an existing file: %s", err)
+	}
+	w, err = s.Create(ctx, "b1/scsi.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(testDisk(3, 1000))
+	if err := w.Abort(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadFile(filepath.Join(s.root, "b1", "scsi.0"))
+	if err != nil || !bytes.Equal(got, files["b1/scsi.0"]) {
+		t.Fatalf("stored %d bytes, %v", len(got), err)
+	}
+
+	//Nothing is left of the aborted file
+	objects, err := s.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != len(files) {
+		t.Fatalf("listed %v", objects)
+	}
+	for name, data := range files {
+		if objects[name] != int64(len(data)) {
+			t.Errorf("listed %s with %d bytes, want %d", name, objects[name], len(data))
+		}
+	}
+	if objects, err := s.List(ctx, "b3"); err != nil || len(objects) != 0 {
+		t.Errorf("listed %v, %v under a missing prefix", objects, err)
+	}
+
+	if size, err := s.Stat(ctx, "b1/SHA256SUMS"); err != nil || size != 5 {
+		t.Errorf("Stat: %d, %v", size, err)
+	}
+	if _, err := s.Stat(ctx, "b3/scsi.0"); !os.IsNotExist(err) {
+		t.Errorf("Stat of a missing file: %v", err)
+	}
+
+	r, err := s.Open(ctx, "b1/scsi.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(got, files["b1/scsi.0"]) {
+		t.Fatalf("read back %d bytes, %v", len(got), err)
+	}
+
+	if err := s.RemoveAll(ctx, "b1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RemoveAll(ctx, "b3"); err != nil {
+		t.Errorf("RemoveAll of a missing prefix: %s", err)
+	}
+	if objects, err := s.List(ctx, ""); err != nil || len(objects) != 1 || objects["b2/scsi.0"] != 1000 {
+		t.Errorf("left %v, %v after removing b1", objects, err)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const summaryFile = "backup_summary.txt"
+
+const (
+	statusOK          = "ok"
+	statusFailed      = "failed"
+	statusSkipped     = "skipped"
+	statusInterrupted = "interrupted"
+	//Set by verify when a disk image does not match its checksum
+	statusCorrupt = "corrupt"
+)
+
+// BackupResult describes the outcome of backing up a single VM
+type BackupResult struct {
+	VM          string
+	Status      string
+	Error       string
+	Snapshot    string
+	BytesCopied int64
+	Duration    time.Duration
+}
+
+// writeSummary prints a table of the results and writes it to backup_root
+func writeSummary(results []BackupResult) {
+	path := filepath.Join(BackupConfig.Backup_root, summaryFile)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		log.Errorf("Unable to write summary to %s: %s", path, err)
+		printSummary(os.Stdout, results)
+		return
+	}
+	defer f.Close()
+
+	fmt.Fprintf(f, "Backup run finished %s\n\n", time.Now().Format(time.RFC3339))
+	printSummary(io.MultiWriter(os.Stdout, f), results)
+	log.Infof("Summary written to %s", path)
+}
+
+func printSummary(out io.Writer, results []BackupResult) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VM\tSTATUS\tCOPIED\tDURATION\tSNAPSHOT\tERROR")
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", r.VM, r.Status, formatBytes(r.BytesCopied),
+			r.Duration.Round(time.Second), r.Snapshot, r.Error)
+	}
+	w.Flush()
+}
@@ -0,0 +1,652 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/loginoff/nutanix-backup/nutanixapi"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Paths of vdisks read with the userspace NFS client start with this,
+// followed by the container and the path in it
+const unfsPrefix = "unfs:"
+
+// ONC RPC programs, RFC 1833 and RFC 1813
+const (
+	portmapPort    = 111
+	portmapProgram = 100000
+	portmapVersion = 2
+	mountProgram   = 100005
+	mountVersion   = 3
+	nfsProgram     = 100003
+	nfsVersion     = 3
+	nfsDefaultPort = 2049
+)
+
+const (
+	portmapGetPort = 3
+	mountMnt       = 1
+	mountUmnt      = 3
+	nfsGetattr     = 1
+	nfsLookup      = 3
+	nfsRead        = 6
+	nfsFsinfo      = 19
+)
+
+// Largest read requested from the server, FSINFO may lower it
+const nfsMaxRead = 1024 * 1024
+
+// How long a single call may take
+const rpcTimeout = 60 * time.Second
+
+// UserNFSAccess reads the containers with an NFSv3 client of its own, so it
+// needs neither root nor mounts. The exports must accept requests from
+// unprivileged ports. Every container gets a connection, opened on first use
+// and shared by the backups running in parallel, which take turns on it. A
+// connection that fails is closed and the export mounted again on next use.
+type UserNFSAccess struct {
+	mu      sync.Mutex
+	names   *containerNames
+	server  string
+	exports map[string]*nfsExport
+}
+
+type nfsExport struct {
+	name    string
+	root    []byte
+	client  *rpcClient
+	maxRead int
+	//Forgets the export once its connection failed, nil while it is mounted
+	access *UserNFSAccess
+}
+
+func NewUserNFSAccess(ntnx *nutanixapi.Client, server string) *UserNFSAccess {
+	return &UserNFSAccess{
+		names:   newContainerNames(ntnx),
+		server:  server,
+		exports: make(map[string]*nfsExport),
+	}
+}
+
+func (a *UserNFSAccess) Root(UUID string) (string, error) {
+	cname, err := a.names.name(UUID)
+	if err != nil {
+		return "", err
+	}
+	return unfsPrefix + "/" + cname, nil
+}
+
+func (a *UserNFSAccess) Prefix() string {
+	return unfsPrefix
+}
+
+// export returns the connection to the export of a container, mounting it
+// with the MOUNT protocol when there is none yet
+func (a *UserNFSAccess) export(cname string) (*nfsExport, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if e, ok := a.exports[cname]; ok {
+		return e, nil
+	}
+
+	log.Infof("Connecting to %s:/%s with the userspace NFS client", a.server, cname)
+	mount_port, err := getPort(a.server, mountProgram, mountVersion)
+	if err != nil {
+		return nil, err
+	}
+	mountd, err := dialRPC(net.JoinHostPort(a.server, strconv.Itoa(mount_port)), mountProgram, mountVersion)
+	if err != nil {
+		return nil, err
+	}
+	defer mountd.Close()
+	args := &xdrWriter{}
+	args.string("/" + cname)
+	r, err := mountd.call(mountMnt, args.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if status := r.uint32(); status != 0 {
+		return nil, fmt.Errorf("Unable to mount %s:/%s: %s", a.server, cname, nfsError(status))
+	}
+	root := r.opaque()
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	nfs_port, err := getPort(a.server, nfsProgram, nfsVersion)
+	if err != nil || nfs_port == 0 {
+		nfs_port = nfsDefaultPort
+	}
+	client, err := dialRPC(net.JoinHostPort(a.server, strconv.Itoa(nfs_port)), nfsProgram, nfsVersion)
+	if err != nil {
+		return nil, err
+	}
+	e := &nfsExport{name: cname, root: root, client: client, maxRead: nfsMaxRead}
+	rtmax, err := e.fsinfo()
+	if e.client.failed() != nil {
+		return nil, err
+	}
+	if err == nil && rtmax > 0 && rtmax < e.maxRead {
+		e.maxRead = rtmax
+	}
+	e.access = a
+	a.exports[cname] = e
+	return e, nil
+}
+
+// forget drops an export whose connection failed, so the next use mounts it
+// again
+func (a *UserNFSAccess) forget(e *nfsExport) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.exports[e.name] == e {
+		log.Warnf("Lost the connection to %s:/%s: %s", a.server, e.name, e.client.failed())
+		delete(a.exports, e.name)
+	}
+}
+
+// resolve looks up a path of the form /container/dir/file
+func (a *UserNFSAccess) resolve(p string) (*nfsExport, []byte, *nfsFileInfo, error) {
+	parts := strings.Split(strings.Trim(path.Clean(p), "/"), "/")
+	if parts[0] == "" {
+		return nil, nil, nil, fmt.Errorf("%s%s is not a path on a container", unfsPrefix, p)
+	}
+	e, err := a.export(parts[0])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	fh := e.root
+	for _, name := range parts[1:] {
+		if fh, err = e.lookup(fh, name); err != nil {
+			return nil, nil, nil, &os.PathError{Op: "lookup", Path: unfsPrefix + p, Err: err}
+		}
+	}
+	info, err := e.getattr(fh)
+	if err != nil {
+		return nil, nil, nil, &os.PathError{Op: "stat", Path: unfsPrefix + p, Err: err}
+	}
+	info.name = path.Base(p)
+	return e, fh, info, nil
+}
+
+func (a *UserNFSAccess) Open(p string) (SourceFile, error) {
+	e, fh, info, err := a.resolve(p)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("%s%s is a directory", unfsPrefix, p)
+	}
+	return &nfsFile{export: e, fh: fh, name: unfsPrefix + p, info: info}, nil
+}
+
+func (a *UserNFSAccess) Stat(p string) (os.FileInfo, error) {
+	_, _, info, err := a.resolve(p)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Release unmounts the exports and closes the connections
+func (a *UserNFSAccess) Release() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for cname, e := range a.exports {
+		e.client.Close()
+		delete(a.exports, cname)
+		//Only tells the server the export is no longer in use
+		if mount_port, err := getPort(a.server, mountProgram, mountVersion); err == nil {
+			if mountd, err := dialRPC(net.JoinHostPort(a.server, strconv.Itoa(mount_port)), mountProgram, mountVersion); err == nil {
+				args := &xdrWriter{}
+				args.string("/" + cname)
+				mountd.call(mountUmnt, args.Bytes())
+				mountd.Close()
+			}
+		}
+	}
+	return nil
+}
+
+// call makes a call on the connection of the export
+func (e *nfsExport) call(proc uint32, args []byte) (*xdrReader, error) {
+	r, err := e.client.call(proc, args)
+	if err != nil && e.access != nil && e.client.failed() != nil {
+		e.access.forget(e)
+	}
+	return r, err
+}
+
+func (e *nfsExport) lookup(dir []byte, name string) ([]byte, error) {
+	args := &xdrWriter{}
+	args.opaque(dir)
+	args.string(name)
+	r, err := e.call(nfsLookup, args.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if status := r.uint32(); status != 0 {
+		return nil, nfsError(status)
+	}
+	fh := r.opaque()
+	return fh, r.err
+}
+
+func (e *nfsExport) getattr(fh []byte) (*nfsFileInfo, error) {
+	args := &xdrWriter{}
+	args.opaque(fh)
+	r, err := e.call(nfsGetattr, args.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if status := r.uint32(); status != 0 {
+		return nil, nfsError(status)
+	}
+	info := r.fattr()
+	return info, r.err
+}
+
+// fsinfo returns the largest read the server supports
+func (e *nfsExport) fsinfo() (int, error) {
+	args := &xdrWriter{}
+	args.opaque(e.root)
+	r, err := e.call(nfsFsinfo, args.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	if status := r.uint32(); status != 0 {
+		return 0, nfsError(status)
+	}
+	r.postOpAttr()
+	rtmax := r.uint32()
+	return int(rtmax), r.err
+}
+
+func (e *nfsExport) read(fh []byte, offset int64, count int) (data []byte, eof bool, err error) {
+	args := &xdrWriter{}
+	args.opaque(fh)
+	args.uint64(uint64(offset))
+	args.uint32(uint32(count))
+	r, err := e.call(nfsRead, args.Bytes())
+	if err != nil {
+		return nil, false, err
+	}
+	return r.readResult()
+}
+
+// nfsFile is a file opened with the userspace NFS client. NFSv3 is
+// stateless, so there is nothing to close.
+type nfsFile struct {
+	export *nfsExport
+	fh     []byte
+	name   string
+	info   *nfsFileInfo
+	offset int64
+}
+
+func (f *nfsFile) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		count := len(p) - n
+		if count > f.export.maxRead {
+			count = f.export.maxRead
+		}
+		data, eof, err := f.export.read(f.fh, off+int64(n), count)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], data)
+		if eof || len(data) == 0 {
+			if n < len(p) {
+				return n, io.EOF
+			}
+			break
+		}
+	}
+	return n, nil
+}
+
+func (f *nfsFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *nfsFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.size
+	default:
+		return 0, fmt.Errorf("Invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("Negative offset %d", offset)
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *nfsFile) Close() error {
+	return nil
+}
+
+func (f *nfsFile) Name() string {
+	return f.name
+}
+
+func (f *nfsFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+type nfsFileInfo struct {
+	name  string
+	size  int64
+	mode  os.FileMode
+	mtime time.Time
+}
+
+func (i *nfsFileInfo) Name() string       { return i.name }
+func (i *nfsFileInfo) Size() int64        { return i.size }
+func (i *nfsFileInfo) Mode() os.FileMode  { return i.mode }
+func (i *nfsFileInfo) ModTime() time.Time { return i.mtime }
+func (i *nfsFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *nfsFileInfo) Sys() interface{}   { return nil }
+
+// nfsError turns nfsstat3 and mountstat3 codes into errors
+func nfsError(status uint32) error {
+	switch status {
+	case 1, 13:
+		return os.ErrPermission
+	case 2:
+		return os.ErrNotExist
+	case 5:
+		return fmt.Errorf("I/O error")
+	case 20:
+		return fmt.Errorf("Not a directory")
+	case 70:
+		return fmt.Errorf("Stale file handle")
+	}
+	return fmt.Errorf("NFS error %d", status)
+}
+
+// getPort asks the portmapper of the server for the TCP port of a program
+func getPort(server string, program, version uint32) (int, error) {
+	portmap, err := dialRPC(net.JoinHostPort(server, strconv.Itoa(portmapPort)), portmapProgram, portmapVersion)
+	if err != nil {
+		return 0, err
+	}
+	defer portmap.Close()
+
+	args := &xdrWriter{}
+	args.uint32(program)
+	args.uint32(version)
+	//TCP
+	args.uint32(6)
+	args.uint32(0)
+	r, err := portmap.call(portmapGetPort, args.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	port := r.uint32()
+	if r.err == nil && port == 0 {
+		return 0, fmt.Errorf("Program %d version %d is not registered on %s", program, version, server)
+	}
+	return int(port), r.err
+}
+
+// rpcClient makes ONC RPC calls (RFC 5531) over TCP, one at a time. The
+// first error on the connection closes it, the replies can't be matched to
+// the calls after one.
+type rpcClient struct {
+	mu      sync.Mutex
+	conn    net.Conn
+	program uint32
+	version uint32
+	xid     uint32
+	//Why the connection was closed
+	err error
+}
+
+func dialRPC(addr string, program, version uint32) (*rpcClient, error) {
+	conn, err := net.DialTimeout("tcp", addr, 30*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to %s: %s", addr, err)
+	}
+	return &rpcClient{conn: conn, program: program, version: version, xid: uint32(time.Now().UnixNano())}, nil
+}
+
+func (c *rpcClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return nil
+	}
+	c.err = fmt.Errorf("Connection closed")
+	return c.conn.Close()
+}
+
+// failed returns why the connection was closed, or nil while it is open
+func (c *rpcClient) failed() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// fail closes the connection after an error on it
+func (c *rpcClient) fail(err error) error {
+	c.err = err
+	c.conn.Close()
+	return err
+}
+
+// call sends a call and returns a reader positioned at the results
+func (c *rpcClient) call(proc uint32, args []byte) (*xdrReader, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return nil, c.err
+	}
+	c.xid++
+	msg := &xdrWriter{}
+	msg.uint32(c.xid)
+	//CALL, RPC version 2
+	msg.uint32(0)
+	msg.uint32(2)
+	msg.uint32(c.program)
+	msg.uint32(c.version)
+	msg.uint32(proc)
+	//AUTH_SYS as root, servers map it as they are configured to
+	cred := &xdrWriter{}
+	cred.uint32(uint32(time.Now().Unix()))
+	cred.string("nutanix-backup")
+	cred.uint32(0)
+	cred.uint32(0)
+	cred.uint32(0)
+	msg.uint32(1)
+	msg.opaque(cred.Bytes())
+	//AUTH_NONE verifier
+	msg.uint32(0)
+	msg.uint32(0)
+	msg.Write(args)
+
+	c.conn.SetDeadline(time.Now().Add(rpcTimeout))
+	//A single record, with the last fragment bit set
+	record := make([]byte, 4, 4+msg.Len())
+	binary.BigEndian.PutUint32(record, uint32(msg.Len())|1<<31)
+	if _, err := c.conn.Write(append(record, msg.Bytes()...)); err != nil {
+		return nil, c.fail(err)
+	}
+
+	for {
+		reply, err := c.readRecord()
+		if err != nil {
+			return nil, c.fail(err)
+		}
+		r := &xdrReader{b: reply}
+		if r.uint32() != c.xid {
+			//Reply to a call that timed out
+			continue
+		}
+		if r.uint32() != 1 {
+			return nil, c.fail(fmt.Errorf("Malformed RPC reply"))
+		}
+		if r.uint32() != 0 {
+			return nil, fmt.Errorf("RPC call to program %d denied", c.program)
+		}
+		r.uint32()
+		r.opaque()
+		if status := r.uint32(); status != 0 {
+			return nil, fmt.Errorf("RPC call to program %d failed with status %d", c.program, status)
+		}
+		return r, r.err
+	}
+}
+
+func (c *rpcClient) readRecord() ([]byte, error) {
+	var record []byte
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(c.conn, header[:]); err != nil {
+			return nil, err
+		}
+		h := binary.BigEndian.Uint32(header[:])
+		fragment := make([]byte, h&^(1<<31))
+		if _, err := io.ReadFull(c.conn, fragment); err != nil {
+			return nil, err
+		}
+		record = append(record, fragment...)
+		if h&(1<<31) != 0 {
+			return record, nil
+		}
+	}
+}
+
+// xdrWriter encodes XDR (RFC 4506)
+type xdrWriter struct {
+	bytes.Buffer
+}
+
+func (w *xdrWriter) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	w.Write(b[:])
+}
+
+func (w *xdrWriter) uint64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	w.Write(b[:])
+}
+
+func (w *xdrWriter) opaque(data []byte) {
+	w.uint32(uint32(len(data)))
+	w.Write(data)
+	w.Write(make([]byte, (4-len(data)%4)%4))
+}
+
+func (w *xdrWriter) string(s string) {
+	w.opaque([]byte(s))
+}
+
+// xdrReader decodes XDR. The first error sticks, later reads return zeroes.
+type xdrReader struct {
+	b   []byte
+	err error
+}
+
+func (r *xdrReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.b) < n {
+		r.err = fmt.Errorf("Short XDR message")
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *xdrReader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *xdrReader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *xdrReader) bool() bool {
+	return r.uint32() != 0
+}
+
+func (r *xdrReader) opaque() []byte {
+	n := int(r.uint32())
+	data := r.next(n)
+	r.next((4 - n%4) % 4)
+	return data
+}
+
+// fattr reads the fattr3 attributes of a file
+func (r *xdrReader) fattr() *nfsFileInfo {
+	ftype := r.uint32()
+	mode := os.FileMode(r.uint32() & 0777)
+	if ftype == 2 {
+		mode |= os.ModeDir
+	}
+	//nlink, uid, gid
+	r.next(12)
+	size := r.uint64()
+	//used, rdev, fsid, fileid, atime
+	r.next(8 + 8 + 8 + 8 + 8)
+	mtime := time.Unix(int64(r.uint32()), int64(r.uint32()))
+	//ctime
+	r.next(8)
+	return &nfsFileInfo{size: int64(size), mode: mode, mtime: mtime}
+}
+
+// postOpAttr skips optional attributes
+func (r *xdrReader) postOpAttr() {
+	if r.bool() {
+		r.fattr()
+	}
+}
+
+// readResult reads the READ3res results of a READ call
+func (r *xdrReader) readResult() (data []byte, eof bool, err error) {
+	if status := r.uint32(); status != 0 {
+		return nil, false, nfsError(status)
+	}
+	r.postOpAttr()
+	r.uint32()
+	eof = r.bool()
+	data = r.opaque()
+	return data, eof, r.err
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeFattr encodes the fattr3 attributes of a file
+func writeFattr(w *xdrWriter, ftype uint32, mode uint32, size uint64, mtime time.Time) {
+	w.uint32(ftype)
+	w.uint32(mode)
+	//nlink, uid, gid
+	w.uint32(1)
+	w.uint32(0)
+	w.uint32(0)
+	w.uint64(size)
+	//used, rdev, fsid, fileid, atime
+	w.uint64(size)
+	w.uint64(0)
+	w.uint64(1)
+	w.uint64(2)
+	w.uint64(0)
+	w.uint32(uint32(mtime.Unix()))
+	w.uint32(uint32(mtime.Nanosecond()))
+	//ctime
+	w.uint64(0)
+}
+
+// writeRecord sends msg as a record split in fragments of at most fragment bytes
+func writeRecord(w io.Writer, msg []byte, fragment int) error {
+	for {
+		n := len(msg)
+		header := uint32(n) | 1<<31
+		if n > fragment {
+			n = fragment
+			header = uint32(n)
+		}
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], header)
+		if _, err := w.Write(append(b[:], msg[:n]...)); err != nil {
+			return err
+		}
+		msg = msg[n:]
+		if header&(1<<31) != 0 {
+			return nil
+		}
+	}
+}
+
+func TestXDR(t *testing.T) {
+	w := &xdrWriter{}
+	w.uint32(7)
+	w.uint64(1 << 40)
+	w.uint32(1)
+	for _, s := range []string{"", "a", "ab", "abc", "abcd", "abcde"} {
+		w.string(s)
+	}
+	if w.Len()%4 != 0 {
+		t.Fatalf("XDR message of %d bytes is not padded", w.Len())
+	}
+
+	r := &xdrReader{b: w.Bytes()}
+	if v := r.uint32(); v != 7 {
+		t.Errorf("uint32 %d, want 7", v)
+	}
+	if v := r.uint64(); v != 1<<40 {
+		t.Errorf("uint64 %d, want %d", v, uint64(1<<40))
+	}
+	if !r.bool() {
+		t.Error("bool false, want true")
+	}
+	for _, s := range []string{"", "a", "ab", "abc", "abcd", "abcde"} {
+		if got := string(r.opaque()); got != s {
+			t.Errorf("opaque %q, want %q", got, s)
+		}
+	}
+	if r.err != nil || len(r.b) != 0 {
+		t.Fatalf("%d bytes left, error %v", len(r.b), r.err)
+	}
+
+	//Errors stick
+	r.uint32()
+	if r.err == nil {
+		t.Fatal("read past the end without an error")
+	}
+	if v := (&xdrReader{b: []byte{0, 0, 0, 9, 'x'}}).opaque(); v != nil {
+		t.Fatalf("short opaque read as %q", v)
+	}
+}
+
+func TestXDRFattr(t *testing.T) {
+	mtime := time.Unix(1700000000, 500)
+	tests := []struct {
+		name  string
+		ftype uint32
+		mode  uint32
+		want  os.FileMode
+	}{
+		{name: "file", ftype: 1, mode: 0640, want: 0640},
+		{name: "directory", ftype: 2, mode: 0755, want: os.ModeDir | 0755},
+		{name: "setuid bits dropped", ftype: 1, mode: 04755, want: 0755},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := &xdrWriter{}
+			writeFattr(w, test.ftype, test.mode, 12345, mtime)
+			w.uint32(99)
+
+			r := &xdrReader{b: w.Bytes()}
+			info := r.fattr()
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			if info.Size() != 12345 || info.Mode() != test.want || !info.ModTime().Equal(mtime) {
+				t.Fatalf("size %d, mode %s, mtime %s", info.Size(), info.Mode(), info.ModTime())
+			}
+			if v := r.uint32(); v != 99 {
+				t.Fatalf("fattr3 not read whole, next value %d", v)
+			}
+		})
+	}
+}
+
+func TestXDRReadResult(t *testing.T) {
+	tests := []struct {
+		name   string
+		status uint32
+		attr   bool
+		eof    bool
+		data   []byte
+		ok     bool
+	}{
+		{name: "data", attr: true, data: []byte("hello"), ok: true},
+		{name: "without attributes", data: []byte("hello"), ok: true},
+		{name: "end of file", attr: true, eof: true, data: []byte("hi"), ok: true},
+		{name: "empty at end of file", eof: true, data: []byte{}, ok: true},
+		{name: "stale handle", status: 70},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := &xdrWriter{}
+			w.uint32(test.status)
+			if test.status == 0 {
+				w.uint32(boolValue(test.attr))
+				if test.attr {
+					writeFattr(w, 1, 0640, 100, time.Now())
+				}
+				w.uint32(uint32(len(test.data)))
+				w.uint32(boolValue(test.eof))
+				w.opaque(test.data)
+			}
+
+			data, eof, err := (&xdrReader{b: w.Bytes()}).readResult()
+			if !test.ok {
+				if err == nil {
+					t.Fatal("no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, test.data) || eof != test.eof {
+				t.Fatalf("read %q eof %v, want %q eof %v", data, eof, test.data, test.eof)
+			}
+		})
+	}
+}
+
+func boolValue(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func TestReadRecord(t *testing.T) {
+	msg := bytes.Repeat([]byte("0123456789"), 10)
+	for _, fragment := range []int{1000, 100, 33, 1} {
+		client, server := net.Pipe()
+		go func() {
+			writeRecord(server, msg, fragment)
+			server.Close()
+		}()
+		got, err := (&rpcClient{conn: client}).readRecord()
+		client.Close()
+		if err != nil {
+			t.Fatalf("fragments of %d: %s", fragment, err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("fragments of %d: read %q", fragment, got)
+		}
+	}
+
+	//Cut off in the middle of a fragment
+	client, server := net.Pipe()
+	go func() {
+		server.Write([]byte{0x80, 0, 0, 10, 'a', 'b'})
+		server.Close()
+	}()
+	if _, err := (&rpcClient{conn: client}).readRecord(); err == nil {
+		t.Fatal("read a truncated record")
+	}
+}
+
+// fakeNFS serves a single file to READ and GETATTR calls
+type fakeNFS struct {
+	listener net.Listener
+	data     []byte
+	mu       sync.Mutex
+	conns    []net.Conn
+	//Largest READ reply, and the READs asked for
+	maxRead int
+	reads   int
+}
+
+func newFakeNFS(t *testing.T, data []byte) *fakeNFS {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeNFS{listener: listener, data: data, maxRead: len(data)}
+	t.Cleanup(func() {
+		listener.Close()
+		f.drop()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.conns = append(f.conns, conn)
+			f.mu.Unlock()
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+// drop cuts the connections
+func (f *fakeNFS) drop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+	f.conns = nil
+}
+
+func (f *fakeNFS) serve(conn net.Conn) {
+	in := &rpcClient{conn: conn}
+	for {
+		msg, err := in.readRecord()
+		if err != nil {
+			return
+		}
+		r := &xdrReader{b: msg}
+		xid := r.uint32()
+		//CALL, RPC version, program, version
+		r.next(16)
+		proc := r.uint32()
+		//Credentials and verifier
+		r.uint32()
+		r.opaque()
+		r.uint32()
+		r.opaque()
+		r.opaque()
+
+		reply := &xdrWriter{}
+		//A reply to an earlier call first, which the client skips
+		reply.uint32(xid - 1)
+		reply.uint32(1)
+		reply.uint32(0)
+		reply.uint32(0)
+		reply.opaque(nil)
+		reply.uint32(0)
+		writeRecord(conn, reply.Bytes(), 1<<20)
+
+		reply.Reset()
+		reply.uint32(xid)
+		//REPLY, MSG_ACCEPTED, AUTH_NONE verifier, SUCCESS
+		reply.uint32(1)
+		reply.uint32(0)
+		reply.uint32(0)
+		reply.opaque(nil)
+		reply.uint32(0)
+		switch proc {
+		case nfsGetattr:
+			reply.uint32(0)
+			writeFattr(reply, 1, 0640, uint64(len(f.data)), time.Unix(0, 0))
+		case nfsRead:
+			offset := int(r.uint64())
+			count := int(r.uint32())
+			f.mu.Lock()
+			f.reads++
+			f.mu.Unlock()
+			if count > f.maxRead {
+				count = f.maxRead
+			}
+			if offset > len(f.data) {
+				offset = len(f.data)
+			}
+			if offset+count > len(f.data) {
+				count = len(f.data) - offset
+			}
+			reply.uint32(0)
+			reply.uint32(0)
+			reply.uint32(uint32(count))
+			reply.uint32(boolValue(offset+count == len(f.data)))
+			reply.opaque(f.data[offset : offset+count])
+		default:
+			//NFS3ERR_NOTSUPP
+			reply.uint32(10004)
+		}
+		//Small fragments, so replies are put together from several
+		if err := writeRecord(conn, reply.Bytes(), 4096); err != nil {
+			return
+		}
+	}
+}
+
+// mount stands in for the MOUNT protocol, which needs the portmapper
+func (f *fakeNFS) mount(t *testing.T, a *UserNFSAccess, cname string) *nfsExport {
+	client, err := dialRPC(f.listener.Addr().String(), nfsProgram, nfsVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &nfsExport{name: cname, root: []byte("root"), client: client, maxRead: 1000, access: a}
+	a.exports[cname] = e
+	return e
+}
+
+func TestUserNFSRead(t *testing.T) {
+	data := testDisk(3, 10000)
+	server := newFakeNFS(t, data)
+	//Replies shorter than asked for are read on from where they stop
+	server.maxRead = 700
+	access := NewUserNFSAccess(nil, "127.0.0.1")
+	e := server.mount(t, access, "ctr1")
+	defer access.Release()
+
+	info, err := e.getattr(e.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(len(data)) {
+		t.Fatalf("size %d, want %d", info.Size(), len(data))
+	}
+
+	f := &nfsFile{export: e, fh: e.root, name: unfsPrefix + "/ctr1/vdisk", info: info}
+	buf := make([]byte, 3000)
+	n, err := f.ReadAt(buf, 9000)
+	if n != 1000 || err != io.EOF {
+		t.Fatalf("read %d bytes at the end, error %v", n, err)
+	}
+	if !bytes.Equal(buf[:n], data[9000:]) {
+		t.Fatal("read different data at the end")
+	}
+
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("read different data")
+	}
+	if server.reads < len(data)/server.maxRead {
+		t.Fatalf("%d READs for %d bytes", server.reads, len(data))
+	}
+}
+
+func TestUserNFSForgetsFailedExport(t *testing.T) {
+	server := newFakeNFS(t, testDisk(4, 4096))
+	access := NewUserNFSAccess(nil, "127.0.0.1")
+	e := server.mount(t, access, "ctr1")
+	defer access.Release()
+
+	if _, err := e.getattr(e.root); err != nil {
+		t.Fatal(err)
+	}
+	server.drop()
+	if _, err := e.getattr(e.root); err == nil {
+		t.Fatal("call on a dropped connection succeeded")
+	}
+	if e.client.failed() == nil {
+		t.Fatal("the failed connection was not closed")
+	}
+	if _, ok := access.exports["ctr1"]; ok {
+		t.Fatal("the export of the failed connection was kept")
+	}
+	if _, err := e.getattr(e.root); err == nil {
+		t.Fatal("call on a closed connection succeeded")
+	}
+}
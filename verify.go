@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/loginoff/nutanix-backup/nutanixapi"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Checksums of the disk images in a backup directory, in the format of sha256sum
+const manifestFile = "SHA256SUMS"
+
+func writeManifest(backup_path string, disks []CatalogDisk) error {
+	f, err := os.OpenFile(filepath.Join(backup_path, manifestFile), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for _, disk := range disks {
+		if _, err := fmt.Fprintf(f, "%s  %s\n", disk.Checksum, disk.Name); err != nil {
+			return err
+		}
+	}
+	return f.Sync()
+}
+
+// readManifest returns the checksums by disk name
+func readManifest(backup_path string) (map[string]string, error) {
+	f, err := os.Open(filepath.Join(backup_path, manifestFile))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Malformed line in %s: %q", f.Name(), scanner.Text())
+		}
+		sums[strings.TrimPrefix(fields[1], "*")] = fields[0]
+	}
+	return sums, scanner.Err()
+}
+
+// hashFile computes the SHA-256 checksum of a file, skipping over its holes
+func hashFile(ctx context.Context, path string, limiter *RateLimiter) (string, error) {
+	f, err := openSource(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	size := info.Size()
+
+	sum := sha256.New()
+	buf := make([]byte, copyChunkSize)
+	var offset int64
+	for offset < size {
+		data, end, err := dataRegion(f, offset, size)
+		if err != nil {
+			return "", err
+		}
+		hashZeroes(sum, data-offset)
+		offset = data
+
+		for offset < end {
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+			n := end - offset
+			if n > copyChunkSize {
+				n = copyChunkSize
+			}
+			if err := limiter.Wait(ctx, int(n)); err != nil {
+				return "", err
+			}
+			read, err := f.ReadAt(buf[:n], offset)
+			if int64(read) < n {
+				if err == nil || err == io.EOF {
+					err = fmt.Errorf("%s shrank while reading", path)
+				}
+				return "", err
+			}
+			sum.Write(buf[:n])
+			offset += n
+		}
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// backupChecksums returns the checksums recorded for a backup, from its manifest
+// or, for backups without one, from the catalog
+func backupChecksums(name string) (map[string]string, error) {
+	sums, err := readManifest(filepath.Join(BackupConfig.Backup_root, name))
+	if err == nil || !os.IsNotExist(err) {
+		return sums, err
+	}
+
+	entry, ok := catalog.Get(name)
+	if !ok {
+		return nil, fmt.Errorf("No checksums recorded for %s", name)
+	}
+	sums = make(map[string]string)
+	for _, disk := range entry.Disks {
+		sums[disk.Name] = disk.Checksum
+	}
+	return sums, nil
+}
+
+// sourceChecksum hashes the vdisk in the snapshot a backup was taken from,
+// if the snapshot still exists
+func sourceChecksum(ctx context.Context, snapshots []nutanixapi.AHVSnapshotInfo, backup_path, disk string) (string, error) {
+	snapshot_info, err := ReadSnapshotInfo(filepath.Join(backup_path, "ahv_vm"))
+	if err != nil {
+		return "", err
+	}
+
+	found := false
+	for _, snap := range snapshots {
+		if snap.UUID == snapshot_info.UUID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return "", nil
+	}
+
+	container_uuid, disk_container_path, ok := snapshotDiskPath(snapshot_info, disk)
+	if !ok {
+		return "", fmt.Errorf("Disk %s not found in snapshot %s", disk, snapshot_info.UUID)
+	}
+	container_root, err := containers.Root(container_uuid)
+	if err != nil {
+		return "", err
+	}
+	return hashFile(ctx, filepath.Join(container_root, disk_container_path), bandwidth)
+}
+
+func runVerify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	source := fs.Bool("source", false, "Also compare against the source vdisks, for backups whose snapshot still exists")
+	fs.Parse(args)
+
+	//Keeps backups from being written or pruned while they are verified
+	lock := lockBackupRoot()
+	defer lock.Release()
+
+	names := fs.Args()
+	if len(names) == 0 {
+		backups, err := listBackups(BackupConfig.Backup_root)
+		if err != nil {
+			log.Fatal(err)
+		}
+		//Failed and interrupted backups have nothing to verify against
+		var incomplete []string
+		for _, b := range backups {
+			if !b.Complete {
+				incomplete = append(incomplete, b.Name)
+				continue
+			}
+			names = append(names, b.Name)
+		}
+		if len(incomplete) > 0 {
+			log.Warnf("Not verifying %d incomplete backups: %s", len(incomplete), strings.Join(incomplete, ", "))
+		}
+	}
+
+	ctx := context.Background()
+	var snapshots []nutanixapi.AHVSnapshotInfo
+	if *source {
+		ntnx := connect()
+		var err error
+		snapshots, err = ntnx.GetSnapshots()
+		if err != nil {
+			log.Fatalf("Unable to retrieve snapshots from PRISM %s", err)
+		}
+		containers, err = newContainerAccess(ntnx, false)
+		if err != nil {
+			log.Fatalf("Unable to access the containers: %s", err)
+		}
+		defer containers.Release()
+		bandwidth = bandwidthLimiter()
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "BACKUP\tDISK\tIMAGE\tSOURCE")
+	failed := 0
+	for _, name := range names {
+		backup_path := filepath.Join(BackupConfig.Backup_root, name)
+		sums, err := backupChecksums(name)
+		if err != nil {
+			log.Errorf("Unable to verify %s: %s", name, err)
+			failed++
+			continue
+		}
+
+		disks := make([]string, 0, len(sums))
+		for disk := range sums {
+			disks = append(disks, disk)
+		}
+		sort.Strings(disks)
+
+		status := statusOK
+		problems := false
+		for _, disk := range disks {
+			checksum := sums[disk]
+			image, source_result := "ok", "-"
+
+			log.Infof("Verifying %s/%s", name, disk)
+			sum, err := hashBackupFile(ctx, backup_path, disk)
+			switch {
+			case os.IsNotExist(err):
+				image = "MISSING"
+			case err != nil:
+				image = "ERROR: " + err.Error()
+			case sum != checksum:
+				image = "CORRUPT"
+			}
+
+			//Compressed and encrypted files must also decompress and decrypt to what was stored
+			source_disk, source_checksum := disk, checksum
+			if plainName(disk) != disk {
+				source_disk = plainName(disk)
+				if meta, err := readBackupMeta(backup_path); err == nil && meta.Checksums[disk] != "" {
+					source_checksum = meta.Checksums[disk]
+					if image == "ok" {
+						sum, err := hashStoredFile(ctx, backup_path, disk)
+						if err != nil {
+							image = "CORRUPT: " + err.Error()
+						} else if sum != source_checksum {
+							image = "CORRUPT"
+						}
+					}
+				}
+			}
+
+			//Deltas and indexes are compared by the checksum of the image they make up
+			if strings.HasSuffix(source_disk, deltaSuffix) {
+				source_disk = strings.TrimSuffix(source_disk, deltaSuffix)
+				if chain, err := readChain(backup_path); err == nil {
+					source_checksum = chain.Disks[source_disk].Checksum
+				}
+			}
+			if strings.HasSuffix(disk, indexSuffix) && image == "ok" {
+				source_disk = strings.TrimSuffix(disk, indexSuffix)
+				sum, recorded, err := hashIndexedImage(ctx, filepath.Join(backup_path, disk))
+				if _, corrupt := err.(*ChunkCorruptError); corrupt {
+					image = "CORRUPT"
+				} else if os.IsNotExist(err) {
+					image = "MISSING"
+				} else if err != nil {
+					image = "ERROR: " + err.Error()
+				} else if sum != recorded {
+					image = "CORRUPT"
+				}
+				source_checksum = recorded
+			}
+
+			if *source {
+				source_sum, err := sourceChecksum(ctx, snapshots, backup_path, source_disk)
+				switch {
+				case err != nil:
+					source_result = "ERROR: " + err.Error()
+				case source_sum == "":
+					source_result = "snapshot deleted"
+				case source_sum != source_checksum:
+					source_result = "MISMATCH"
+				default:
+					source_result = "ok"
+				}
+			}
+
+			if strings.HasPrefix(image, "CORRUPT") || image == "MISSING" || source_result == "MISMATCH" {
+				status = statusCorrupt
+			}
+			if image != "ok" || strings.HasPrefix(source_result, "ERROR") {
+				problems = true
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", name, disk, image, source_result)
+		}
+
+		if problems || status != statusOK {
+			failed++
+		}
+		//Errors reading the images say nothing about their state
+		if status == statusCorrupt || !problems {
+			if err := catalog.SetVerified(name, status, time.Now()); err != nil {
+				log.Errorf("Unable to update catalog: %s", err)
+			}
+		}
+	}
+	w.Flush()
+
+	if failed > 0 {
+		if containers != nil {
+			containers.Release()
+		}
+		log.Fatalf("%d of %d backups failed verification", failed, len(names))
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/loginoff/nutanix-backup/nutanixapi/prismtest"
+)
+
+func TestRunVerifySkipsIncomplete(t *testing.T) {
+	e := setupE2E(t)
+	e.prism.AddVM("web1", "", prismtest.Disk{Bus: "scsi", Index: 0, ContainerUUID: testContainer, Data: testDisk(2, 64*1024)})
+	vms := e.resolve(t, VMBackup{Name: "web1"})
+	var result BackupResult
+	if err := BackupVM(context.Background(), e.ntnx, &vms[0], &result); err != nil {
+		t.Fatal(err)
+	}
+	containers.Release()
+
+	//An interrupted backup, without the manifest to verify against
+	interrupted := filepath.Join(BackupConfig.Backup_root, "web1_backup_20240115_1000")
+	if err := os.Mkdir(interrupted, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(interrupted, "scsi.0"), []byte("partial"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	//Fails the test by exiting when a backup fails verification
+	runVerify(nil)
+
+	backups := catalog.Find("web1", time.Time{}, time.Time{})
+	if len(backups) != 1 || backups[0].Verified.IsZero() || backups[0].Status != statusOK {
+		t.Fatalf("complete backup not verified: %+v", backups)
+	}
+	//The lock is released for the next run
+	lock, err := AcquireLock(filepath.Join(BackupConfig.Backup_root, lockFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock.Release()
+}